@@ -107,6 +107,41 @@ const (
 	TJPixelFormatUnknown TJPixelFormat = C.TJPF_UNKNOWN
 )
 
+// Ptr 返回指向f的指针，用来设置DecodeOptions的OutputPixelFormat
+func (f TJPixelFormat) Ptr() *TJPixelFormat {
+	return &f
+}
+
+// pixelFormatColorSpaces 像素格式和libjpeg输出色彩空间的对应关系
+var pixelFormatColorSpaces = map[TJPixelFormat]ColorSpace{
+	TJPixelFormatRGB:  ColorSpaceRGB,
+	TJPixelFormatBGR:  ColorSpaceExtBGR,
+	TJPixelFormatRGBX: ColorSpaceExtRGBX,
+	TJPixelFormatBGRX: ColorSpaceExtBGRX,
+	TJPixelFormatXBGR: ColorSpaceExtXBGR,
+	TJPixelFormatXRGB: ColorSpaceExtXRGB,
+	TJPixelFormatGray: ColorSpaceGrayScale,
+	TJPixelFormatRGBA: ColorSpaceExtRGBA,
+	TJPixelFormatBGRA: ColorSpaceExtBGRA,
+	TJPixelFormatABGR: ColorSpaceExtABGR,
+	TJPixelFormatARGB: ColorSpaceExtARGB,
+	TJPixelFormatCMYK: ColorSpaceCMYK,
+}
+
+// 各个像素格式中R、G、B分量的偏移和每个像素的字节数，下标是TJPixelFormat，和turbojpeg.h中的一致。
+var (
+	pixelRedOffset   = [...]int{0, 2, 0, 2, 3, 1, -1, 0, 2, 3, 1, -1}
+	pixelGreenOffset = [...]int{1, 1, 1, 1, 2, 2, -1, 1, 1, 2, 2, -1}
+	pixelBlueOffset  = [...]int{2, 0, 2, 0, 1, 3, -1, 2, 0, 1, 3, -1}
+	pixelSize        = [...]int{3, 3, 4, 4, 4, 4, 1, 4, 4, 4, 4, 4}
+)
+
+// 各个二次采样方法的MCU宽高，下标是TJSubSample，和turbojpeg.h中的tjMCUWidth、tjMCUHeight一致。
+var (
+	mcuWidth  = [...]int{8, 16, 16, 8, 8, 32}
+	mcuHeight = [...]int{8, 8, 16, 8, 16, 8}
+)
+
 // TJSubSample 二次采样方法，一般是4:2:0采样。
 type TJSubSample int
 
@@ -124,6 +159,8 @@ const (
 	TjSubSample440 TJSubSample = C.TJSAMP_440
 	// TjSubSample411 每个颜色分量对应包含4x1个像素区块，和420大小一样的，但是更好地表现横向特征。
 	TjSubSample411 TJSubSample = C.TJSAMP_411
+	// TjSubSampleUnknown 无法识别的采样方式，如各分量采样因子不规则的图片。
+	TjSubSampleUnknown TJSubSample = -1
 )
 
 const (
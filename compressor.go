@@ -0,0 +1,142 @@
+package gojpegturbo
+
+/*
+#cgo linux LDFLAGS: -lturbojpeg
+#cgo darwin LDFLAGS: -L/usr/local/opt/libjpeg-turbo/lib -lturbojpeg
+#cgo darwin CFLAGS: -I/usr/local/opt/libjpeg-turbo/include
+
+#include "goturbo.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+var (
+	// ErrHandleClosed Compressor或者Decompressor已经关闭了
+	ErrHandleClosed = errors.New("handle closed")
+)
+
+// Decompressor 可以复用的解码器，包装了libjpeg的jpeg_decompress_struct，多次解码之间不需要重新创建，省掉了初始化的开销，适合
+// 大量解码小图片的场景。只能解码内存里的图片，流式解码（DecodeReader、NewDecoder）还是每次创建。
+//
+// Decompressor不是并发安全的，每个goroutine用自己的。用完之后调用Close释放，忘了的话GC回收时也会释放。包里的Decode等函数
+// 用的是内部的池子，一般不需要自己创建。
+type Decompressor struct {
+	decoder *C.jpeg_decoder
+}
+
+// NewDecompressor 创建可以复用的解码器
+func NewDecompressor() (*Decompressor, error) {
+	decoder := C.jpeg_decoder_alloc()
+	if decoder == nil {
+		return nil, errors.New("jpeg_decoder_alloc failed")
+	}
+	d := &Decompressor{decoder: decoder}
+	runtime.SetFinalizer(d, (*Decompressor).Close)
+	return d, nil
+}
+
+// Close 释放解码器，可以重复调用
+func (d *Decompressor) Close() error {
+	if d.decoder == nil {
+		return nil
+	}
+	C.jpeg_decoder_destroy(d.decoder)
+	d.decoder = nil
+	runtime.SetFinalizer(d, nil)
+	return nil
+}
+
+// handle C的解码器。d为nil时返回NULL，C会临时创建一个
+func (d *Decompressor) handle() (*C.jpeg_decoder, error) {
+	if d == nil {
+		return nil, nil
+	}
+	if d.decoder == nil {
+		return nil, ErrHandleClosed
+	}
+	return d.decoder, nil
+}
+
+// Compressor 可以复用的编码器，包装了turbojpeg的tjhandle，多次编码之间不需要重新创建。
+//
+// Compressor不是并发安全的，每个goroutine用自己的。用完之后调用Close释放，忘了的话GC回收时也会释放。包里的Encode等函数用的是
+// 内部的池子，一般不需要自己创建。
+type Compressor struct {
+	tj C.tjhandle
+}
+
+// NewCompressor 创建可以复用的编码器
+func NewCompressor() (*Compressor, error) {
+	tj := C.tjInitCompress()
+	if tj == nil {
+		return nil, fmt.Errorf("tjInitCompress failed, err = %s", C.GoString(C.tjGetErrorStr2(nil)))
+	}
+	c := &Compressor{tj: tj}
+	runtime.SetFinalizer(c, (*Compressor).Close)
+	return c, nil
+}
+
+// Close 释放编码器，可以重复调用
+func (c *Compressor) Close() error {
+	if c.tj == nil {
+		return nil
+	}
+	C.tjDestroy(c.tj)
+	c.tj = nil
+	runtime.SetFinalizer(c, nil)
+	return nil
+}
+
+// handle turbojpeg的handle。c为nil时返回NULL，C会临时创建一个
+func (c *Compressor) handle() (C.tjhandle, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.tj == nil {
+		return nil, ErrHandleClosed
+	}
+	return c.tj, nil
+}
+
+// decompressorPool 包里的Decode等函数复用的解码器，GC时池子里的会被finalizer释放
+var decompressorPool = sync.Pool{
+	New: func() interface{} {
+		// 创建失败时返回nil，这次解码临时创建一个
+		d, _ := NewDecompressor()
+		return d
+	},
+}
+
+// compressorPool 包里的Encode等函数复用的编码器
+var compressorPool = sync.Pool{
+	New: func() interface{} {
+		c, _ := NewCompressor()
+		return c
+	},
+}
+
+func getDecompressor() *Decompressor {
+	return decompressorPool.Get().(*Decompressor)
+}
+
+func putDecompressor(d *Decompressor) {
+	if d != nil {
+		decompressorPool.Put(d)
+	}
+}
+
+func getCompressor() *Compressor {
+	return compressorPool.Get().(*Compressor)
+}
+
+func putCompressor(c *Compressor) {
+	if c != nil {
+		compressorPool.Put(c)
+	}
+}
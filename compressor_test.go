@@ -0,0 +1,219 @@
+package gojpegturbo
+
+import (
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompressor(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	grayBuf, err := ioutil.ReadFile("./testdata/gray.jpg")
+	require.NoError(t, err)
+	cmykBuf, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	errBuf, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+	crop := image.Rect(100, 200, 400, 500)
+	paletted := NewDecodeOptions()
+	paletted.DesiredNumberOfColors = 64
+
+	d, err := NewDecompressor()
+	require.NoError(t, err)
+	defer d.Close()
+	// 同一个解码器按顺序解码各种图片和参数，结果要和临时创建的解码器一样，上一次的设置不能影响下一次
+	tests := []struct {
+		name     string
+		img      []byte
+		options  *DecodeOptions
+		paletted bool
+		wantErr  bool
+	}{
+		{name: "auto orient", img: withOrientation(buf, 6, false), options: &DecodeOptions{AutoOrient: true}},
+		{name: "plain after auto orient", img: withOrientation(buf, 6, false)},
+		{name: "crop and scale", img: buf, options: &DecodeOptions{CropRect: &crop, ScaleNum: 1, ScaleDenom: 2}},
+		{name: "full after crop", img: buf},
+		{name: "error image", img: errBuf, wantErr: true},
+		{name: "valid after error", img: buf},
+		{name: "cmyk", img: cmykBuf},
+		{name: "gray to rgb", img: grayBuf, options: &DecodeOptions{OutputPixelFormat: TJPixelFormatRGB.Ptr()}},
+		{name: "paletted", img: buf, options: paletted, paletted: true},
+		{name: "crop after paletted", img: buf, options: &DecodeOptions{CropRect: &crop}},
+		{name: "icc profile", img: withICCProfile(buf, buildICCProfile("RGB ", displayP3Primaries, srgbTRC)),
+			options: &DecodeOptions{ConvertToSRGB: true}},
+		{name: "gray", img: grayBuf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.paletted {
+				got, err := d.DecodePaletted(tt.img, tt.options)
+				require.NoError(t, err)
+				want, err := DecodePaletted(tt.img, tt.options)
+				require.NoError(t, err)
+				assert.Equal(t, want, got)
+				return
+			}
+			got, err := d.Decode(tt.img, tt.options)
+			want, wantErr := decodeOnce(tt.img, tt.options)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, wantErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			size, err := d.RequiredBufferSize(tt.img, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, len(want.Img), size)
+			dst := &ImageAttr{Img: make([]byte, size)}
+			require.NoError(t, d.DecodeInto(tt.img, dst, tt.options))
+			assert.Equal(t, want.Img, dst.Img)
+		})
+	}
+
+	assert.NoError(t, d.Close())
+	assert.NoError(t, d.Close())
+	_, err = d.Decode(buf, nil)
+	assert.Equal(t, ErrHandleClosed, err)
+	_, err = d.DecodePaletted(buf, nil)
+	assert.Equal(t, ErrHandleClosed, err)
+	_, err = d.RequiredBufferSize(buf, nil)
+	assert.Equal(t, ErrHandleClosed, err)
+	assert.Equal(t, ErrHandleClosed, d.DecodeInto(buf, &ImageAttr{Img: make([]byte, 1)}, nil))
+}
+
+// decodeOnce 用临时创建的解码器解码
+func decodeOnce(img []byte, options *DecodeOptions) (*ImageAttr, error) {
+	var d *Decompressor
+	return d.Decode(img, options)
+}
+
+func TestCompressor(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	cmykBuf, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	cmyk, err := Decode(cmykBuf, nil)
+	require.NoError(t, err)
+
+	c, err := NewCompressor()
+	require.NoError(t, err)
+	defer c.Close()
+	tests := []struct {
+		name    string
+		img     *ImageAttr
+		options *EncodeOptions
+	}{
+		{name: "default", img: img},
+		{name: "progressive", img: img, options: &EncodeOptions{Quality: 90, SubSample: TjSubSample444, Progressive: true}},
+		{name: "baseline after progressive", img: img, options: &EncodeOptions{Quality: 75, SubSample: TjSubSample420}},
+		{name: "cmyk", img: cmyk, options: &EncodeOptions{Quality: 80, SubSample: TjSubSampleUnknown}},
+		{name: "fast dct", img: img, options: &EncodeOptions{Quality: 60, SubSample: TjSubSample422, FastDct: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Encode(tt.img, tt.options)
+			require.NoError(t, err)
+			var once *Compressor
+			want, err := once.Encode(tt.img, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			dst := make([]byte, EncodeBufferSize(tt.img.ImageWidth, tt.img.ImageHeight, tt.options))
+			n, err := c.EncodeInto(tt.img, dst, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, want, dst[:n])
+		})
+	}
+	_, err = c.Encode(img, &EncodeOptions{Quality: 101})
+	assert.Equal(t, ErrQualityOption, err)
+	_, err = c.Encode(img, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Close())
+	assert.NoError(t, c.Close())
+	_, err = c.Encode(img, nil)
+	assert.Equal(t, ErrHandleClosed, err)
+	_, err = c.EncodeInto(img, make([]byte, EncodeBufferSize(img.ImageWidth, img.ImageHeight, nil)), nil)
+	assert.Equal(t, ErrHandleClosed, err)
+	_, err = c.Encode(img, &EncodeOptions{Quality: 90, Comments: []string{"comment"}})
+	assert.Equal(t, ErrHandleClosed, err)
+	_, err = c.EncodeInto(img, nil, &EncodeOptions{Quality: 90, Comments: []string{"comment"}})
+	assert.Equal(t, ErrHandleClosed, err)
+}
+
+// smallJPEG 缩略图大小的图片，创建解码器、编码器的开销占比更明显
+func smallJPEG(b *testing.B) ([]byte, *ImageAttr) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	img, err := Decode(buf, &DecodeOptions{ScaleNum: 1, ScaleDenom: 8})
+	require.NoError(b, err)
+	small, err := Encode(img, nil)
+	require.NoError(b, err)
+	return small, img
+}
+
+func BenchmarkDecompressor_Reuse(b *testing.B) {
+	buf, _ := smallJPEG(b)
+	d, err := NewDecompressor()
+	require.NoError(b, err)
+	defer d.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := d.Decode(buf, nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
+
+func BenchmarkDecompressor_New(b *testing.B) {
+	buf, _ := smallJPEG(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, err := NewDecompressor()
+		require.NoError(b, err)
+		_, err = d.Decode(buf, nil)
+		assert.NoError(b, err)
+		d.Close()
+	}
+	b.SetBytes(int64(len(buf)))
+}
+
+func BenchmarkCompressor_Reuse(b *testing.B) {
+	buf, img := smallJPEG(b)
+	c, err := NewCompressor()
+	require.NoError(b, err)
+	defer c.Close()
+	dst := make([]byte, EncodeBufferSize(img.ImageWidth, img.ImageHeight, nil))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := c.EncodeInto(img, dst, nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
+
+func BenchmarkCompressor_New(b *testing.B) {
+	buf, img := smallJPEG(b)
+	dst := make([]byte, EncodeBufferSize(img.ImageWidth, img.ImageHeight, nil))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := NewCompressor()
+		require.NoError(b, err)
+		_, err = c.EncodeInto(img, dst, nil)
+		assert.NoError(b, err)
+		c.Close()
+	}
+	b.SetBytes(int64(len(buf)))
+}
@@ -0,0 +1,86 @@
+package gojpegturbo
+
+/*
+#cgo linux LDFLAGS: -lturbojpeg
+#cgo darwin LDFLAGS: -L/usr/local/opt/libjpeg-turbo/lib -lturbojpeg
+#cgo darwin CFLAGS: -I/usr/local/opt/libjpeg-turbo/include
+
+#include "goturbo.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"unsafe"
+)
+
+// DecodeContext 和Decode一样，但是解码过程中ctx取消或者超时时会中止解码，返回ctx.Err()。libjpeg每解码一批扫描线，或者渐进式
+// 图片每读取一个iMCU行检查一次，恶意构造的超大图片也能及时退出。
+func DecodeContext(ctx context.Context, img []byte, options *DecodeOptions) (*ImageAttr, error) {
+	d := getDecompressor()
+	defer putDecompressor(d)
+	return d.DecodeContext(ctx, img, options)
+}
+
+// EncodeContext 和Encode一样，但是编码过程中ctx取消或者超时时会中止编码，返回ctx.Err()。turbojpeg没法中途取消，ctx可以取消的
+// 时候用libjpeg的流式编码器（见EncodeWriter），参数的选择和Encode一样，但是输出不保证逐字节相同。
+func EncodeContext(ctx context.Context, img *ImageAttr, options *EncodeOptions) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return Encode(img, options)
+	}
+	if err := checkEncodeImage(img); err != nil {
+		return nil, err
+	}
+	cancel := watchContext(ctx)
+	defer cancel.stop()
+	buf := bytes.NewBuffer(make([]byte, 0, len(img.Img)/8))
+	if err := encodeWriter(buf, img, options, cancel.flag); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cancelFlag ctx取消时由Go设置、C在progress monitor里检查的标志。C会在编解码过程中读取，所以放在C的内存里
+type cancelFlag struct {
+	flag   *C.int
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// watchContext 创建取消标志并在后台等待ctx取消，ctx不能取消时返回nil，用完之后要调用stop
+func watchContext(ctx context.Context) *cancelFlag {
+	if ctx.Done() == nil {
+		return nil
+	}
+	c := &cancelFlag{
+		flag:   (*C.int)(C.calloc(1, C.sizeof_int)),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		defer close(c.exited)
+		select {
+		case <-ctx.Done():
+			C.jpeg_cancel(c.flag)
+		case <-c.done:
+		}
+	}()
+	return c
+}
+
+// stop 停止等待ctx，goroutine退出后才释放标志
+func (c *cancelFlag) stop() {
+	if c == nil {
+		return
+	}
+	close(c.done)
+	<-c.exited
+	C.free(unsafe.Pointer(c.flag))
+}
@@ -0,0 +1,142 @@
+package gojpegturbo
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bigImage 足够大的图片，编解码都要一段时间，可以在中途取消
+func bigImage(t *testing.T) (*ImageAttr, []byte) {
+	img := &ImageAttr{ImageWidth: 2000, ImageHeight: 2000, ComponentsNum: 3, ColorSpace: ColorSpaceRGB}
+	img.Img = make([]byte, img.ImageWidth*img.ImageHeight*img.ComponentsNum)
+	for i := range img.Img {
+		img.Img[i] = byte(i % 251)
+	}
+	buf, err := Encode(img, &EncodeOptions{Quality: 90, SubSample: TjSubSample444, Progressive: true})
+	require.NoError(t, err)
+	return img, buf
+}
+
+func TestDecodeContext(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	cmykBuf, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	errBuf, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+
+	// 没有取消的时候和Decode的结果一样
+	tests := []struct {
+		name    string
+		img     []byte
+		options *DecodeOptions
+	}{
+		{name: "nil options", img: buf},
+		{name: "default options", img: buf, options: NewDecodeOptions()},
+		{name: "scale", img: buf, options: &DecodeOptions{ScaleNum: 1, ScaleDenom: 2, DoFancyUpSampling: true}},
+		{name: "cmyk", img: cmykBuf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := Decode(tt.img, tt.options)
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			got, err := DecodeContext(ctx, tt.img, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			got, err = DecodeContext(context.Background(), tt.img, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = DecodeContext(ctx, buf, nil)
+	assert.Equal(t, context.Canceled, err)
+	_, err = DecodeContext(context.Background(), errBuf, nil)
+	assert.Error(t, err)
+	_, err = DecodeContext(context.Background(), nil, nil)
+	assert.Equal(t, ErrEmptyImage, err)
+
+	// 解码到一半超时，解码器可以继续用
+	_, big := bigImage(t)
+	d, err := NewDecompressor()
+	require.NoError(t, err)
+	defer d.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = d.DecodeContext(ctx, big, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	want, err := Decode(buf, nil)
+	require.NoError(t, err)
+	got, err := d.Decode(buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestEncodeContext(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	cmykBuf, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	cmyk, err := Decode(cmykBuf, nil)
+	require.NoError(t, err)
+
+	// 没有取消的时候，ctx不能取消时和Encode的结果一样，否则和EncodeWriter一样
+	tests := []struct {
+		name    string
+		img     *ImageAttr
+		options *EncodeOptions
+	}{
+		{name: "nil options", img: img},
+		{name: "progressive", img: img, options: &EncodeOptions{Quality: 90, SubSample: TjSubSample444, Progressive: true}},
+		{name: "cmyk", img: cmyk, options: &EncodeOptions{Quality: 80, SubSample: TjSubSampleUnknown}},
+		{name: "metadata", img: img, options: &EncodeOptions{Quality: 80, SubSample: TjSubSample420,
+			Markers: []Marker{{Marker: MarkerCOM, Data: []byte("comment")}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := Encode(tt.img, tt.options)
+			require.NoError(t, err)
+			got, err := EncodeContext(context.Background(), tt.img, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			w := bytes.NewBuffer(nil)
+			require.NoError(t, EncodeWriter(w, tt.img, tt.options))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			got, err = EncodeContext(ctx, tt.img, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, w.Bytes(), got)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = EncodeContext(ctx, img, nil)
+	assert.Equal(t, context.Canceled, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_, err = EncodeContext(ctx, img, &EncodeOptions{Quality: 101})
+	assert.Equal(t, ErrQualityOption, err)
+	_, err = EncodeContext(ctx, &ImageAttr{}, nil)
+	assert.Equal(t, ErrImgEmpty, err)
+
+	// 编码到一半超时
+	big, _ := bigImage(t)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = EncodeContext(ctx, big, &EncodeOptions{Quality: 90, SubSample: TjSubSample444, Progressive: true})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
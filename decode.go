@@ -10,43 +10,67 @@ package gojpegturbo
 import "C"
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"runtime"
+	"runtime/cgo"
 	"unsafe"
 )
 
 // DecodeOptions 解码图片时的选项
 type DecodeOptions struct {
-	// CropRect 图片剪裁区域，默认不剪裁
+	// CropRect 图片剪裁区域，默认不剪裁。坐标是原图的坐标，和缩放一起使用时会映射到缩放后的图片上，左上角向下取整、右下角向上
+	// 取整，如600*800的图片剪裁(100,200)-(300,621)，缩放1/2后输出的是(50,100)-(150,311)，即100*211。
 	CropRect *image.Rectangle
 	// DctMethod 解码的时候使用的方法。
 	// 现在的计算机上有AVX2，JDCT_IFAST和JDCT_ISLOW有相似的性能。如果JPEG图像使用85质量一下的等级压缩的，那么这两种算法
 	// 应该没有差别。如果高于85，实践中如quality=97，JDCT_IFAST通常会比JDCT_ISLOW的PSNR低大约4-6dB。因此一般不是用
 	// JDCT_IFAST。对于JDCT_FLOAT并不一定质量就好，因为每个机器的四舍五入情况不一致。
 	DctMethod DctMethod
-	// TwoPassQuantize 默认是true。
+	// TwoPassQuantize 生成颜色表时先扫描一遍整张图片选出最合适的颜色，默认是true。为false时用固定的颜色表，速度快但是效果差。
+	// 颜色表相关的选项只在DecodePaletted里生效。
 	TwoPassQuantize bool
 	// DitherMode 抖动方法，默认是DitherFs。
 	DitherMode DitherMode
-	// DesiredNumberOfColors 颜色表使用的颜色数量，默认是256。
+	// DesiredNumberOfColors 颜色表使用的颜色数量，最多256个，0（零值）也是256。TwoPassQuantize时至少8个，否则至少2个（彩色图片
+	// 每个分量至少要2个，也就是8个）。
 	DesiredNumberOfColors int
 	// DoFancyUpSampling 升采样是否使用精确的，默认是true。
 	DoFancyUpSampling bool
 	// ScaleNum 按比例缩放图片，在MCU升降采样的时候就能生效，一般为1
 	ScaleNum uint
-	// ScaleDenom 缩放比例的分母，为了保证图片效果，一般取值为 1/2, 1/4, 1/8...
+	// ScaleDenom 缩放比例的分母，libjpeg-turbo支持 1/8 到 16/8 的所有 N/8 比例，见 AvailableScalingFactors
 	ScaleDenom uint
 	// ExpectWidth 预期宽度，根据图片宽高使用ScaleNum和ScaleDenom参数调整缩放比例。如果设置了会覆盖ScaleNum和ScaleDenom的值。这里缩放的
 	// 意义在于能在解码阶段低成本的缩放图片，尽量节省 CPU 和内存，且对实际使用效果影响很小。
 	//
-	// WARNING: 这里只是期望值，并不是实际值，内部会尽量等比缩放到不低于期望值的最合理值，它始终只会以 1/2，1/4，1/8 这样的比例缩小图片。如输入
-	// 尺寸为 600*800，期望值为 100*200，则实际结果为 150*200；若期望值为 250*300， 则实际结果为 300*400。
+	// WARNING: 这里只是期望值，并不是实际值，内部会尽量等比缩放到不低于期望值的最合理值，它只会以 AvailableScalingFactors 中小于1的
+	// N/8 比例（1/8，1/4，3/8 ... 7/8）缩小图片，不会放大。如输入尺寸为 600*800，期望值为 100*200，则实际结果为 150*200；若期望值为
+	// 200*250，则实际结果为 225*300；若期望值为 250*300， 则实际结果为 300*400。
+	//
+	// 设置了CropRect时，期望值是剪裁区域缩放后的尺寸。
 	ExpectWidth uint
 	// ExpectHeight 预期高度，根据图片宽高使用ScaleNum和ScaleDenom参数调整缩放比例
 	ExpectHeight uint
+	// CMYKToRGB CMYK和YCCK的图片解码后转成RGB输出，方便后续编码和缩放。默认输出4个分量的CMYK。
+	CMYKToRGB bool
+	// OutputPixelFormat 解码输出的像素格式，由libjpeg在解码时直接转换，不需要再在Go里逐个像素转换。如BGRA可以直接给Skia、Cairo
+	// 使用，RGBA可以直接转成image.RGBA。默认是nil，即保持JPEG原来的格式（RGB、gray或CMYK），TJPixelFormatUnknown也一样。
+	// 可以这样设置：options.OutputPixelFormat = TJPixelFormatBGRA.Ptr()
+	OutputPixelFormat *TJPixelFormat
+	// AutoOrient 按照EXIF里的Orientation旋转或翻转图片，手机拍的照片不会再横着。Orientation是5到8的时候图片的宽高（包括
+	// OriginWidth和OriginHeight）会互换。设置了之后CropRect、ExpectWidth和ExpectHeight都是旋转后图片的坐标和尺寸。
+	//
+	// 旋转需要整张图片，Decoder不支持这个选项。
+	AutoOrient bool
+	// ConvertToSRGB 按照图片内嵌的ICC profile把像素转换到sRGB，Display P3、Adobe RGB等广色域的图片不会再发灰。只支持RGB的
+	// matrix/TRC profile（相机和手机常用的都是），超出sRGB色域的颜色直接截断。没有ICC profile、profile本身就是sRGB、profile
+	// 不支持或者输出的是灰度、CMYK时不转换，是否转换了见ImageAttr和Decoder的ConvertedToSRGB。
+	ConvertToSRGB bool
 }
 
 // NewDecodeOptions 创建一个默认的解码图片选项
@@ -65,10 +89,6 @@ func (options *DecodeOptions) toCOptions() (*C.jpeg_decode_options, error) {
 	if options == nil {
 		return nil, nil
 	}
-	// 暂时不支持scale & crop同时，会有panic。
-	if options.CropRect != nil && (options.ScaleNum > 0 || options.ScaleDenom > 0) {
-		return nil, ErrOptionsUnsupported
-	}
 	co := &C.jpeg_decode_options{
 		dct_method:               C.J_DCT_METHOD(options.DctMethod),
 		dither_mode:              C.J_DITHER_MODE(options.DitherMode),
@@ -84,6 +104,22 @@ func (options *DecodeOptions) toCOptions() (*C.jpeg_decode_options, error) {
 	if options.DoFancyUpSampling {
 		co.do_fancy_upsampling = C.int(1)
 	}
+	if options.CMYKToRGB {
+		co.cmyk_to_rgb = C.int(1)
+	}
+	if options.AutoOrient {
+		co.auto_orient = C.int(1)
+	}
+	if options.ConvertToSRGB {
+		co.read_icc_profile = C.int(1)
+	}
+	if options.OutputPixelFormat != nil && *options.OutputPixelFormat != TJPixelFormatUnknown {
+		colorSpace, ok := pixelFormatColorSpaces[*options.OutputPixelFormat]
+		if !ok {
+			return nil, ErrOptionsUnsupported
+		}
+		co.out_color_space = C.J_COLOR_SPACE(colorSpace)
+	}
 	if options.CropRect != nil {
 		co.crop.left = C.uint(uint(options.CropRect.Min.X))
 		co.crop.top = C.uint(uint(options.CropRect.Min.Y))
@@ -104,27 +140,265 @@ var (
 
 // Decode 解码JPEG图片
 func Decode(img []byte, options *DecodeOptions) (*ImageAttr, error) {
+	d := getDecompressor()
+	defer putDecompressor(d)
+	return d.Decode(img, options)
+}
+
+// Decode 解码JPEG图片，见Decode
+func (d *Decompressor) Decode(img []byte, options *DecodeOptions) (*ImageAttr, error) {
+	return d.DecodeContext(context.Background(), img, options)
+}
+
+// DecodeContext 解码JPEG图片，ctx取消时中止解码，见DecodeContext
+func (d *Decompressor) DecodeContext(ctx context.Context, img []byte, options *DecodeOptions) (*ImageAttr, error) {
 	if len(img) == 0 {
 		return nil, ErrEmptyImage
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	decoder, err := d.handle()
+	if err != nil {
+		return nil, err
+	}
 	jres := C.jpeg_decode_result{}
 	co, err := options.toCOptions()
 	if err != nil {
 		return nil, err
 	}
-	C.jpeg_decode((*C.uchar)(unsafe.Pointer(&img[0])), C.uint(uint(len(img))), co, &jres)
+	cancel := watchContext(ctx)
+	defer cancel.stop()
+	if cancel != nil {
+		// options为nil时C用libjpeg的默认参数，和NewDecodeOptions一样
+		if co == nil {
+			co, _ = NewDecodeOptions().toCOptions()
+		}
+		co.cancel = cancel.flag
+	}
+	C.jpeg_decode(decoder, (*C.uchar)(unsafe.Pointer(&img[0])), C.uint(uint(len(img))), co, &jres)
+	// 解码过程中d不能被finalizer释放
+	runtime.KeepAlive(d)
+	imgAttr, err := newImageAttr(&jres, "jpeg_decode")
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return imgAttr, err
+}
+
+// DecodeReader 流式解码reader过来的图片，每次只从reader读取一小块数据交给libjpeg，不需要把整个图片读进内存，内存占用只有解码后的
+// 像素和一个读取的buffer。
+func DecodeReader(r io.Reader, options *DecodeOptions) (*ImageAttr, error) {
+	co, err := options.toCOptions()
+	if err != nil {
+		return nil, err
+	}
+	reader := &jpegReader{r: r}
+	handle := cgo.NewHandle(reader)
+	defer handle.Delete()
+	jres := C.jpeg_decode_result{}
+	C.jpeg_decode_reader(C.uintptr_t(handle), C.uint(readerBufferSize), co, &jres)
+	if err := reader.readErr(); err != nil {
+		if jres.img != nil {
+			C.free(unsafe.Pointer(jres.img))
+		}
+		if jres.icc_profile != nil {
+			C.free(unsafe.Pointer(jres.icc_profile))
+		}
+		if jres.err != nil {
+			C.free(unsafe.Pointer(jres.err))
+		}
+		return nil, err
+	}
+	if reader.total == 0 {
+		if jres.err != nil {
+			C.free(unsafe.Pointer(jres.err))
+		}
+		return nil, ErrEmptyImage
+	}
+	return newImageAttr(&jres, "jpeg_decode_reader")
+}
+
+// DecodeInto 把图片直接解码到dst.Img里，不需要C分配内存再复制一遍，dst.Img可以在多次解码之间复用。dst.Img的容量（cap）
+// 至少是RequiredBufferSize，不够时返回ErrBufferTooSmall，dst不会被修改。解码成功后dst的各个字段和Decode返回的一样，dst.Img的
+// 长度是像素的字节数。dst不能为nil。
+func DecodeInto(img []byte, dst *ImageAttr, options *DecodeOptions) error {
+	d := getDecompressor()
+	defer putDecompressor(d)
+	return d.DecodeInto(img, dst, options)
+}
+
+// DecodeInto 把图片直接解码到dst.Img里，见DecodeInto
+func (d *Decompressor) DecodeInto(img []byte, dst *ImageAttr, options *DecodeOptions) error {
+	if len(img) == 0 {
+		return ErrEmptyImage
+	}
+	decoder, err := d.handle()
+	if err != nil {
+		return err
+	}
+	buf := dst.Img[:cap(dst.Img)]
+	// C里dst为NULL时会自己分配内存，空的buffer先检查图片再返回buffer不够
+	if len(buf) == 0 {
+		if _, err := d.RequiredBufferSize(img, options); err != nil {
+			return err
+		}
+		return ErrBufferTooSmall
+	}
+	co, err := options.toCOptions()
+	if err != nil {
+		return err
+	}
+	jres := C.jpeg_decode_result{}
+	C.jpeg_decode_into(decoder, (*C.uchar)(unsafe.Pointer(&img[0])), C.uint(uint(len(img))), co,
+		(*C.uchar)(unsafe.Pointer(&buf[0])), C.size_t(len(buf)), &jres)
+	runtime.KeepAlive(d)
+	icc := takeICCProfile(&jres)
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return fmt.Errorf("jpeg_decode_into failed, err = %s", C.GoString(jres.err))
+	}
+	size := int(jres.img_size)
+	if size == 0 {
+		return ErrEmptyDecode
+	}
+	if size > len(buf) {
+		return ErrBufferTooSmall
+	}
+	dst.setResult(&jres, buf[:size], icc)
+	return nil
+}
+
+// RequiredBufferSize 计算按options解码后的像素需要多少字节，考虑了剪裁、缩放和输出的像素格式，用来给DecodeInto准备buffer。
+// 只读取header，不会解码像素，header可以是整张图片，也可以只是到SOS为止的部分（如从io.Reader读取的header）。
+func RequiredBufferSize(header []byte, options *DecodeOptions) (int, error) {
+	d := getDecompressor()
+	defer putDecompressor(d)
+	return d.RequiredBufferSize(header, options)
+}
+
+// RequiredBufferSize 计算解码后的像素需要多少字节，见RequiredBufferSize
+func (d *Decompressor) RequiredBufferSize(header []byte, options *DecodeOptions) (int, error) {
+	if len(header) == 0 {
+		return 0, ErrEmptyImage
+	}
+	decoder, err := d.handle()
+	if err != nil {
+		return 0, err
+	}
+	co, err := options.toCOptions()
+	if err != nil {
+		return 0, err
+	}
+	jres := C.jpeg_decode_result{}
+	C.jpeg_decode_output_size(decoder, (*C.uchar)(unsafe.Pointer(&header[0])), C.uint(uint(len(header))), co, &jres)
+	runtime.KeepAlive(d)
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return 0, fmt.Errorf("jpeg_decode_output_size failed, err = %s", C.GoString(jres.err))
+	}
+	if jres.img_size == 0 {
+		return 0, ErrEmptyDecode
+	}
+	return int(jres.img_size), nil
+}
+
+// DecodePaletted 解码JPEG图片，并用libjpeg的color quantizer把颜色减少到DesiredNumberOfColors个，返回*image.Paletted，可以
+// 直接编码成GIF或者PNG-8。彩色图片的颜色表是RGB的，灰度图是灰度的，不支持CMYK图片。options为nil时使用NewDecodeOptions的默认值，
+// OutputPixelFormat和CMYKToRGB会被忽略；设置了ConvertToSRGB时转换的是颜色表。
+func DecodePaletted(img []byte, options *DecodeOptions) (*image.Paletted, error) {
+	d := getDecompressor()
+	defer putDecompressor(d)
+	return d.DecodePaletted(img, options)
+}
+
+// DecodePaletted 解码成*image.Paletted，见DecodePaletted
+func (d *Decompressor) DecodePaletted(img []byte, options *DecodeOptions) (*image.Paletted, error) {
+	if len(img) == 0 {
+		return nil, ErrEmptyImage
+	}
+	decoder, err := d.handle()
+	if err != nil {
+		return nil, err
+	}
+	if options == nil {
+		options = NewDecodeOptions()
+	}
+	numColors := options.DesiredNumberOfColors
+	if numColors == 0 {
+		numColors = 256
+	}
+	// libjpeg颜色太少时会报JERR_QUANT_FEW_COLORS，太多时报JERR_QUANT_MANY_COLORS，这里提前检查
+	if numColors < 2 || numColors > 256 || (options.TwoPassQuantize && numColors < 8) {
+		return nil, ErrOptionsUnsupported
+	}
+	co, err := options.toCOptions()
+	if err != nil {
+		return nil, err
+	}
+	co.quantize_colors = C.int(1)
+	co.desired_number_of_colors = C.int(numColors)
+	co.out_color_space = C.JCS_UNKNOWN
+	jres := C.jpeg_decode_result{}
+	C.jpeg_decode(decoder, (*C.uchar)(unsafe.Pointer(&img[0])), C.uint(uint(len(img))), co, &jres)
+	runtime.KeepAlive(d)
+	var colormap []byte
+	if jres.colormap != nil {
+		colormap = C.GoBytes(unsafe.Pointer(jres.colormap), C.int(int(jres.num_colors)*int(jres.num_components)))
+		C.free(unsafe.Pointer(jres.colormap))
+	}
+	// 像素是颜色表的下标，只能转换颜色表
+	icc := takeICCProfile(&jres)
+	imgAttr, err := newImageAttr(&jres, "jpeg_decode")
+	if err != nil {
+		return nil, err
+	}
+	if len(colormap) == 0 {
+		return nil, ErrEmptyDecode
+	}
+	palette := make(color.Palette, 0, len(colormap)/imgAttr.ComponentsNum)
+	if imgAttr.ComponentsNum == 1 {
+		for _, y := range colormap {
+			palette = append(palette, color.Gray{Y: y})
+		}
+	} else {
+		if t := newSRGBTransformFor(icc, TJPixelFormatRGB); t != nil {
+			t.convert(colormap, TJPixelFormatRGB)
+		}
+		for i := 0; i+2 < len(colormap); i += 3 {
+			palette = append(palette, color.RGBA{R: colormap[i], G: colormap[i+1], B: colormap[i+2], A: 0xff})
+		}
+	}
+	return &image.Paletted{
+		Pix:     imgAttr.Img,
+		Stride:  imgAttr.ImageWidth,
+		Rect:    imgAttr.Bounds(),
+		Palette: palette,
+	}, nil
+}
+
+// newImageAttr 把C的解码结果转成ImageAttr，并释放C分配的内存
+func newImageAttr(jres *C.jpeg_decode_result, name string) (*ImageAttr, error) {
 	if jres.img != nil {
 		defer C.free(unsafe.Pointer(jres.img))
 	}
+	icc := takeICCProfile(jres)
 	if jres.err != nil {
 		defer C.free(unsafe.Pointer(jres.err))
-		return nil, fmt.Errorf("jpeg_decode failed, err = %s", C.GoString(jres.err))
+		return nil, fmt.Errorf("%s failed, err = %s", name, C.GoString(jres.err))
 	}
 	if jres.img == nil || int(jres.img_size) == 0 {
 		return nil, ErrEmptyDecode
 	}
-	imgAttr := &ImageAttr{
-		Img:           C.GoBytes(unsafe.Pointer(jres.img), C.int(int(jres.img_size))),
+	imgAttr := &ImageAttr{}
+	imgAttr.setResult(jres, C.GoBytes(unsafe.Pointer(jres.img), C.int(int(jres.img_size))), icc)
+	return imgAttr, nil
+}
+
+// setResult 用C的解码结果设置ImageAttr，pix是解码后的像素，有ICC profile时按需转换到sRGB
+func (img *ImageAttr) setResult(jres *C.jpeg_decode_result, pix []byte, icc []byte) {
+	*img = ImageAttr{
+		Img:           pix,
 		ImageWidth:    int(jres.image_width),
 		ImageHeight:   int(jres.image_height),
 		OriginWidth:   int(jres.origin_width),
@@ -132,14 +406,133 @@ func Decode(img []byte, options *DecodeOptions) (*ImageAttr, error) {
 		ColorSpace:    ColorSpace(jres.color_space),
 		ComponentsNum: int(jres.num_components),
 	}
-	return imgAttr, nil
+	if t := newSRGBTransformFor(icc, img.PixelFormat()); t != nil {
+		t.convert(img.Img, img.PixelFormat())
+		img.ConvertedToSRGB = true
+	}
 }
 
-// DecodeReader 解码reader过来的图片
-func DecodeReader(r io.Reader, options *DecodeOptions) (*ImageAttr, error) {
-	buf := bytes.NewBuffer(nil)
-	if _, err := buf.ReadFrom(r); err != nil {
+// takeICCProfile 把C的解码结果里的ICC profile复制出来，并释放C分配的内存
+func takeICCProfile(jres *C.jpeg_decode_result) []byte {
+	if jres.icc_profile == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(jres.icc_profile))
+	icc := C.GoBytes(unsafe.Pointer(jres.icc_profile), C.int(int(jres.icc_profile_size)))
+	jres.icc_profile = nil
+	return icc
+}
+
+// ScalingFactor 解码时的缩放比例，Num/Denom
+type ScalingFactor struct {
+	Num   int
+	Denom int
+}
+
+// Scale 计算边长按比例缩放后的长度，和libjpeg-turbo一样向上取整
+func (f ScalingFactor) Scale(dimension int) int {
+	return (dimension*f.Num + f.Denom - 1) / f.Denom
+}
+
+// AvailableScalingFactors 返回libjpeg-turbo解码时支持的所有缩放比例，从大到小排列，一般是 16/8 到 1/8 的所有 N/8 比例。
+// 可以用来设置 DecodeOptions 的 ScaleNum 和 ScaleDenom。
+func AvailableScalingFactors() []ScalingFactor {
+	var num C.int
+	factors := C.tjGetScalingFactors(&num)
+	if factors == nil || num <= 0 {
+		return nil
+	}
+	result := make([]ScalingFactor, 0, int(num))
+	for _, factor := range unsafe.Slice(factors, int(num)) {
+		result = append(result, ScalingFactor{Num: int(factor.num), Denom: int(factor.denom)})
+	}
+	return result
+}
+
+// ImageConfig 图片的头部信息，只需要解析JPEG的header就能得到，不需要解码像素。
+type ImageConfig struct {
+	OriginWidth, OriginHeight int         // 原始图片宽高
+	ColorSpace                ColorSpace  // JPEG文件的色彩空间
+	SubSample                 TJSubSample // 二次采样方法，无法识别时为TjSubSampleUnknown
+	ComponentsNum             int         // 颜色分量数，如YCbCr就是3。
+	Progressive               bool        // 是否渐进式编码，false则为baseline
+	Precision                 int         // 每个采样的精度，一般是8
+}
+
+// DecodeConfig 只读取JPEG图片的header，得到宽高、色彩空间和采样方法等信息，不会解码像素，开销很小。
+func DecodeConfig(img []byte) (*ImageConfig, error) {
+	if len(img) == 0 {
+		return nil, ErrEmptyImage
+	}
+	jres := C.jpeg_decode_config_result{}
+	C.jpeg_decode_config((*C.uchar)(unsafe.Pointer(&img[0])), C.uint(uint(len(img))), &jres)
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return nil, fmt.Errorf("jpeg_decode_config failed, err = %s", C.GoString(jres.err))
+	}
+	return &ImageConfig{
+		OriginWidth:   int(jres.origin_width),
+		OriginHeight:  int(jres.origin_height),
+		ColorSpace:    ColorSpace(jres.color_space),
+		SubSample:     TJSubSample(jres.sub_sample),
+		ComponentsNum: int(jres.num_components),
+		Progressive:   jres.progressive != 0,
+		Precision:     int(jres.precision),
+	}, nil
+}
+
+// DecodeConfigReader 从reader中读取JPEG图片的header。只会读到SOS段为止，后面的图片数据不会被读取。
+func DecodeConfigReader(r io.Reader) (*ImageConfig, error) {
+	header, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeConfig(header)
+}
+
+// readHeader 从reader中按段读取JPEG的header，直到读完SOS段。不是合法的标记时直接返回，交给libjpeg报错。
+func readHeader(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 2, 1024)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
 	}
-	return Decode(buf.Bytes(), options)
+	if buf[0] != 0xff || buf[1] != 0xd8 {
+		return buf, nil
+	}
+	marker := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return nil, err
+		}
+		// 标记前面允许有任意个0xff填充
+		for marker[0] == 0xff && marker[1] == 0xff {
+			if _, err := io.ReadFull(r, marker[1:]); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, marker...)
+		if marker[0] != 0xff || marker[1] == 0xd9 {
+			return buf, nil
+		}
+		// TEM和RSTn是没有长度的标记
+		if marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd7) {
+			continue
+		}
+		start := len(buf)
+		buf = append(buf, 0, 0)
+		if _, err := io.ReadFull(r, buf[start:]); err != nil {
+			return nil, err
+		}
+		length := int(buf[start])<<8 | int(buf[start+1])
+		if length < 2 {
+			return buf, nil
+		}
+		buf = append(buf, make([]byte, length-2)...)
+		if _, err := io.ReadFull(r, buf[start+2:]); err != nil {
+			return nil, err
+		}
+		if marker[1] == 0xda {
+			return buf, nil
+		}
+	}
 }
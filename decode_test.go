@@ -2,7 +2,9 @@ package gojpegturbo
 
 import (
 	"bytes"
+	"encoding/binary"
 	"image"
+	"image/color"
 	_ "image/jpeg" // 注册jpeg解码库
 	"io/ioutil"
 	"testing"
@@ -121,7 +123,7 @@ func TestDecode(t *testing.T) {
 					ScaleDenom: 2,
 				},
 			},
-			wantErr: true,
+			wantSize: image.Point{X: 100, Y: 211},
 		},
 		{
 			name: "case 9-error",
@@ -148,6 +150,107 @@ func TestDecode(t *testing.T) {
 			},
 			wantSize: image.Point{X: 150, Y: 200},
 		},
+		{
+			name: "case 12-cmyk",
+			args: args{
+				filename: "./testdata/cmyk.jpg",
+			},
+			wantSize: image.Point{X: 300, Y: 400},
+		},
+		{
+			name: "case 13-cmyk to rgb",
+			args: args{
+				filename: "./testdata/cmyk.jpg",
+				options: &DecodeOptions{
+					CMYKToRGB: true,
+				},
+			},
+			wantSize: image.Point{X: 300, Y: 400},
+		},
+		{
+			name: "case 14-cmyk crop",
+			args: args{
+				filename: "./testdata/cmyk.jpg",
+				options: &DecodeOptions{
+					CropRect: &image.Rectangle{
+						Min: image.Point{X: 50, Y: 100},
+						Max: image.Point{X: 150, Y: 310},
+					},
+					CMYKToRGB: true,
+				},
+			},
+			wantSize: image.Point{X: 100, Y: 210},
+		},
+		{
+			name: "case 15-crop&expect size",
+			args: args{
+				filename: "./testdata/test.jpg",
+				options: &DecodeOptions{
+					CropRect: &image.Rectangle{
+						Min: image.Point{X: 100, Y: 200},
+						Max: image.Point{X: 300, Y: 621},
+					},
+					ExpectWidth:  100,
+					ExpectHeight: 200,
+				},
+			},
+			wantSize: image.Point{X: 100, Y: 211},
+		},
+		{
+			name: "case 16-expect size 3/8",
+			args: args{
+				filename: "./testdata/test.jpg",
+				options: &DecodeOptions{
+					ExpectWidth:  200,
+					ExpectHeight: 250,
+				},
+			},
+			wantSize: image.Point{X: 225, Y: 300},
+		},
+		{
+			name: "case 17-expect size 7/8",
+			args: args{
+				filename: "./testdata/test.jpg",
+				options: &DecodeOptions{
+					ExpectWidth:  500,
+					ExpectHeight: 600,
+				},
+			},
+			wantSize: image.Point{X: 525, Y: 700},
+		},
+		{
+			name: "case 18-expect size smaller than 1/8",
+			args: args{
+				filename: "./testdata/test.jpg",
+				options: &DecodeOptions{
+					ExpectWidth:  10,
+					ExpectHeight: 10,
+				},
+			},
+			wantSize: image.Point{X: 75, Y: 100},
+		},
+		{
+			name: "case 19-expect size larger than origin",
+			args: args{
+				filename: "./testdata/test.jpg",
+				options: &DecodeOptions{
+					ExpectWidth:  1000,
+					ExpectHeight: 1000,
+				},
+			},
+			wantSize: image.Point{X: 600, Y: 800},
+		},
+		{
+			name: "case 20-scale 5/8",
+			args: args{
+				filename: "./testdata/test.jpg",
+				options: &DecodeOptions{
+					ScaleNum:   5,
+					ScaleDenom: 8,
+				},
+			},
+			wantSize: image.Point{X: 375, Y: 500},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -167,6 +270,253 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestAvailableScalingFactors(t *testing.T) {
+	factors := AvailableScalingFactors()
+	require.Len(t, factors, 16)
+	// 从大到小排列，覆盖 16/8 到 1/8
+	for i := 1; i < len(factors); i++ {
+		assert.Greater(t, factors[i-1].Num*factors[i].Denom, factors[i].Num*factors[i-1].Denom)
+	}
+	assert.Contains(t, factors, ScalingFactor{Num: 3, Denom: 8})
+	assert.Contains(t, factors, ScalingFactor{Num: 1, Denom: 1})
+	assert.Equal(t, ScalingFactor{Num: 1, Denom: 8}, factors[len(factors)-1])
+	assert.Equal(t, 225, ScalingFactor{Num: 3, Denom: 8}.Scale(600))
+	assert.Equal(t, 1, ScalingFactor{Num: 1, Denom: 8}.Scale(1))
+
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	for _, factor := range factors {
+		got, err := Decode(buf, &DecodeOptions{ScaleNum: uint(factor.Num), ScaleDenom: uint(factor.Denom)})
+		require.NoError(t, err)
+		assert.Equal(t, image.Point{X: factor.Scale(600), Y: factor.Scale(800)},
+			image.Point{X: got.ImageWidth, Y: got.ImageHeight}, "scale %d/%d", factor.Num, factor.Denom)
+	}
+}
+
+func TestDecodeCropScale(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	rects := []image.Rectangle{
+		image.Rect(16, 32, 208, 400),   // MCU对齐
+		image.Rect(13, 27, 301, 250),   // 不对齐
+		image.Rect(333, 555, 600, 800), // 贴着右下边缘
+		image.Rect(500, 700, 900, 900), // 超出图片范围
+		image.Rect(123, 234, 124, 235), // 1*1
+	}
+	for num := uint(1); num <= 16; num++ {
+		full, err := Decode(buf, &DecodeOptions{ScaleNum: num, ScaleDenom: 8})
+		require.NoError(t, err)
+		for _, rect := range rects {
+			got, err := Decode(buf, &DecodeOptions{CropRect: &rect, ScaleNum: num, ScaleDenom: 8})
+			require.NoError(t, err, "scale %d/8, crop %v", num, rect)
+			// 剪裁区域先限制在原图内，再按缩放比例映射，左上角向下取整、右下角向上取整
+			clipped := rect.Intersect(image.Rect(0, 0, 600, 800))
+			want := image.Rect(clipped.Min.X*full.ImageWidth/600, clipped.Min.Y*full.ImageHeight/800,
+				(clipped.Max.X*full.ImageWidth+599)/600, (clipped.Max.Y*full.ImageHeight+799)/800)
+			require.Equal(t, want.Size(), image.Point{X: got.ImageWidth, Y: got.ImageHeight},
+				"scale %d/8, crop %v", num, rect)
+			assertSimilar(t, translate(full.ToImage().(*image.RGBA).SubImage(want)), got)
+		}
+	}
+}
+
+func TestDecodeCMYK(t *testing.T) {
+	// cmyk.jpg是test.jpg缩小一半后转成Adobe CMYK保存的
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	want, err := Decode(buf, &DecodeOptions{ScaleNum: 1, ScaleDenom: 2})
+	require.NoError(t, err)
+	buf, err = ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+
+	cmyk, err := Decode(buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ColorSpace(ColorSpaceCMYK), cmyk.ColorSpace)
+	assert.Equal(t, 4, cmyk.ComponentsNum)
+	assertSimilar(t, want, cmyk)
+
+	rgb, err := Decode(buf, &DecodeOptions{CMYKToRGB: true})
+	require.NoError(t, err)
+	assert.Equal(t, ColorSpace(ColorSpaceRGB), rgb.ColorSpace)
+	assert.Equal(t, 3, rgb.ComponentsNum)
+	assertSimilar(t, want, rgb)
+}
+
+// assertSimilar 校验两张图片的平均像素误差足够小
+func assertSimilar(t *testing.T, want, got image.Image) {
+	require.Equal(t, want.Bounds(), got.Bounds())
+	var diff, count int64
+	for y := want.Bounds().Min.Y; y < want.Bounds().Max.Y; y += 3 {
+		for x := want.Bounds().Min.X; x < want.Bounds().Max.X; x += 3 {
+			r1, g1, b1, _ := want.At(x, y).RGBA()
+			r2, g2, b2, _ := got.At(x, y).RGBA()
+			diff += absDiff(r1>>8, r2>>8) + absDiff(g1>>8, g2>>8) + absDiff(b1>>8, b2>>8)
+			count += 3
+		}
+	}
+	assert.Less(t, diff/count, int64(8))
+}
+
+func absDiff(a, b uint32) int64 {
+	if a > b {
+		return int64(a - b)
+	}
+	return int64(b - a)
+}
+
+func TestDecodeOutputPixelFormat(t *testing.T) {
+	pixelFormats := []TJPixelFormat{
+		TJPixelFormatRGB, TJPixelFormatBGR, TJPixelFormatRGBX, TJPixelFormatBGRX, TJPixelFormatXBGR, TJPixelFormatXRGB,
+		TJPixelFormatRGBA, TJPixelFormatBGRA, TJPixelFormatABGR, TJPixelFormatARGB, TJPixelFormatGray,
+	}
+	for _, filename := range []string{"./testdata/test.jpg", "./testdata/gray.jpg", "./testdata/cmyk.jpg"} {
+		buf, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		want, err := Decode(buf, nil)
+		require.NoError(t, err)
+		for _, pixelFormat := range pixelFormats {
+			options := NewDecodeOptions()
+			options.OutputPixelFormat = pixelFormat.Ptr()
+			got, err := Decode(buf, options)
+			// CMYK不支持转成灰度图
+			if filename == "./testdata/cmyk.jpg" && pixelFormat == TJPixelFormatGray {
+				assert.Error(t, err)
+				continue
+			}
+			require.NoError(t, err, "%s %d", filename, pixelFormat)
+			assert.Equal(t, pixelFormat, got.PixelFormat())
+			assert.Equal(t, pixelSize[pixelFormat], got.ComponentsNum)
+			assert.Equal(t, got.ImageWidth*got.ImageHeight*got.ComponentsNum, len(got.Img))
+			if pixelFormat != TJPixelFormatGray {
+				assertSimilar(t, want, got)
+			}
+		}
+	}
+	// YCbCr不能直接输出CMYK
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	_, err = Decode(buf, &DecodeOptions{OutputPixelFormat: TJPixelFormatCMYK.Ptr()})
+	assert.Error(t, err)
+	_, err = Decode(buf, &DecodeOptions{OutputPixelFormat: TJPixelFormat(100).Ptr()})
+	assert.Equal(t, ErrOptionsUnsupported, err)
+
+	// 和turbojpeg.h中TJPF的值一致
+	assert.Equal(t, TJPixelFormat(0), TJPixelFormatRGB)
+	assert.Equal(t, TJPixelFormat(11), TJPixelFormatCMYK)
+	assert.Equal(t, TJPixelFormat(-1), TJPixelFormatUnknown)
+	// 直接构造DecodeOptions时零值是保持原来的格式
+	for _, tt := range []struct {
+		filename string
+		options  *DecodeOptions
+		want     TJPixelFormat
+	}{
+		{filename: "./testdata/test.jpg", options: &DecodeOptions{}, want: TJPixelFormatRGB},
+		{filename: "./testdata/gray.jpg", options: &DecodeOptions{}, want: TJPixelFormatGray},
+		{filename: "./testdata/cmyk.jpg", options: &DecodeOptions{}, want: TJPixelFormatCMYK},
+		{filename: "./testdata/cmyk.jpg", options: &DecodeOptions{CMYKToRGB: true}, want: TJPixelFormatRGB},
+		{filename: "./testdata/gray.jpg", options: &DecodeOptions{OutputPixelFormat: TJPixelFormatUnknown.Ptr()},
+			want: TJPixelFormatGray},
+	} {
+		buf, err := ioutil.ReadFile(tt.filename)
+		require.NoError(t, err)
+		got, err := Decode(buf, tt.options)
+		require.NoError(t, err, tt.filename)
+		assert.Equal(t, tt.want, got.PixelFormat(), tt.filename)
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     *ImageConfig
+		wantErr  bool
+	}{
+		{
+			name:     "case 1-YCbCr",
+			filename: "./testdata/test.jpg",
+			want: &ImageConfig{
+				OriginWidth:   600,
+				OriginHeight:  800,
+				ColorSpace:    ColorSpaceYCbCr,
+				SubSample:     TjSubSample420,
+				ComponentsNum: 3,
+				Precision:     8,
+			},
+		},
+		{
+			name:     "case 2-gray",
+			filename: "./testdata/gray.jpg",
+			want: &ImageConfig{
+				OriginWidth:   600,
+				OriginHeight:  800,
+				ColorSpace:    ColorSpaceGrayScale,
+				SubSample:     TjSubSampleGray,
+				ComponentsNum: 1,
+				Precision:     8,
+			},
+		},
+		{
+			name:     "case 3-error",
+			filename: "./testdata/error.jpg",
+			wantErr:  true,
+		},
+		{
+			name:     "case 4-cmyk",
+			filename: "./testdata/cmyk.jpg",
+			want: &ImageConfig{
+				OriginWidth:   300,
+				OriginHeight:  400,
+				ColorSpace:    ColorSpaceYCCK,
+				SubSample:     TjSubSample420,
+				ComponentsNum: 4,
+				Precision:     8,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := ioutil.ReadFile(tt.filename)
+			require.NoError(t, err)
+			got, err := DecodeConfig(buf)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+			// reader只读取header，结果应该一致
+			r := bytes.NewReader(buf)
+			gotReader, err := DecodeConfigReader(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, gotReader)
+				assert.Greater(t, r.Len(), 0)
+			}
+		})
+	}
+	_, err := DecodeConfig(nil)
+	assert.Equal(t, ErrEmptyImage, err)
+}
+
+func TestDecodeConfigProgressive(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	options := NewEncodeOptions()
+	options.Progressive = true
+	options.SubSample = TjSubSample444
+	out, err := Encode(img, options)
+	require.NoError(t, err)
+	got, err := DecodeConfig(out)
+	require.NoError(t, err)
+	assert.True(t, got.Progressive)
+	assert.Equal(t, TjSubSample444, got.SubSample)
+}
+
 func BenchmarkDecodeC(b *testing.B) {
 	buf, err := ioutil.ReadFile("./testdata/test.jpg")
 	require.NoError(b, err)
@@ -240,3 +590,327 @@ func BenchmarkDecodeGo(b *testing.B) {
 	}
 	b.SetBytes(int64(len(buf)))
 }
+
+// withOrientation 在SOI后面插入只有Orientation的EXIF，bigEndian决定TIFF的字节序
+func withOrientation(img []byte, orientation uint16, bigEndian bool) []byte {
+	var order binary.ByteOrder = binary.LittleEndian
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	if bigEndian {
+		order = binary.BigEndian
+		tiff = []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	}
+	// IFD0只有一个entry：Orientation，类型SHORT，数量1
+	ifd := make([]byte, 18)
+	order.PutUint16(ifd[0:], 1)
+	order.PutUint16(ifd[2:], 0x0112)
+	order.PutUint16(ifd[4:], 3)
+	order.PutUint32(ifd[6:], 1)
+	order.PutUint16(ifd[10:], orientation)
+	data := append(append([]byte("Exif\x00\x00"), tiff...), ifd...)
+	segment := []byte{0xff, 0xe1, byte((len(data) + 2) >> 8), byte(len(data) + 2)}
+	out := append([]byte{}, img[:2]...)
+	out = append(out, segment...)
+	out = append(out, data...)
+	return append(out, img[2:]...)
+}
+
+func TestDecodeAutoOrient(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	src, err := Decode(buf, &DecodeOptions{ScaleNum: 1, ScaleDenom: 4})
+	require.NoError(t, err)
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		for _, bigEndian := range []bool{false, true} {
+			img := withOrientation(buf, orientation, bigEndian)
+			got, err := Decode(img, &DecodeOptions{ScaleNum: 1, ScaleDenom: 4, AutoOrient: true})
+			require.NoError(t, err)
+			assertSimilar(t, transformImage(src, orientationTransforms[int(orientation)]), got)
+			if orientation >= 5 {
+				assert.Equal(t, 800, got.OriginWidth)
+				assert.Equal(t, 600, got.OriginHeight)
+			}
+
+			// 没有设置AutoOrient的时候忽略EXIF
+			got, err = Decode(img, &DecodeOptions{ScaleNum: 1, ScaleDenom: 4})
+			require.NoError(t, err)
+			assertSimilar(t, src, got)
+		}
+	}
+
+	// 不合法的Orientation、IFD0的偏移超出EXIF和没有EXIF的图片都不旋转
+	badOffset := withOrientation(buf, 6, false)
+	copy(badOffset[16:20], []byte{0xff, 0xff, 0, 0})
+	// 只有TIFF header的EXIF，IFD0的entry数量是6，但是后面没有数据了
+	tiny := []byte("Exif\x00\x00MM\x00*\x00\x00\x00\x06")
+	tinyExif := append([]byte{0xff, 0xd8, 0xff, 0xe1, 0, byte(len(tiny) + 2)}, tiny...)
+	tinyExif = append(tinyExif, buf[2:]...)
+	for _, img := range [][]byte{withOrientation(buf, 9, false), badOffset, tinyExif, buf} {
+		got, err := Decode(img, &DecodeOptions{ScaleNum: 1, ScaleDenom: 4, AutoOrient: true})
+		require.NoError(t, err)
+		assertSimilar(t, src, got)
+	}
+}
+
+func TestDecodeAutoOrientCrop(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	src, err := Decode(buf, nil)
+	require.NoError(t, err)
+	tests := []struct {
+		name        string
+		orientation uint16
+		options     *DecodeOptions
+		rect        image.Rectangle
+		wantSize    image.Point
+	}{
+		{name: "rot90 crop", orientation: 6, rect: image.Rect(100, 50, 500, 450), wantSize: image.Pt(400, 400)},
+		{name: "rot270 crop", orientation: 8, rect: image.Rect(300, 120, 800, 600), wantSize: image.Pt(500, 480)},
+		{name: "transverse crop", orientation: 7, rect: image.Rect(0, 0, 200, 100), wantSize: image.Pt(200, 100)},
+		{name: "rot180 crop", orientation: 3, rect: image.Rect(37, 91, 300, 700), wantSize: image.Pt(263, 609)},
+		{name: "hflip crop", orientation: 2, rect: image.Rect(500, 700, 900, 900), wantSize: image.Pt(100, 100)},
+		{
+			name: "rot90 expect", orientation: 6, options: &DecodeOptions{ExpectWidth: 400, ExpectHeight: 300},
+			rect: image.Rect(0, 0, 800, 600), wantSize: image.Pt(400, 300),
+		},
+		{
+			name: "rot90 crop expect", orientation: 6, options: &DecodeOptions{ExpectWidth: 200, ExpectHeight: 100},
+			rect: image.Rect(100, 50, 500, 250), wantSize: image.Pt(200, 100),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			if options == nil {
+				options = &DecodeOptions{}
+			}
+			options.AutoOrient = true
+			options.CropRect = &tt.rect
+			img := withOrientation(buf, tt.orientation, false)
+			got, err := Decode(img, options)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantSize, got.Bounds().Size())
+			if tt.options != nil {
+				return
+			}
+			want := transformImage(src, orientationTransforms[int(tt.orientation)]).(*image.RGBA).SubImage(tt.rect)
+			assertSimilar(t, translate(want), got)
+
+			got, err = DecodeReader(bytes.NewReader(img), options)
+			require.NoError(t, err)
+			assertSimilar(t, translate(want), got)
+		})
+	}
+
+	_, err = NewDecoder(bytes.NewReader(buf), &DecodeOptions{AutoOrient: true})
+	assert.Equal(t, ErrOptionsUnsupported, err)
+	_, err = Decode(withOrientation(buf, 6, false), &DecodeOptions{AutoOrient: true, CropRect: &image.Rectangle{
+		Min: image.Pt(700, 0), Max: image.Pt(900, 100),
+	}})
+	assert.NoError(t, err)
+	_, err = Decode(withOrientation(buf, 6, false), &DecodeOptions{AutoOrient: true, CropRect: &image.Rectangle{
+		Min: image.Pt(800, 0), Max: image.Pt(900, 100),
+	}})
+	assert.Error(t, err)
+}
+
+func TestDecodePaletted(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	grayBuf, err := ioutil.ReadFile("./testdata/gray.jpg")
+	require.NoError(t, err)
+	crop := image.Rect(100, 200, 400, 500)
+	tests := []struct {
+		name       string
+		img        []byte
+		options    func() *DecodeOptions
+		wantColors int
+		similar    bool // 颜色足够多的时候和正常解码的结果差不多
+	}{
+		{name: "default", img: buf, options: func() *DecodeOptions { return nil }, wantColors: 256, similar: true},
+		{
+			name: "one pass",
+			img:  buf,
+			options: func() *DecodeOptions {
+				options := NewDecodeOptions()
+				options.TwoPassQuantize = false
+				options.DitherMode = DitherOrdered
+				return options
+			},
+			wantColors: 256,
+		},
+		{
+			name: "16 colors",
+			img:  buf,
+			options: func() *DecodeOptions {
+				options := NewDecodeOptions()
+				options.DesiredNumberOfColors = 16
+				options.DitherMode = DitherNone
+				return options
+			},
+			wantColors: 16,
+		},
+		{
+			name: "crop and scale",
+			img:  buf,
+			options: func() *DecodeOptions {
+				options := NewDecodeOptions()
+				options.CropRect = &crop
+				options.ScaleNum, options.ScaleDenom = 1, 2
+				// 输出格式会被忽略
+				options.OutputPixelFormat = TJPixelFormatBGRA.Ptr()
+				return options
+			},
+			wantColors: 256,
+			similar:    true,
+		},
+		{name: "gray", img: grayBuf, options: func() *DecodeOptions { return nil }, wantColors: 256, similar: true},
+		// 直接构造DecodeOptions时颜色数量是0，按256处理
+		{name: "struct literal", img: buf, options: func() *DecodeOptions { return &DecodeOptions{} }, wantColors: 256},
+		{
+			name:       "struct literal two pass",
+			img:        buf,
+			options:    func() *DecodeOptions { return &DecodeOptions{TwoPassQuantize: true} },
+			wantColors: 256,
+			similar:    true,
+		},
+		{
+			name:       "gray 2 colors",
+			img:        grayBuf,
+			options:    func() *DecodeOptions { return &DecodeOptions{DesiredNumberOfColors: 2} },
+			wantColors: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options()
+			got, err := DecodePaletted(tt.img, options)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(got.Palette), tt.wantColors)
+			assert.Greater(t, len(got.Palette), 1)
+			var maxIndex uint8
+			for _, index := range got.Pix {
+				if index > maxIndex {
+					maxIndex = index
+				}
+			}
+			assert.Less(t, int(maxIndex), len(got.Palette))
+			if options != nil {
+				options.OutputPixelFormat = nil
+			}
+			want, err := Decode(tt.img, options)
+			require.NoError(t, err)
+			require.Equal(t, want.Bounds(), got.Bounds())
+			if tt.similar {
+				assertSimilar(t, want, got)
+			}
+		})
+	}
+
+	// 灰度图的颜色表是灰度的
+	gray, err := DecodePaletted(grayBuf, nil)
+	require.NoError(t, err)
+	assert.IsType(t, color.Gray{}, gray.Palette[0])
+
+	cmyk, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	_, err = DecodePaletted(cmyk, nil)
+	assert.Error(t, err)
+	_, err = DecodePaletted(nil, nil)
+	assert.Equal(t, ErrEmptyImage, err)
+	for _, options := range []*DecodeOptions{
+		{DesiredNumberOfColors: 257},
+		{DesiredNumberOfColors: 1},
+		{DesiredNumberOfColors: -1},
+		{DesiredNumberOfColors: 7, TwoPassQuantize: true},
+	} {
+		_, err = DecodePaletted(buf, options)
+		assert.Equal(t, ErrOptionsUnsupported, err, "%d colors", options.DesiredNumberOfColors)
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	grayBuf, err := ioutil.ReadFile("./testdata/gray.jpg")
+	require.NoError(t, err)
+	cmykBuf, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	crop := image.Rect(13, 27, 301, 250)
+	tests := []struct {
+		name    string
+		img     []byte
+		options *DecodeOptions
+	}{
+		{name: "default", img: buf},
+		{name: "scale", img: buf, options: &DecodeOptions{ScaleNum: 3, ScaleDenom: 8}},
+		{name: "expect size", img: buf, options: &DecodeOptions{ExpectWidth: 200, ExpectHeight: 250}},
+		{name: "crop and scale", img: buf, options: &DecodeOptions{CropRect: &crop, ScaleNum: 1, ScaleDenom: 2}},
+		{name: "bgra", img: buf, options: &DecodeOptions{OutputPixelFormat: TJPixelFormatBGRA.Ptr()}},
+		{name: "auto orient", img: withOrientation(buf, 6, false), options: &DecodeOptions{AutoOrient: true}},
+		{name: "gray", img: grayBuf, options: NewDecodeOptions()},
+		{name: "cmyk", img: cmykBuf, options: NewDecodeOptions()},
+		{name: "cmyk to rgb", img: cmykBuf, options: &DecodeOptions{CMYKToRGB: true}},
+		{
+			name:    "convert to srgb",
+			img:     withICCProfile(buf, buildICCProfile("RGB ", displayP3Primaries, srgbTRC)),
+			options: &DecodeOptions{ConvertToSRGB: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := Decode(tt.img, tt.options)
+			require.NoError(t, err)
+			size, err := RequiredBufferSize(tt.img, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, len(want.Img), size)
+			// 只有header的时候也能算出来
+			header, err := readHeader(bytes.NewReader(tt.img))
+			require.NoError(t, err)
+			headerSize, err := RequiredBufferSize(header, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, size, headerSize)
+
+			// buffer不够大的时候dst不变
+			small := &ImageAttr{Img: make([]byte, size-1)}
+			assert.Equal(t, ErrBufferTooSmall, DecodeInto(tt.img, small, tt.options))
+			assert.Equal(t, &ImageAttr{Img: make([]byte, size-1)}, small)
+
+			dst := &ImageAttr{Img: make([]byte, 0, size+100)}
+			require.NoError(t, DecodeInto(tt.img, dst, tt.options))
+			assert.Equal(t, want, dst)
+			assert.Equal(t, size+100, cap(dst.Img))
+
+			// 复用上一次的buffer
+			pix := &dst.Img[0]
+			require.NoError(t, DecodeInto(tt.img, dst, tt.options))
+			assert.Equal(t, want, dst)
+			assert.Same(t, pix, &dst.Img[0])
+		})
+	}
+
+	assert.Equal(t, ErrBufferTooSmall, DecodeInto(buf, &ImageAttr{}, nil))
+	assert.Equal(t, ErrEmptyImage, DecodeInto(nil, &ImageAttr{}, nil))
+	errBuf, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+	assert.Error(t, DecodeInto(errBuf, &ImageAttr{}, nil))
+	assert.Error(t, DecodeInto(errBuf, &ImageAttr{Img: make([]byte, 1<<20)}, nil))
+	_, err = RequiredBufferSize(errBuf, nil)
+	assert.Error(t, err)
+	_, err = RequiredBufferSize(nil, nil)
+	assert.Equal(t, ErrEmptyImage, err)
+}
+
+func BenchmarkDecodeInto(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	size, err := RequiredBufferSize(buf, nil)
+	require.NoError(b, err)
+	dst := &ImageAttr{Img: make([]byte, size)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := DecodeInto(buf, dst, nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
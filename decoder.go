@@ -0,0 +1,162 @@
+package gojpegturbo
+
+/*
+#cgo linux LDFLAGS: -lturbojpeg
+#cgo darwin LDFLAGS: -L/usr/local/opt/libjpeg-turbo/lib -lturbojpeg
+#cgo darwin CFLAGS: -I/usr/local/opt/libjpeg-turbo/include
+
+#include "goturbo.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+var (
+	// ErrBufferTooSmall 传入的buffer不够大
+	ErrBufferTooSmall = errors.New("buffer too small")
+	// ErrDecoderClosed 解码器已经关闭了
+	ErrDecoderClosed = errors.New("decoder closed")
+)
+
+// Decoder 逐行解码JPEG图片，libjpeg每解码出一行就交给调用方，不需要把整张图片放在内存里，适合处理超大的图片（如全景图、
+// 高分辨率扫描件），边解码边缩放或者编码。支持DecodeOptions里的剪裁和缩放。
+//
+// Decoder不是并发安全的，用完之后必须调用Close释放C分配的内存。
+type Decoder struct {
+	ImageWidth    int        // 输出图片的宽度，剪裁和缩放之后的
+	ImageHeight   int        // 输出图片的高度，剪裁和缩放之后的
+	OriginWidth   int        // 原图宽度
+	OriginHeight  int        // 原图高度
+	ColorSpace    ColorSpace // 输出的颜色空间
+	ComponentsNum int        // 每个像素的分量数
+	// ConvertedToSRGB 是否按照ICC profile把像素转换到sRGB，见DecodeOptions的ConvertToSRGB
+	ConvertedToSRGB bool
+
+	decoder     *C.jpeg_decoder
+	reader      *jpegReader
+	handle      cgo.Handle
+	row         []byte // Next返回的行，每次调用都会复用
+	srgb        *srgbTransform
+	pixelFormat TJPixelFormat // srgb转换时的像素格式
+	err         error
+}
+
+// NewDecoder 创建逐行解码的解码器，数据从r中流式读取，内存占用只有一行像素和一个读取的buffer。不支持AutoOrient。
+func NewDecoder(r io.Reader, options *DecodeOptions) (*Decoder, error) {
+	if options != nil && options.AutoOrient {
+		return nil, ErrOptionsUnsupported
+	}
+	co, err := options.toCOptions()
+	if err != nil {
+		return nil, err
+	}
+	d := &Decoder{reader: &jpegReader{r: r}}
+	d.handle = cgo.NewHandle(d.reader)
+	jres := C.jpeg_decode_result{}
+	d.decoder = C.jpeg_decoder_create(C.uintptr_t(d.handle), C.uint(readerBufferSize), co, &jres)
+	icc := takeICCProfile(&jres)
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+	}
+	if d.decoder == nil {
+		d.handle.Delete()
+		if err := d.reader.readErr(); err != nil {
+			return nil, err
+		}
+		if d.reader.total == 0 {
+			return nil, ErrEmptyImage
+		}
+		if jres.err != nil {
+			return nil, fmt.Errorf("jpeg_decoder_create failed, err = %s", C.GoString(jres.err))
+		}
+		return nil, ErrEmptyDecode
+	}
+	d.ImageWidth = int(jres.image_width)
+	d.ImageHeight = int(jres.image_height)
+	d.OriginWidth = int(jres.origin_width)
+	d.OriginHeight = int(jres.origin_height)
+	d.ColorSpace = ColorSpace(jres.color_space)
+	d.ComponentsNum = int(jres.num_components)
+	pixelFormat := (&ImageAttr{ColorSpace: d.ColorSpace}).PixelFormat()
+	if d.srgb = newSRGBTransformFor(icc, pixelFormat); d.srgb != nil {
+		d.pixelFormat = pixelFormat
+		d.ConvertedToSRGB = true
+	}
+	return d, nil
+}
+
+// RowSize 每一行的字节数
+func (d *Decoder) RowSize() int {
+	return d.ImageWidth * d.ComponentsNum
+}
+
+// Next 解码下一行，返回的[]byte在下次调用Next时会被覆盖，需要保留的话自己复制一份。所有行都读完后返回io.EOF。
+func (d *Decoder) Next() ([]byte, error) {
+	if d.row == nil {
+		d.row = make([]byte, d.RowSize())
+	}
+	if _, err := d.read(d.row); err != nil {
+		return nil, err
+	}
+	return d.row, nil
+}
+
+// ReadRows 解码最多len(dst)行，每一行写到dst[i]里，dst[i]的长度至少是RowSize。返回实际读到的行数，所有行都读完后返回0和io.EOF。
+func (d *Decoder) ReadRows(dst [][]byte) (int, error) {
+	for i := range dst {
+		if len(dst[i]) < d.RowSize() {
+			return i, ErrBufferTooSmall
+		}
+		if _, err := d.read(dst[i]); err != nil {
+			if err == io.EOF && i > 0 {
+				return i, nil
+			}
+			return i, err
+		}
+	}
+	return len(dst), nil
+}
+
+// read 解码一行到row里
+func (d *Decoder) read(row []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.decoder == nil {
+		return 0, ErrDecoderClosed
+	}
+	n := C.jpeg_decoder_read(d.decoder, (*C.uchar)(unsafe.Pointer(&row[0])), C.size_t(len(row)), 1)
+	switch {
+	case n > 0:
+		if d.srgb != nil {
+			d.srgb.convert(row[:d.RowSize()], d.pixelFormat)
+		}
+		return int(n), nil
+	case n == 0:
+		d.err = io.EOF
+	default:
+		if err := d.reader.readErr(); err != nil {
+			d.err = err
+		} else {
+			d.err = fmt.Errorf("jpeg_decoder_read failed, err = %s", C.GoString(&d.decoder.jerr.last_msg[0]))
+		}
+	}
+	return 0, d.err
+}
+
+// Close 释放解码器，可以重复调用
+func (d *Decoder) Close() error {
+	if d.decoder == nil {
+		return nil
+	}
+	C.jpeg_decoder_destroy(d.decoder)
+	d.decoder = nil
+	d.handle.Delete()
+	return nil
+}
@@ -0,0 +1,183 @@
+package gojpegturbo
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoder_Next(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		options  *DecodeOptions
+	}{
+		{
+			name:     "case 1",
+			filename: "./testdata/test.jpg",
+		},
+		{
+			name:     "case 2-gray",
+			filename: "./testdata/gray.jpg",
+		},
+		{
+			name:     "case 3-cmyk",
+			filename: "./testdata/cmyk.jpg",
+		},
+		{
+			name:     "case 4-cmyk crop to rgb",
+			filename: "./testdata/cmyk.jpg",
+			options: &DecodeOptions{
+				CropRect:  &image.Rectangle{Min: image.Point{X: 13, Y: 27}, Max: image.Point{X: 201, Y: 250}},
+				CMYKToRGB: true,
+			},
+		},
+		{
+			name:     "case 5-crop&scale",
+			filename: "./testdata/test.jpg",
+			options: &DecodeOptions{
+				CropRect:   &image.Rectangle{Min: image.Point{X: 100, Y: 200}, Max: image.Point{X: 300, Y: 621}},
+				ScaleNum:   5,
+				ScaleDenom: 8,
+			},
+		},
+		{
+			name:     "case 6-expect size&pixel format",
+			filename: "./testdata/test.jpg",
+			options: &DecodeOptions{
+				ExpectWidth:       200,
+				ExpectHeight:      250,
+				OutputPixelFormat: TJPixelFormatBGRA.Ptr(),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := ioutil.ReadFile(tt.filename)
+			require.NoError(t, err)
+			want, err := Decode(buf, tt.options)
+			require.NoError(t, err)
+
+			d, err := NewDecoder(iotest.HalfReader(bytes.NewReader(buf)), tt.options)
+			require.NoError(t, err)
+			defer d.Close()
+			assert.Equal(t, want.ImageWidth, d.ImageWidth)
+			assert.Equal(t, want.ImageHeight, d.ImageHeight)
+			assert.Equal(t, want.OriginWidth, d.OriginWidth)
+			assert.Equal(t, want.OriginHeight, d.OriginHeight)
+			assert.Equal(t, want.ColorSpace, d.ColorSpace)
+			assert.Equal(t, want.ComponentsNum, d.ComponentsNum)
+			got := make([]byte, 0, len(want.Img))
+			for {
+				row, err := d.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				require.Len(t, row, d.RowSize())
+				got = append(got, row...)
+			}
+			assert.Equal(t, want.Img, got)
+			_, err = d.Next()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestDecoder_ReadRows(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	options := &DecodeOptions{ScaleNum: 3, ScaleDenom: 8}
+	want, err := Decode(buf, options)
+	require.NoError(t, err)
+
+	d, err := NewDecoder(bytes.NewReader(buf), options)
+	require.NoError(t, err)
+	defer d.Close()
+	dst := make([][]byte, 7)
+	for i := range dst {
+		dst[i] = make([]byte, d.RowSize())
+	}
+	n, err := d.ReadRows([][]byte{make([]byte, d.RowSize()-1)})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrBufferTooSmall, err)
+	got := make([]byte, 0, len(want.Img))
+	for {
+		n, err := d.ReadRows(dst)
+		if err == io.EOF {
+			assert.Equal(t, 0, n)
+			break
+		}
+		require.NoError(t, err)
+		for _, row := range dst[:n] {
+			got = append(got, row...)
+		}
+	}
+	assert.Equal(t, want.Img, got)
+
+	require.NoError(t, d.Close())
+	require.NoError(t, d.Close())
+}
+
+func TestDecoder_Error(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+
+	_, err = NewDecoder(bytes.NewReader(nil), nil)
+	assert.Equal(t, ErrEmptyImage, err)
+	errorImg, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+	_, err = NewDecoder(bytes.NewReader(errorImg), nil)
+	assert.Error(t, err)
+	_, err = NewDecoder(bytes.NewReader(buf), &DecodeOptions{OutputPixelFormat: TJPixelFormatCMYK.Ptr()})
+	assert.Error(t, err)
+
+	// 读到一半reader出错，错误要原样返回
+	errRead := errors.New("read failed")
+	d, err := NewDecoder(io.MultiReader(bytes.NewReader(buf[:20000]), iotest.ErrReader(errRead)), nil)
+	require.NoError(t, err)
+	for err == nil {
+		_, err = d.Next()
+	}
+	assert.ErrorIs(t, err, errRead)
+	require.NoError(t, d.Close())
+
+	// 图片不完整
+	d, err = NewDecoder(bytes.NewReader(buf[:len(buf)/2]), nil)
+	require.NoError(t, err)
+	for err == nil {
+		_, err = d.Next()
+	}
+	assert.Error(t, err)
+	assert.NotEqual(t, io.EOF, err)
+	require.NoError(t, d.Close())
+
+	d, err = NewDecoder(bytes.NewReader(buf), nil)
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	_, err = d.Next()
+	assert.Equal(t, ErrDecoderClosed, err)
+}
+
+func BenchmarkDecoder_Next(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, err := NewDecoder(bytes.NewReader(buf), nil)
+		require.NoError(b, err)
+		for err == nil {
+			_, err = d.Next()
+		}
+		assert.Equal(b, io.EOF, err)
+		d.Close()
+	}
+	b.SetBytes(int64(len(buf)))
+}
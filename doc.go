@@ -5,6 +5,13 @@
 	// modify img
 	buf, err = gojpegturbo.Encode(img, nil)
 
+只读取图片头信息（不解码像素）：
+	config, err := gojpegturbo.DecodeConfig(buf)
+	// config.OriginWidth, config.OriginHeight, config.SubSample ...
+
+解码成YUV平面（不做颜色空间转换，适合重新编码或者给视频编码器）：
+	ycbcr, err := gojpegturbo.DecodeToYCbCr(buf)
+
 图片缩放：
 	options := gojpegturbo.NewDecodeOptions()
 	options.ExpectWidth = 50
@@ -9,8 +9,10 @@ package gojpegturbo
 */
 import "C"
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"runtime"
 	"unsafe"
 )
 
@@ -35,6 +37,18 @@ type EncodeOptions struct {
 	SubSample TJSubSample
 	// Progressive 是否使用渐进式编码
 	Progressive bool
+	// ICCProfile 写到APP2里的ICC profile，超过一个段的大小时会被拆成多个APP2
+	ICCProfile []byte
+	// EXIF 写到APP1里的EXIF，是TIFF格式的数据，不包括开头的"Exif\0\0"，即Exif.TIFF
+	EXIF []byte
+	// XMP 写到APP1里的XMP packet
+	XMP []byte
+	// Comments 写到COM里的注释，每个注释一个段
+	Comments []string
+	// Markers 其他任意的APPn和COM段，按顺序写在上面这些的后面。JFIF和Adobe由编码器自己写，放在这里会返回ErrMarkerInvalid。
+	//
+	// 元数据都写在JFIF或者Adobe的后面，依次是ICC profile、EXIF、XMP、Comments和Markers。可以用CopyMetadataFrom从原图复制。
+	Markers []Marker
 }
 
 // NewEncodeOptions 创建一个默认的图片编码选项
@@ -50,12 +64,29 @@ func (options *EncodeOptions) toCOptions() (*C.jpeg_encode_options, error) {
 	if options == nil {
 		return nil, nil
 	}
+	quality, tjFlag, subSample, err := options.tjParams()
+	if err != nil {
+		return nil, err
+	}
+	co := &C.jpeg_encode_options{
+		quality:    quality,
+		tj_flag:    tjFlag,
+		sub_sample: subSample,
+	}
+	return co, nil
+}
+
+// tjParams 转成turbojpeg的质量、flag和采样率。options为nil时都是C的默认值
+func (options *EncodeOptions) tjParams() (C.int, C.int, C.int, error) {
+	if options == nil {
+		return 0, 0, C.int(TjSubSampleUnknown), nil
+	}
 	// 暂时不支持scale & crop同时，会有panic。
 	if options.Quality > 100 || options.Quality < 0 {
-		return nil, ErrQualityOption
+		return 0, 0, 0, ErrQualityOption
 	}
 	tjFlag := 0
-	if options.AccurateDCT {
+	if options.FastDct {
 		tjFlag |= TjFlagFastDCT
 	}
 	if options.AccurateDCT {
@@ -64,31 +95,44 @@ func (options *EncodeOptions) toCOptions() (*C.jpeg_encode_options, error) {
 	if options.Progressive {
 		tjFlag |= TjFlagProgressive
 	}
-	co := &C.jpeg_encode_options{
-		quality:    C.int(options.Quality),
-		tj_flag:    C.int(tjFlag),
-		sub_sample: C.int(options.SubSample),
-	}
-	return co, nil
+	return C.int(options.Quality), C.int(tjFlag), C.int(options.SubSample), nil
 }
 
 // Encode jpeg图片编码
 func Encode(img *ImageAttr, options *EncodeOptions) ([]byte, error) {
-	if img == nil || len(img.Img) == 0 {
-		return nil, ErrImgEmpty
+	c := getCompressor()
+	defer putCompressor(c)
+	return c.Encode(img, options)
+}
+
+// Encode jpeg图片编码，见Encode
+func (c *Compressor) Encode(img *ImageAttr, options *EncodeOptions) ([]byte, error) {
+	if err := checkEncodeImage(img); err != nil {
+		return nil, err
 	}
-	if img.ImageWidth*img.ImageHeight*img.ComponentsNum != len(img.Img) {
-		return nil, ErrImgSizeInvalid
+	// 关闭了的编码器在写元数据的时候也要报错
+	if _, err := c.handle(); err != nil {
+		return nil, err
 	}
-	jres := C.jpeg_encode_result{}
-	co, err := options.toCOptions()
+	// turbojpeg没法写其他的段，有元数据的时候用libjpeg的流式编码器（EncodeWriter），不经过c的tjhandle。
+	// 质量、采样和DCT的选择和turbojpeg一样（质量小于96又没有设置AccurateDCT时用JDCT_FASTEST），
+	// 但是输出不保证和没有元数据时逐字节相同
+	if options.hasMetadata() {
+		if _, err := options.toCOptions(); err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, len(img.Img)/8))
+		if err := EncodeWriter(buf, img, options); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	jres, err := c.encodeImage(img, nil, options)
 	if err != nil {
 		return nil, err
 	}
-	C.jpeg_encode((*C.uchar)(unsafe.Pointer(&img.Img[0])), C.int(img.ImageWidth), C.int(img.ImageHeight),
-		C.int(img.PixelFormat()), co, &jres)
-	if jres.img == nil {
-		defer C.free(unsafe.Pointer(jres.img))
+	if jres.img != nil {
+		defer C.tjFree(jres.img)
 	}
 	if jres.err != nil {
 		defer C.free(unsafe.Pointer(jres.err))
@@ -96,3 +140,86 @@ func Encode(img *ImageAttr, options *EncodeOptions) ([]byte, error) {
 	}
 	return C.GoBytes(unsafe.Pointer(jres.img), C.int(int(jres.img_size))), nil
 }
+
+// EncodeInto 把图片直接编码到dst里，返回写入的字节数。dst的长度至少是EncodeBufferSize，不够时返回ErrBufferTooSmall。编码结果
+// 不需要C分配再复制一遍，dst可以在多次编码之间复用，除了CMYK的图片，编码时Go这边没有内存分配。不支持写元数据。
+func EncodeInto(img *ImageAttr, dst []byte, options *EncodeOptions) (int, error) {
+	c := getCompressor()
+	defer putCompressor(c)
+	return c.EncodeInto(img, dst, options)
+}
+
+// EncodeInto 把图片直接编码到dst里，见EncodeInto
+func (c *Compressor) EncodeInto(img *ImageAttr, dst []byte, options *EncodeOptions) (int, error) {
+	if err := checkEncodeImage(img); err != nil {
+		return 0, err
+	}
+	if _, err := c.handle(); err != nil {
+		return 0, err
+	}
+	if options.hasMetadata() {
+		return 0, ErrOptionsUnsupported
+	}
+	// TJFLAG_NOREALLOC时turbojpeg假定buffer有tjBufSize那么大
+	if len(dst) == 0 || len(dst) < EncodeBufferSize(img.ImageWidth, img.ImageHeight, options) {
+		return 0, ErrBufferTooSmall
+	}
+	jres, err := c.encodeImage(img, dst, options)
+	if err != nil {
+		return 0, err
+	}
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return 0, fmt.Errorf("jpeg_encode_into failed, err = %s", C.GoString(jres.err))
+	}
+	return int(jres.img_size), nil
+}
+
+// EncodeBufferSize 编码width*height的图片最多需要多少字节，即tjBufSize，和图片内容无关。options为nil时按4:2:0计算。
+func EncodeBufferSize(width, height int, options *EncodeOptions) int {
+	subSample := TjSubSample420
+	if options != nil && options.SubSample >= 0 {
+		subSample = options.SubSample
+	}
+	return int(C.tjBufSize(C.int(width), C.int(height), C.int(subSample)))
+}
+
+// checkEncodeImage 校验要编码的图片
+func checkEncodeImage(img *ImageAttr) error {
+	if img == nil || len(img.Img) == 0 {
+		return ErrImgEmpty
+	}
+	if img.ImageWidth*img.ImageHeight*img.ComponentsNum != len(img.Img) {
+		return ErrImgSizeInvalid
+	}
+	return nil
+}
+
+// encodeImage 调用turbojpeg编码，dst为nil时由turbojpeg分配内存。参数都按值传给C，不会在Go的堆上分配
+func (c *Compressor) encodeImage(img *ImageAttr, dst []byte, options *EncodeOptions) (C.jpeg_encode_result, error) {
+	tj, err := c.handle()
+	if err != nil {
+		return C.jpeg_encode_result{}, err
+	}
+	quality, tjFlag, subSample, err := options.tjParams()
+	if err != nil {
+		return C.jpeg_encode_result{}, err
+	}
+	src := img.Img
+	// turbojpeg按Adobe的约定写CMYK（255代表无墨），而ImageAttr里0代表无墨，需要反转一下
+	if img.PixelFormat() == TJPixelFormatCMYK {
+		src = make([]byte, len(img.Img))
+		for i, v := range img.Img {
+			src[i] = 0xff - v
+		}
+	}
+	var out *C.uchar
+	if len(dst) > 0 {
+		out = (*C.uchar)(unsafe.Pointer(&dst[0]))
+	}
+	jres := C.jpeg_encode_into(tj, (*C.uchar)(unsafe.Pointer(&src[0])), C.int(img.ImageWidth), C.int(img.ImageHeight),
+		C.int(img.PixelFormat()), quality, tjFlag, subSample, out, C.ulong(len(dst)))
+	// 编码过程中c不能被finalizer释放
+	runtime.KeepAlive(c)
+	return jres, nil
+}
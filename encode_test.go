@@ -7,6 +7,9 @@ import (
 	_ "image/jpeg" // 注册jpeg解码库
 	"io/ioutil"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -71,6 +74,10 @@ func TestEncode(t *testing.T) {
 				AccurateDCT: true,
 			},
 		},
+		{
+			name:     "case 8-cmyk",
+			filename: "./testdata/cmyk.jpg",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -95,6 +102,149 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+func TestEncodeCMYK(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	out, err := Encode(img, NewEncodeOptions())
+	require.NoError(t, err)
+	// 重新解码后颜色应该保持一致，不会被反转
+	got, err := Decode(out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ColorSpace(ColorSpaceCMYK), got.ColorSpace)
+	assertSimilar(t, img, got)
+}
+
+func TestEncodeOptions_toCOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  *EncodeOptions
+		wantFlag int
+	}{
+		{
+			name:     "default",
+			options:  NewEncodeOptions(),
+			wantFlag: 0,
+		},
+		{
+			name:     "fast dct",
+			options:  &EncodeOptions{Quality: 90, FastDct: true},
+			wantFlag: TjFlagFastDCT,
+		},
+		{
+			name:     "accurate dct",
+			options:  &EncodeOptions{Quality: 90, AccurateDCT: true},
+			wantFlag: TjFlagAccurateDCT,
+		},
+		{
+			name:     "fast dct progressive",
+			options:  &EncodeOptions{Quality: 90, FastDct: true, Progressive: true},
+			wantFlag: TjFlagFastDCT | TjFlagProgressive,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			co, err := tt.options.toCOptions()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFlag, int(co.tj_flag))
+		})
+	}
+}
+
+func TestEncodeFreeOutput(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	options := &EncodeOptions{Quality: 100, SubSample: TjSubSample444}
+	out, err := Encode(img, options)
+	require.NoError(t, err)
+	before, ok := residentBytes()
+	if !ok {
+		t.Skip("/proc/self/statm is unavailable")
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	goSys := ms.Sys
+	const n = 200
+	for i := 0; i < n; i++ {
+		_, err := Encode(img, options)
+		require.NoError(t, err)
+	}
+	after, _ := residentBytes()
+	runtime.ReadMemStats(&ms)
+	// 去掉Go堆的增长，剩下的是C分配的内存。turbojpeg的输出buffer没有释放的话会涨n*len(out)
+	growth := after - before - int64(ms.Sys-goSys)
+	assert.Less(t, growth, int64(n*len(out)/4))
+}
+
+// residentBytes 当前进程的常驻内存
+func residentBytes() (int64, bool) {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * int64(os.Getpagesize()), true
+}
+
+func TestEncodeInto(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	cmykBuf, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	cmyk, err := Decode(cmykBuf, nil)
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		img     *ImageAttr
+		options *EncodeOptions
+	}{
+		{name: "default", img: img},
+		{name: "444", img: img, options: &EncodeOptions{Quality: 100, SubSample: TjSubSample444}},
+		{name: "gray", img: img, options: &EncodeOptions{Quality: 60, SubSample: TjSubSampleGray}},
+		{name: "progressive", img: img, options: &EncodeOptions{Quality: 90, Progressive: true}},
+		{name: "fast dct", img: img, options: &EncodeOptions{Quality: 90, FastDct: true}},
+		{name: "cmyk", img: cmyk, options: NewEncodeOptions()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := Encode(tt.img, tt.options)
+			require.NoError(t, err)
+			size := EncodeBufferSize(tt.img.ImageWidth, tt.img.ImageHeight, tt.options)
+			assert.GreaterOrEqual(t, size, len(want))
+
+			dst := make([]byte, size)
+			n, err := EncodeInto(tt.img, dst, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, want, dst[:n])
+
+			_, err = EncodeInto(tt.img, make([]byte, size-1), tt.options)
+			assert.Equal(t, ErrBufferTooSmall, err)
+		})
+	}
+
+	_, err = EncodeInto(img, nil, nil)
+	assert.Equal(t, ErrBufferTooSmall, err)
+	_, err = EncodeInto(nil, make([]byte, 100), nil)
+	assert.Equal(t, ErrImgEmpty, err)
+	_, err = EncodeInto(&ImageAttr{Img: []byte("1234"), ImageWidth: 100, ImageHeight: 100}, make([]byte, 100), nil)
+	assert.Equal(t, ErrImgSizeInvalid, err)
+	_, err = EncodeInto(img, make([]byte, EncodeBufferSize(img.ImageWidth, img.ImageHeight, nil)),
+		&EncodeOptions{Quality: 90, Comments: []string{"comment"}})
+	assert.Equal(t, ErrOptionsUnsupported, err)
+}
+
 func BenchmarkEncodeC(b *testing.B) {
 	buf, err := ioutil.ReadFile("./testdata/test.jpg")
 	require.NoError(b, err)
@@ -151,3 +301,18 @@ func BenchmarkEncodeGo(b *testing.B) {
 	}
 	b.SetBytes(int64(len(buf)))
 }
+
+func BenchmarkEncodeInto(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	img, err := Decode(buf, nil)
+	require.NoError(b, err)
+	dst := make([]byte, EncodeBufferSize(img.ImageWidth, img.ImageHeight, nil))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := EncodeInto(img, dst, nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
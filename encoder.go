@@ -0,0 +1,196 @@
+package gojpegturbo
+
+/*
+#cgo linux LDFLAGS: -lturbojpeg
+#cgo darwin LDFLAGS: -L/usr/local/opt/libjpeg-turbo/lib -lturbojpeg
+#cgo darwin CFLAGS: -I/usr/local/opt/libjpeg-turbo/include
+
+#include "goturbo.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/cgo"
+	"unsafe"
+)
+
+var (
+	// ErrPixelFormatUnsupported 像素格式不支持
+	ErrPixelFormatUnsupported = errors.New("pixel format unsupported")
+	// ErrEncoderClosed 编码器已经关闭了
+	ErrEncoderClosed = errors.New("encoder closed")
+)
+
+// Encoder 逐行编码JPEG图片，编码结果边编码边写到io.Writer里，可以直接写到HTTP的response或者上传的请求里，不需要先把整个JPEG
+// 文件放在内存里，也不需要像Encode一样再从C复制一次。像素可以分多次写入，配合Decoder就能处理超大的图片。
+//
+// Encoder不是并发安全的，写完所有行之后必须调用Close，Close会把剩下的数据写到io.Writer并释放C分配的内存。忘了Close的话GC
+// 回收时只会释放内存，不会写剩下的数据。
+type Encoder struct {
+	Width       int           // 图片宽度
+	Height      int           // 图片高度
+	PixelFormat TJPixelFormat // 写入的像素格式
+
+	encoder *C.jpeg_encoder
+	writer  *jpegWriter
+	handle  cgo.Handle
+	err     error
+}
+
+// NewEncoder 创建逐行编码的编码器，编码的参数和Encode一样。CMYK格式的像素和ImageAttr一致，0代表无墨。
+func NewEncoder(w io.Writer, width, height int, pixelFormat TJPixelFormat, options *EncodeOptions) (*Encoder, error) {
+	return newEncoder(w, width, height, pixelFormat, options, nil)
+}
+
+// newEncoder 创建逐行编码的编码器，cancel不为nil时，编码过程中*cancel不为0就中止编码
+func newEncoder(w io.Writer, width, height int, pixelFormat TJPixelFormat, options *EncodeOptions,
+	cancel *C.int) (*Encoder, error) {
+	if width <= 0 || height <= 0 {
+		return nil, ErrImgSizeInvalid
+	}
+	if pixelFormat < 0 || int(pixelFormat) >= len(pixelSize) {
+		return nil, ErrPixelFormatUnsupported
+	}
+	co, err := options.toCOptions()
+	if err != nil {
+		return nil, err
+	}
+	if cancel != nil {
+		// options为nil时C都用默认值
+		if co == nil {
+			co = &C.jpeg_encode_options{sub_sample: C.int(TjSubSampleUnknown)}
+		}
+		co.cancel = cancel
+	}
+	// 元数据在jpeg_encoder_create里就写完了，之后就可以释放
+	free, err := options.setCMetadata(co)
+	if err != nil {
+		return nil, err
+	}
+	defer free()
+	e := &Encoder{
+		Width:       width,
+		Height:      height,
+		PixelFormat: pixelFormat,
+		writer:      &jpegWriter{w: w},
+	}
+	e.handle = cgo.NewHandle(e.writer)
+	jres := C.jpeg_encode_result{}
+	e.encoder = C.jpeg_encoder_create(C.uintptr_t(e.handle), C.uint(writerBufferSize), C.int(width), C.int(height),
+		C.int(pixelFormat), co, &jres)
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+	}
+	if e.encoder == nil {
+		e.handle.Delete()
+		if e.writer.err != nil {
+			return nil, e.writer.err
+		}
+		if jres.err != nil {
+			return nil, fmt.Errorf("jpeg_encoder_create failed, err = %s", C.GoString(jres.err))
+		}
+		return nil, fmt.Errorf("jpeg_encoder_create failed")
+	}
+	// 忘了Close的时候GC回收时释放C的内存和writer的handle
+	runtime.SetFinalizer(e, (*Encoder).release)
+	return e, nil
+}
+
+// RowSize 每一行的字节数
+func (e *Encoder) RowSize() int {
+	return e.Width * pixelSize[e.PixelFormat]
+}
+
+// WriteRows 按顺序写入len(src)行，src[i]的长度至少是RowSize。返回实际写入的行数，超出图片高度的行会被忽略。
+func (e *Encoder) WriteRows(src [][]byte) (int, error) {
+	for i := range src {
+		if len(src[i]) < e.RowSize() {
+			return i, ErrBufferTooSmall
+		}
+		n, err := e.write(src[i], 0, 1)
+		if err != nil || n == 0 {
+			return i, err
+		}
+	}
+	return len(src), nil
+}
+
+// write 写入最多rows行，每行间隔stride字节
+func (e *Encoder) write(src []byte, stride, rows int) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	if e.encoder == nil {
+		return 0, ErrEncoderClosed
+	}
+	n := C.jpeg_encoder_write(e.encoder, (*C.uchar)(unsafe.Pointer(&src[0])), C.size_t(stride), C.uint(rows))
+	// 编码过程中e不能被finalizer释放
+	runtime.KeepAlive(e)
+	if n < 0 {
+		e.err = e.lastErr("jpeg_encoder_write")
+		return 0, e.err
+	}
+	return int(n), nil
+}
+
+// lastErr 编码出错时，优先返回writer的错误
+func (e *Encoder) lastErr(name string) error {
+	if e.writer.err != nil {
+		return e.writer.err
+	}
+	return fmt.Errorf("%s failed, err = %s", name, C.GoString(&e.encoder.jerr.last_msg[0]))
+}
+
+// Close 结束编码，把剩下的数据写到io.Writer并释放编码器。没有写完所有行的时候会返回错误，可以重复调用。
+func (e *Encoder) Close() error {
+	if e.encoder == nil {
+		return e.err
+	}
+	defer e.release()
+	if e.err != nil {
+		return e.err
+	}
+	if C.jpeg_encoder_finish(e.encoder) < 0 {
+		e.err = e.lastErr("jpeg_encoder_finish")
+	}
+	return e.err
+}
+
+// release 释放C的编码器和writer的handle，不会再写数据。忘了Close的时候由finalizer调用
+func (e *Encoder) release() {
+	if e.encoder == nil {
+		return
+	}
+	C.jpeg_encoder_destroy(e.encoder)
+	e.encoder = nil
+	e.handle.Delete()
+	runtime.SetFinalizer(e, nil)
+}
+
+// EncodeWriter 编码图片并写到w里，编码结果不会在内存里再复制一份。
+func EncodeWriter(w io.Writer, img *ImageAttr, options *EncodeOptions) error {
+	return encodeWriter(w, img, options, nil)
+}
+
+// encodeWriter 编码图片并写到w里，cancel不为nil时，编码过程中*cancel不为0就中止编码
+func encodeWriter(w io.Writer, img *ImageAttr, options *EncodeOptions, cancel *C.int) error {
+	if img == nil || len(img.Img) == 0 {
+		return ErrImgEmpty
+	}
+	if img.ImageWidth*img.ImageHeight*img.ComponentsNum != len(img.Img) {
+		return ErrImgSizeInvalid
+	}
+	e, err := newEncoder(w, img.ImageWidth, img.ImageHeight, img.PixelFormat(), options, cancel)
+	if err != nil {
+		return err
+	}
+	if _, err := e.write(img.Img, e.RowSize(), e.Height); err != nil {
+		e.Close()
+		return err
+	}
+	return e.Close()
+}
@@ -0,0 +1,221 @@
+package gojpegturbo
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countWriter 记录Write被调用的次数，用来确认编码结果是分块写出的
+type countWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// errWriter 写入超过limit字节后返回err
+type errWriter struct {
+	limit int
+	err   error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		return 0, w.err
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestEncodeWriter(t *testing.T) {
+	tests := []struct {
+		name          string
+		filename      string
+		options       *EncodeOptions
+		wantColor     ColorSpace
+		wantSubSample TJSubSample
+	}{
+		{
+			name:          "case 1",
+			filename:      "./testdata/test.jpg",
+			wantColor:     ColorSpaceYCbCr,
+			wantSubSample: TjSubSample420,
+		},
+		{
+			name:          "case 2-gray sub sample",
+			filename:      "./testdata/test.jpg",
+			options:       &EncodeOptions{Quality: 60, SubSample: TjSubSampleGray},
+			wantColor:     ColorSpaceGrayScale,
+			wantSubSample: TjSubSampleGray,
+		},
+		{
+			name:          "case 3-progressive 444",
+			filename:      "./testdata/test.jpg",
+			options:       &EncodeOptions{Quality: 90, Progressive: true, SubSample: TjSubSample444},
+			wantColor:     ColorSpaceYCbCr,
+			wantSubSample: TjSubSample444,
+		},
+		{
+			name:          "case 4-gray",
+			filename:      "./testdata/gray.jpg",
+			wantColor:     ColorSpaceGrayScale,
+			wantSubSample: TjSubSampleGray,
+		},
+		{
+			name:          "case 5-cmyk",
+			filename:      "./testdata/cmyk.jpg",
+			options:       &EncodeOptions{Quality: 95, SubSample: TjSubSample422},
+			wantColor:     ColorSpaceYCCK,
+			wantSubSample: TjSubSample422,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := ioutil.ReadFile(tt.filename)
+			require.NoError(t, err)
+			img, err := Decode(buf, nil)
+			require.NoError(t, err)
+			w := &countWriter{}
+			require.NoError(t, EncodeWriter(w, img, tt.options))
+			config, err := DecodeConfig(w.Bytes())
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantColor, config.ColorSpace)
+			assert.Equal(t, tt.wantSubSample, config.SubSample)
+			assert.Equal(t, tt.options != nil && tt.options.Progressive, config.Progressive)
+			got, err := Decode(w.Bytes(), nil)
+			require.NoError(t, err)
+			if tt.wantColor == ColorSpaceGrayScale {
+				assert.Equal(t, 1, got.ComponentsNum)
+				return
+			}
+			assertSimilar(t, img, got)
+		})
+	}
+}
+
+func TestEncoder_WriteRows(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	// 边解码边编码，整个过程都不需要完整的图片
+	d, err := NewDecoder(bytes.NewReader(buf), &DecodeOptions{OutputPixelFormat: TJPixelFormatBGRA.Ptr()})
+	require.NoError(t, err)
+	defer d.Close()
+	w := &countWriter{}
+	e, err := NewEncoder(w, d.ImageWidth, d.ImageHeight, TJPixelFormatBGRA, &EncodeOptions{Quality: 100})
+	require.NoError(t, err)
+	assert.Equal(t, d.RowSize(), e.RowSize())
+	rows := make([][]byte, 5)
+	for i := range rows {
+		rows[i] = make([]byte, d.RowSize())
+	}
+	for {
+		n, err := d.ReadRows(rows)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		written, err := e.WriteRows(rows[:n])
+		require.NoError(t, err)
+		require.Equal(t, n, written)
+	}
+	require.NoError(t, e.Close())
+	require.NoError(t, e.Close())
+	assert.Greater(t, w.writes, 1)
+
+	want, err := Decode(buf, nil)
+	require.NoError(t, err)
+	got, err := Decode(w.Bytes(), nil)
+	require.NoError(t, err)
+	assertSimilar(t, want, got)
+
+	_, err = e.WriteRows(rows)
+	assert.Equal(t, ErrEncoderClosed, err)
+}
+
+func TestEncoder_Error(t *testing.T) {
+	_, err := NewEncoder(ioutil.Discard, 0, 100, TJPixelFormatRGB, nil)
+	assert.Equal(t, ErrImgSizeInvalid, err)
+	_, err = NewEncoder(ioutil.Discard, 100, 100, TJPixelFormatUnknown, nil)
+	assert.Equal(t, ErrPixelFormatUnsupported, err)
+	_, err = NewEncoder(ioutil.Discard, 100, 100, TJPixelFormatRGB, &EncodeOptions{Quality: 101})
+	assert.Equal(t, ErrQualityOption, err)
+
+	e, err := NewEncoder(ioutil.Discard, 100, 100, TJPixelFormatRGB, nil)
+	require.NoError(t, err)
+	_, err = e.WriteRows([][]byte{make([]byte, 299)})
+	assert.Equal(t, ErrBufferTooSmall, err)
+	n, err := e.WriteRows([][]byte{make([]byte, 300)})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	// 没写完所有行就Close
+	assert.Error(t, e.Close())
+
+	// writer出错，错误要原样返回
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	errWrite := errors.New("write failed")
+	err = EncodeWriter(&errWriter{limit: 1000, err: errWrite}, img, nil)
+	assert.ErrorIs(t, err, errWrite)
+	assert.Equal(t, ErrImgEmpty, EncodeWriter(ioutil.Discard, nil, nil))
+}
+
+func BenchmarkEncodeWriter(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	img, err := Decode(buf, nil)
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := EncodeWriter(ioutil.Discard, img, nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
+
+func TestEncoder_Finalizer(t *testing.T) {
+	e, err := NewEncoder(ioutil.Discard, 16, 16, TJPixelFormatRGB, nil)
+	require.NoError(t, err)
+	handle := e.handle
+	e = nil
+	// 没有Close的编码器被GC回收时，finalizer会释放writer的handle
+	deleted := func() (ok bool) {
+		defer func() {
+			ok = recover() != nil
+		}()
+		handle.Value()
+		return false
+	}
+	for i := 0; i < 50 && !deleted(); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, deleted())
+
+	// Close之后finalizer不会再释放一次
+	e, err = NewEncoder(ioutil.Discard, 16, 16, TJPixelFormatRGB, nil)
+	require.NoError(t, err)
+	rows := make([][]byte, 16)
+	for i := range rows {
+		rows[i] = make([]byte, e.RowSize())
+	}
+	n, err := e.WriteRows(rows)
+	require.NoError(t, err)
+	assert.Equal(t, 16, n)
+	require.NoError(t, e.Close())
+	e = nil
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+}
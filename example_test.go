@@ -29,6 +29,20 @@ func ExampleDecode() {
 	// width=600,height=800
 }
 
+func ExampleDecodeConfig() {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config, err := gojpegturbo.DecodeConfig(buf) // only the header is parsed, pixels are not decoded.
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("width=%d,height=%d,components=%d\n", config.OriginWidth, config.OriginHeight, config.ComponentsNum)
+	// Output:
+	// width=600,height=800,components=3
+}
+
 func ExampleResizeArea() {
 	fp, err := os.Open("./testdata/test.jpg")
 	if err != nil {
@@ -0,0 +1,178 @@
+package gojpegturbo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrExifInvalid EXIF不是合法的TIFF格式
+	ErrExifInvalid = errors.New("exif invalid")
+)
+
+// exifHeader APP1里EXIF的开头，后面是TIFF格式的数据
+var exifHeader = []byte("Exif\x00\x00")
+
+// 用到的EXIF tag
+const (
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagSoftware         = 0x0131
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+	exifTagPixelXDimension  = 0xa002
+	exifTagPixelYDimension  = 0xa003
+)
+
+// TIFF的数据类型
+const (
+	tiffTypeASCII = 2
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+)
+
+// tiffTypeSizes 各个数据类型每个值的字节数
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// Exif 解析后的EXIF，只包含常用的几个tag，其他的tag可以自己从TIFF里解析
+type Exif struct {
+	TIFF             []byte           // 完整的TIFF格式的数据，不包括开头的"Exif\0\0"
+	ByteOrder        binary.ByteOrder // TIFF的字节序
+	Orientation      int              // 图片的方向，1到8，没有的时候是0
+	Make             string           // 相机厂商
+	Model            string           // 相机型号
+	Software         string           // 处理图片的软件
+	DateTime         string           // 图片修改时间，格式是"2006:01:02 15:04:05"
+	DateTimeOriginal string           // 拍摄时间，格式和DateTime一样
+	PixelXDimension  int              // EXIF里记录的图片宽度，可能和实际的宽度不一样
+	PixelYDimension  int              // EXIF里记录的图片高度
+}
+
+// ParseExif 解析TIFF格式的EXIF数据，即APP1去掉开头"Exif\0\0"之后的部分。解析不了的tag会被忽略。
+func ParseExif(tiff []byte) (*Exif, error) {
+	order, offset, ok := readTIFFHeader(tiff)
+	if !ok {
+		return nil, ErrExifInvalid
+	}
+	exif := &Exif{TIFF: tiff, ByteOrder: order}
+	exifIFD := 0
+	for _, entry := range readIFD(tiff, order, offset) {
+		switch entry.tag {
+		case exifTagOrientation:
+			exif.Orientation, _ = entry.uint(tiff, order)
+		case exifTagMake:
+			exif.Make = entry.string(tiff)
+		case exifTagModel:
+			exif.Model = entry.string(tiff)
+		case exifTagSoftware:
+			exif.Software = entry.string(tiff)
+		case exifTagDateTime:
+			exif.DateTime = entry.string(tiff)
+		case exifTagExifIFD:
+			exifIFD, _ = entry.uint(tiff, order)
+		}
+	}
+	if exifIFD == 0 {
+		return exif, nil
+	}
+	for _, entry := range readIFD(tiff, order, exifIFD) {
+		switch entry.tag {
+		case exifTagDateTimeOriginal:
+			exif.DateTimeOriginal = entry.string(tiff)
+		case exifTagPixelXDimension:
+			exif.PixelXDimension, _ = entry.uint(tiff, order)
+		case exifTagPixelYDimension:
+			exif.PixelYDimension, _ = entry.uint(tiff, order)
+		}
+	}
+	return exif, nil
+}
+
+// tiffEntry IFD中的一个entry
+type tiffEntry struct {
+	tag    uint16
+	typ    uint16
+	count  int
+	offset int // 值在TIFF中的偏移，值不超过4字节时就在entry里
+}
+
+// uint 读取SHORT或者LONG类型的第一个值
+func (e tiffEntry) uint(tiff []byte, order binary.ByteOrder) (int, bool) {
+	switch {
+	case e.typ == tiffTypeShort && e.count > 0:
+		return int(order.Uint16(tiff[e.offset:])), true
+	case e.typ == tiffTypeLong && e.count > 0:
+		return int(order.Uint32(tiff[e.offset:])), true
+	}
+	return 0, false
+}
+
+// string 读取ASCII类型的值，去掉结尾的\0
+func (e tiffEntry) string(tiff []byte) string {
+	if e.typ != tiffTypeASCII {
+		return ""
+	}
+	value := tiff[e.offset : e.offset+e.count]
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return string(value)
+}
+
+// readTIFFHeader 读取TIFF的header：字节序、42、IFD0的偏移，偏移都是相对TIFF header的开始
+func readTIFFHeader(tiff []byte) (binary.ByteOrder, int, bool) {
+	if len(tiff) < 8 {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, 0, false
+	}
+	return order, int(order.Uint32(tiff[4:])), true
+}
+
+// readIFD 读取offset处的IFD，值超出TIFF范围的entry会被丢掉
+func readIFD(tiff []byte, order binary.ByteOrder, offset int) []tiffEntry {
+	if offset < 8 || offset+2 > len(tiff) {
+		return nil
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	entries := make([]tiffEntry, 0, count)
+	// 每个IFD entry是12字节：tag、类型、数量、值
+	for i := 0; i < count; i++ {
+		start := offset + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiffEntry{
+			tag:    order.Uint16(tiff[start:]),
+			typ:    order.Uint16(tiff[start+2:]),
+			count:  int(order.Uint32(tiff[start+4:])),
+			offset: start + 8,
+		}
+		size, ok := tiffTypeSizes[entry.typ]
+		if !ok || entry.count < 0 || entry.count > len(tiff) {
+			continue
+		}
+		// 超过4字节的值放在别的地方，entry里是值的偏移
+		if size*entry.count > 4 {
+			entry.offset = int(order.Uint32(tiff[start+8:]))
+		}
+		if entry.offset < 0 || entry.offset+size*entry.count > len(tiff) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
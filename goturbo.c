@@ -14,159 +14,981 @@ static void jpeg_err_exit(j_common_ptr cinfo) {
     longjmp(mgr->setjmp_buf, 1);
 }
 
-// 解码jpeg图片
-void jpeg_decode(unsigned char* img, unsigned int img_size, jpeg_decode_options* options, jpeg_decode_result* jres) {
-    struct jpeg_decompress_struct dinfo;
-    my_jpeg_err_mgr               jerr;
-    JSAMPROW                      img_decoded = NULL;
-    JSAMPROW                      img_row = NULL;
-    JSAMPROW                      img_row_start = NULL;
-    JSAMPROW                      current_row = NULL;
-    JSAMPARRAY                    row_pointer = NULL;
-    JDIMENSION                    tmp = 0;
-    JDIMENSION                    real_left = 0;
-    JDIMENSION                    real_width = 0;
-    unsigned int                  crop_width = 0;
-    unsigned int                  crop_height = 0;
-    size_t                        img_row_size = 0;
+// 每处理一批扫描线或者一个iMCU行调用一次，已经取消时和出错一样longjmp回去
+static void jpeg_cancel_monitor(j_common_ptr cinfo) {
+    jpeg_cancel_progress_mgr* progress = (jpeg_cancel_progress_mgr*)cinfo->progress;
+    struct my_jpeg_err_mgr*   mgr = (struct my_jpeg_err_mgr*)cinfo->err;
 
-    jerr.last_msg[0] = '\0';
-    dinfo.err = jpeg_std_error(&jerr.mgr);
-    jerr.mgr.output_message = jpeg_err_output_msg;
-    jerr.mgr.error_exit = jpeg_err_exit;
-    if (setjmp(jerr.setjmp_buf)) {
+    if (__atomic_load_n(progress->cancel, __ATOMIC_ACQUIRE) != 0) {
+        snprintf(mgr->last_msg, JMSG_LENGTH_MAX, "operation canceled");
+        longjmp(mgr->setjmp_buf, 1);
+    }
+}
+
+// cancel不为NULL时设置检查是否取消的progress monitor，否则去掉progress monitor
+static void jpeg_set_cancel(j_common_ptr cinfo, jpeg_cancel_progress_mgr* progress, int* cancel) {
+    if (cancel == NULL) {
+        cinfo->progress = NULL;
+        return;
+    }
+    progress->pub.progress_monitor = jpeg_cancel_monitor;
+    progress->cancel = cancel;
+    cinfo->progress = &progress->pub;
+}
+
+// 取消编解码，Go在context取消时调用，可以和编解码并发
+void jpeg_cancel(int* cancel) {
+    __atomic_store_n(cancel, 1, __ATOMIC_RELEASE);
+}
+
+// 从Go的io.Reader读取数据的source manager，每次读满buffer再交给libjpeg
+static void jpeg_reader_init_source(j_decompress_ptr dinfo) {
+    jpeg_reader_source_mgr* src = (jpeg_reader_source_mgr*)dinfo->src;
+    src->start_of_file = TRUE;
+}
+
+static boolean jpeg_reader_fill_input_buffer(j_decompress_ptr dinfo) {
+    static const JOCTET     eoi_buffer[2] = {0xFF, JPEG_EOI};
+    jpeg_reader_source_mgr* src = (jpeg_reader_source_mgr*)dinfo->src;
+    int                     n = 0;
+
+    n = goJpegReaderRead(src->reader, src->buffer, (int)src->buffer_size);
+    if (n < 0) {
+        // 具体的错误由Go记录在reader里
+        ERREXIT(dinfo, JERR_FILE_READ);
+    }
+    if (n == 0) {
+        if (src->start_of_file) {
+            ERREXIT(dinfo, JERR_INPUT_EMPTY);
+        }
+        // 和jpeg_mem_src一样，数据不完整时插入一个EOI，让libjpeg按警告处理
+        WARNMS(dinfo, JWRN_JPEG_EOF);
+        src->pub.next_input_byte = eoi_buffer;
+        src->pub.bytes_in_buffer = 2;
+        return TRUE;
+    }
+    src->pub.next_input_byte = src->buffer;
+    src->pub.bytes_in_buffer = (size_t)n;
+    src->start_of_file = FALSE;
+    return TRUE;
+}
+
+static void jpeg_reader_skip_input_data(j_decompress_ptr dinfo, long num_bytes) {
+    struct jpeg_source_mgr* src = dinfo->src;
+
+    if (num_bytes <= 0) {
+        return;
+    }
+    while (num_bytes > (long)src->bytes_in_buffer) {
+        num_bytes -= (long)src->bytes_in_buffer;
+        (void)(*src->fill_input_buffer)(dinfo);
+    }
+    src->next_input_byte += (size_t)num_bytes;
+    src->bytes_in_buffer -= (size_t)num_bytes;
+}
+
+static void jpeg_reader_term_source(j_decompress_ptr dinfo) {
+}
+
+// 设置从Go的io.Reader读取数据的source manager，内存由libjpeg管理，jpeg_destroy_decompress时释放
+void jpeg_reader_src(j_decompress_ptr dinfo, uintptr_t reader, unsigned int buffer_size) {
+    jpeg_reader_source_mgr* src = NULL;
+
+    if (dinfo->src == NULL) {
+        dinfo->src = (struct jpeg_source_mgr*)(*dinfo->mem->alloc_small)((j_common_ptr)dinfo, JPOOL_PERMANENT,
+            sizeof(jpeg_reader_source_mgr));
+        src = (jpeg_reader_source_mgr*)dinfo->src;
+        src->buffer = (JOCTET*)(*dinfo->mem->alloc_large)((j_common_ptr)dinfo, JPOOL_PERMANENT,
+            buffer_size * sizeof(JOCTET));
+        src->buffer_size = buffer_size;
+    }
+    src = (jpeg_reader_source_mgr*)dinfo->src;
+    src->pub.init_source = jpeg_reader_init_source;
+    src->pub.fill_input_buffer = jpeg_reader_fill_input_buffer;
+    src->pub.skip_input_data = jpeg_reader_skip_input_data;
+    src->pub.resync_to_restart = jpeg_resync_to_restart;
+    src->pub.term_source = jpeg_reader_term_source;
+    src->pub.bytes_in_buffer = 0;
+    src->pub.next_input_byte = NULL;
+    src->reader = reader;
+}
+
+// 解码jpeg图片。decompressor是jpeg_decoder_alloc创建的可以复用的解码器，为NULL时临时创建一个
+void jpeg_decode(jpeg_decoder* decompressor, unsigned char* img, unsigned int img_size, jpeg_decode_options* options,
+    jpeg_decode_result* jres) {
+    jpeg_decode_source src = {img, img_size, 0, 0};
+    jpeg_decode_src(decompressor, &src, options, NULL, 0, jres);
+}
+
+// 解码jpeg图片到调用方的dst里，dst不够大时只在jres->img_size返回需要的大小
+void jpeg_decode_into(jpeg_decoder* decompressor, unsigned char* img, unsigned int img_size,
+    jpeg_decode_options* options, unsigned char* dst, size_t dst_size, jpeg_decode_result* jres) {
+    jpeg_decode_source src = {img, img_size, 0, 0};
+    jpeg_decode_src(decompressor, &src, options, dst, dst_size, jres);
+}
+
+// 只读取header，计算按options解码后的宽高、颜色空间和像素需要的字节数，字节数放在jres->img_size
+void jpeg_decode_output_size(jpeg_decoder* decompressor, unsigned char* img, unsigned int img_size,
+    jpeg_decode_options* options, jpeg_decode_result* jres) {
+    jpeg_decode_source src = {img, img_size, 0, 0};
+    jpeg_decoder*      decoder = NULL;
+
+    decoder = jpeg_decoder_new(decompressor, &src, options, TRUE, jres);
+    if (decoder == NULL) {
+        return;
+    }
+    jres->img_size = sizeof(JSAMPLE) * decoder->crop_width * decoder->crop_height * decoder->out_components;
+    jpeg_decoder_release(decoder);
+}
+
+// 流式解码jpeg图片，数据从Go的io.Reader中分块读取
+void jpeg_decode_reader(uintptr_t reader, unsigned int buffer_size, jpeg_decode_options* options,
+    jpeg_decode_result* jres) {
+    jpeg_decode_source src = {NULL, 0, reader, buffer_size};
+    jpeg_decode_src(NULL, &src, options, NULL, 0, jres);
+}
+
+static void jpeg_decode_oom(jpeg_decode_result* jres) {
+    jres->err = malloc(sizeof(char) * JMSG_LENGTH_MAX);
+    if (jres->err != NULL) {
+        snprintf(jres->err, JMSG_LENGTH_MAX, "out of memory");
+    }
+}
+
+// 解码jpeg图片，数据来源是内存或者Go的io.Reader。dst为NULL时输出到malloc的jres->img，否则直接输出到dst
+static void jpeg_decode_src(jpeg_decoder* decompressor, jpeg_decode_source* source, jpeg_decode_options* options,
+    unsigned char* dst, size_t dst_size, jpeg_decode_result* jres) {
+    jpeg_decoder*  decoder = NULL;
+    size_t         img_row_size = 0;
+    size_t         img_size = 0;
+    unsigned char* pixels = NULL;
+
+    decoder = jpeg_decoder_new(decompressor, source, options, FALSE, jres);
+    if (decoder == NULL) {
+        return;
+    }
+    img_row_size = sizeof(JSAMPLE) * decoder->crop_width * decoder->out_components;
+    img_size = img_row_size * decoder->crop_height;
+    jres->img_size = img_size;
+    if (dst == NULL) {
+        jres->img = (unsigned char*)malloc(img_size);
+        if (jres->img == NULL) {
+            jres->img_size = 0;
+            jpeg_decode_oom(jres);
+            goto bailout;
+        }
+        dst = jres->img;
+    } else if (dst_size < img_size) {
+        // dst不够大，不解码，调用方根据jres->img_size判断
         goto bailout;
     }
-    jpeg_create_decompress(&dinfo);
-    jpeg_mem_src(&dinfo, img, img_size);
-    if (jerr.mgr.num_warnings > 0) {
+    // 需要旋转的时候先解码到临时的buffer，再旋转到dst
+    pixels = dst;
+    if (decoder->orientation > 1) {
+        pixels = (unsigned char*)malloc(jres->img_size);
+        if (pixels == NULL) {
+            jpeg_decode_oom(jres);
+            goto bailout;
+        }
+    }
+    if (jpeg_decoder_read(decoder, pixels, img_row_size, decoder->crop_height) < 0) {
+        // 如果last_msg非空，从解码器copy去堆上
+        jres->err = malloc(sizeof(char) * JMSG_LENGTH_MAX);
+        memcpy(jres->err, decoder->jerr.last_msg, JMSG_LENGTH_MAX);
+    } else if (pixels != dst) {
+        jpeg_orient_pixels(decoder->orientation, pixels, dst, decoder->crop_width, decoder->crop_height,
+            decoder->out_components);
+    }
+bailout:
+    if (pixels != NULL && pixels != dst) {
+        free(pixels);
+    }
+    jpeg_decoder_release(decoder);
+}
+
+// 创建逐行解码的解码器，数据从Go的io.Reader中分块读取
+jpeg_decoder* jpeg_decoder_create(uintptr_t reader, unsigned int buffer_size, jpeg_decode_options* options,
+    jpeg_decode_result* jres) {
+    jpeg_decode_source src = {NULL, 0, reader, buffer_size};
+    return jpeg_decoder_new(NULL, &src, options, FALSE, jres);
+}
+
+// 创建可以复用的解码器，只能用来解码内存里的图片，用完之后要用jpeg_decoder_destroy释放。失败时返回NULL
+jpeg_decoder* jpeg_decoder_alloc() {
+    jpeg_decoder* decoder = NULL;
+
+    decoder = (jpeg_decoder*)calloc(1, sizeof(jpeg_decoder));
+    if (decoder == NULL) {
+        return NULL;
+    }
+    decoder->dinfo.err = jpeg_std_error(&decoder->jerr.mgr);
+    decoder->jerr.mgr.output_message = jpeg_err_output_msg;
+    decoder->jerr.mgr.error_exit = jpeg_err_exit;
+    if (setjmp(decoder->jerr.setjmp_buf)) {
+        jpeg_decoder_destroy(decoder);
+        return NULL;
+    }
+    jpeg_create_decompress(&decoder->dinfo);
+    decoder->created = TRUE;
+    decoder->reusable = TRUE;
+    return decoder;
+}
+
+// 用完解码器，可以复用的解码器重置状态，留着下次用，临时创建的直接释放
+static void jpeg_decoder_release(jpeg_decoder* decoder) {
+    if (!decoder->reusable) {
+        jpeg_decoder_destroy(decoder);
+        return;
+    }
+    // jpeg_abort_decompress释放这张图片用到的内存，解码器回到可以读取下一个header的状态
+    jpeg_abort_decompress(&decoder->dinfo);
+    // color quantizer只在需要的时候创建，jpeg_abort_decompress释放内存后指针还在，jpeg_skip_scanlines会用到它
+    decoder->dinfo.cquantize = NULL;
+    if (decoder->row_buffer != NULL) {
+        free(decoder->row_buffer);
+    }
+    decoder->finished = FALSE;
+    decoder->is_cmyk = FALSE;
+    decoder->need_crop = FALSE;
+    decoder->out_color_space = JCS_UNKNOWN;
+    decoder->out_components = 0;
+    decoder->crop_left = decoder->crop_top = decoder->crop_width = decoder->crop_height = 0;
+    decoder->row_buffer = NULL;
+    decoder->row_start = NULL;
+    decoder->rows_read = 0;
+    decoder->orientation = 0;
+    decoder->jerr.mgr.num_warnings = 0;
+    decoder->jerr.last_msg[0] = '\0';
+}
+
+// 创建解码器并开始解码，输出的宽高等信息写到jres里。header_only时只读取header、计算输出的尺寸，不开始解码。
+// decompressor不为NULL时复用它，否则临时创建一个。失败时返回NULL，错误信息写到jres->err
+static jpeg_decoder* jpeg_decoder_new(jpeg_decoder* decompressor, jpeg_decode_source* source,
+    jpeg_decode_options* options, boolean header_only, jpeg_decode_result* jres) {
+    jpeg_decoder* decoder = decompressor;
+
+    if (decoder == NULL) {
+        decoder = jpeg_decoder_alloc();
+        if (decoder == NULL) {
+            return NULL;
+        }
+        decoder->reusable = FALSE;
+    }
+    // 解码开始前出现的警告也当作错误
+    if (header_only && (!jpeg_decoder_setup(decoder, source, options) || decoder->jerr.last_msg[0] != '\0')) {
         goto bailout;
     }
-    // 读取header后，得到图片color_space和宽高信息，校验一下
-    if (jpeg_read_header(&dinfo, TRUE) != JPEG_HEADER_OK) {
+    if (!header_only && (!jpeg_decoder_start(decoder, source, options) || decoder->jerr.last_msg[0] != '\0')) {
+        goto bailout;
+    }
+    // jpeg_decoder_start返回后setjmp_buf就失效了，需要重新设置
+    if (setjmp(decoder->jerr.setjmp_buf)) {
         goto bailout;
     }
+    // ICC profile不合法时jpeg_read_icc_profile只有警告，当作没有ICC profile，不影响解码
+    if (!header_only && options != NULL && options->read_icc_profile &&
+        !jpeg_read_icc_profile(&decoder->dinfo, &jres->icc_profile, &jres->icc_profile_size)) {
+        decoder->jerr.last_msg[0] = '\0';
+    }
+    jres->image_width = decoder->crop_width;
+    jres->image_height = decoder->crop_height;
+    jres->origin_width = decoder->dinfo.image_width;
+    jres->origin_height = decoder->dinfo.image_height;
+    // Orientation是5到8的时候图片要转置，宽高互换
+    if (decoder->orientation >= 5) {
+        jres->image_width = decoder->crop_height;
+        jres->image_height = decoder->crop_width;
+        jres->origin_width = decoder->dinfo.image_height;
+        jres->origin_height = decoder->dinfo.image_width;
+    }
+    // 指定了输出格式或者是CMYK的图片，按照实际输出的像素格式返回
+    if (decoder->dinfo.quantize_colors) {
+        jres->color_space = decoder->dinfo.out_color_space;
+        jres->num_components = decoder->dinfo.out_color_components;
+        if (!header_only && !jpeg_copy_colormap(&decoder->dinfo, jres)) {
+            goto bailout;
+        }
+    } else if (decoder->out_color_space != JCS_UNKNOWN) {
+        jres->color_space = decoder->out_color_space;
+        jres->num_components = decoder->out_components;
+    } else {
+        jres->color_space = decoder->dinfo.jpeg_color_space;
+        jres->num_components = decoder->dinfo.num_components;
+    }
+    return decoder;
+bailout:
+    // 如果last_msg非空，从解码器copy去堆上
+    if (decoder->jerr.last_msg[0] != '\0') {
+        jres->err = malloc(sizeof(char) * JMSG_LENGTH_MAX);
+        memcpy(jres->err, decoder->jerr.last_msg, JMSG_LENGTH_MAX);
+    }
+    jpeg_decoder_release(decoder);
+    return NULL;
+}
+
+// 读取header，根据options设置解码参数，计算输出的尺寸和剪裁区域，但不开始解码。失败返回FALSE，错误信息在jerr.last_msg
+static boolean jpeg_decoder_setup(jpeg_decoder* decoder, jpeg_decode_source* source, jpeg_decode_options* options) {
+    j_decompress_ptr dinfo = &decoder->dinfo;
+    JDIMENSION       tmp = 0;
+    crop_rect        crop = {0, 0, 0, 0};
+    unsigned int     expect_width = 0, expect_height = 0;
+
+    if (setjmp(decoder->jerr.setjmp_buf)) {
+        return FALSE;
+    }
+    if (source->img != NULL) {
+        jpeg_mem_src(dinfo, source->img, source->img_size);
+    } else {
+        jpeg_reader_src(dinfo, source->reader, source->buffer_size);
+    }
+    decoder->orientation = 1;
+    // EXIF在APP1里，ICC profile在APP2里，需要先让libjpeg保存下来。复用的解码器会保留上次的设置，不需要的时候也要设置一下
+    jpeg_save_markers(dinfo, JPEG_APP0 + 1, options != NULL && options->auto_orient ? 0xFFFF : 0);
+    jpeg_save_markers(dinfo, JPEG_APP0 + 2, options != NULL && options->read_icc_profile ? 0xFFFF : 0);
+    // 同样，复用的解码器会保留上次的progress monitor
+    jpeg_set_cancel((j_common_ptr)dinfo, &decoder->progress, options != NULL ? options->cancel : NULL);
+    // 读取header后，得到图片color_space和宽高信息，校验一下
+    if (jpeg_read_header(dinfo, TRUE) != JPEG_HEADER_OK) {
+        return FALSE;
+    }
+    if (options != NULL) {
+        crop = options->crop;
+        expect_width = options->expect_width;
+        expect_height = options->expect_height;
+        if (options->auto_orient) {
+            decoder->orientation = jpeg_get_orientation(dinfo);
+        }
+    }
+    // 剪裁区域和期望的宽高都是旋转后的坐标，先映射回原图
+    if (decoder->orientation >= 5) {
+        tmp = expect_width;
+        expect_width = expect_height;
+        expect_height = tmp;
+    }
+    if (crop.width > 0 && crop.height > 0 && !jpeg_orient_crop(decoder->orientation, dinfo->image_width,
+        dinfo->image_height, &crop)) {
+        return FALSE;
+    }
+    if (crop.width > 0 && crop.height > 0) {
+        // 有图片剪裁的情况，校验输入的crop_width, crop_height是否正确。剪裁区域是原图的坐标，缩放后再映射到输出的坐标
+        if (crop.left >= dinfo->image_width || crop.top >= dinfo->image_height) {
+            return FALSE;
+        }
+        decoder->need_crop = TRUE;
+        decoder->crop_left = crop.left;
+        decoder->crop_top = crop.top;
+        // 校准width和height，保证不超出图片范围
+        if (crop.left + crop.width > dinfo->image_width) {
+            decoder->crop_width = dinfo->image_width - crop.left;
+        } else {
+            decoder->crop_width = crop.width;
+        }
+        if (crop.top + crop.height > dinfo->image_height) {
+            decoder->crop_height = dinfo->image_height - crop.top;
+        } else {
+            decoder->crop_height = crop.height;
+        }
+    } else {
+        decoder->crop_width = dinfo->image_width;
+        decoder->crop_height = dinfo->image_height;
+    }
     // 根据options设置各种dinfo
     if (options != NULL) {
-        dinfo.dct_method = options->dct_method;
-        dinfo.two_pass_quantize = options->two_pass_quantize;
-        dinfo.dither_mode = options->dither_mode;
-        dinfo.desired_number_of_colors = options->desired_number_of_colors;
-        dinfo.do_fancy_upsampling = options->do_fancy_upsampling;
-        if (options->expect_width > 0 && options->expect_height > 0) {
-            jpeg_find_denom(dinfo.image_width, dinfo.image_height, options->expect_width, options->expect_height,
-                &dinfo.scale_num, &dinfo.scale_denom);
+        dinfo->dct_method = options->dct_method;
+        dinfo->two_pass_quantize = options->two_pass_quantize;
+        dinfo->dither_mode = options->dither_mode;
+        dinfo->desired_number_of_colors = options->desired_number_of_colors;
+        dinfo->do_fancy_upsampling = options->do_fancy_upsampling;
+        // 有剪裁的时候，期望的宽高是剪裁后的区域缩放后的宽高
+        if (expect_width > 0 && expect_height > 0) {
+            jpeg_find_denom(decoder->crop_width, decoder->crop_height, expect_width, expect_height,
+                &dinfo->scale_num, &dinfo->scale_denom);
         } else if (options->scale_num > 0 && options->scale_denom > 0) {
-            dinfo.scale_num = options->scale_num;
-            dinfo.scale_denom = options->scale_denom;
+            dinfo->scale_num = options->scale_num;
+            dinfo->scale_denom = options->scale_denom;
+        }
+        decoder->out_color_space = options->out_color_space;
+        // 颜色表是RGB或者灰度的，two pass的quantizer也只支持3个分量，所以输出格式固定是RGB或者灰度
+        if (options->quantize_colors) {
+            if (dinfo->jpeg_color_space == JCS_CMYK || dinfo->jpeg_color_space == JCS_YCCK) {
+                snprintf(decoder->jerr.last_msg, JMSG_LENGTH_MAX, "color quantization unsupported for CMYK image");
+                return FALSE;
+            }
+            dinfo->quantize_colors = TRUE;
+            decoder->out_color_space = JCS_UNKNOWN;
         }
     }
-    if (dinfo.jpeg_color_space != JCS_GRAYSCALE && dinfo.jpeg_color_space != JCS_YCbCr) {
-        snprintf(jerr.last_msg, JMSG_LENGTH_MAX, "unsupported color space, which is %d", dinfo.jpeg_color_space);
-        goto bailout;
+    switch (dinfo->jpeg_color_space) {
+    case JCS_GRAYSCALE:
+    case JCS_YCbCr:
+        // 其他输出格式的转换交给libjpeg，不支持的转换在jpeg_start_decompress时会报错
+        if (decoder->out_color_space != JCS_UNKNOWN) {
+            dinfo->out_color_space = decoder->out_color_space;
+        }
+        break;
+    case JCS_CMYK:
+    case JCS_YCCK:
+        // YCCK由libjpeg转成CMYK输出，需要的话再自己转成RGB格式
+        dinfo->out_color_space = JCS_CMYK;
+        decoder->is_cmyk = TRUE;
+        if (decoder->out_color_space == JCS_UNKNOWN) {
+            decoder->out_color_space = options != NULL && options->cmyk_to_rgb ? JCS_RGB : JCS_CMYK;
+        }
+        if (decoder->out_color_space != JCS_CMYK &&
+            !jpeg_rgb_layout(decoder->out_color_space, NULL, NULL, NULL, &decoder->out_components)) {
+            snprintf(decoder->jerr.last_msg, JMSG_LENGTH_MAX, "unsupported output color space %d for CMYK image",
+                decoder->out_color_space);
+            return FALSE;
+        }
+        break;
+    default:
+        snprintf(decoder->jerr.last_msg, JMSG_LENGTH_MAX, "unsupported color space, which is %d",
+            dinfo->jpeg_color_space);
+        return FALSE;
+    }
+    // 不需要开始解码就能算出输出的宽高和分量数，和jpeg_start_decompress里算的一样
+    jpeg_calc_output_dimensions(dinfo);
+    // CMYK转RGB格式的out_components在上面已经得到了
+    if (!decoder->is_cmyk || decoder->out_color_space == JCS_CMYK) {
+        decoder->out_components = dinfo->output_components;
+    }
+    if (!decoder->need_crop) {
+        decoder->crop_width = dinfo->output_width;
+        decoder->crop_height = dinfo->output_height;
+        return TRUE;
+    }
+    // 把原图坐标的剪裁区域映射到缩放后的输出坐标，左上角向下取整，右下角向上取整，保证覆盖整个剪裁区域
+    tmp = (JDIMENSION)(((unsigned long long)(decoder->crop_left + decoder->crop_width) * dinfo->output_width +
+        dinfo->image_width - 1) / dinfo->image_width);
+    decoder->crop_left = (unsigned int)((unsigned long long)decoder->crop_left * dinfo->output_width / dinfo->image_width);
+    decoder->crop_width = (tmp > dinfo->output_width ? dinfo->output_width : tmp) - decoder->crop_left;
+    tmp = (JDIMENSION)(((unsigned long long)(decoder->crop_top + decoder->crop_height) * dinfo->output_height +
+        dinfo->image_height - 1) / dinfo->image_height);
+    decoder->crop_top = (unsigned int)((unsigned long long)decoder->crop_top * dinfo->output_height / dinfo->image_height);
+    decoder->crop_height = (tmp > dinfo->output_height ? dinfo->output_height : tmp) - decoder->crop_top;
+    return decoder->crop_width > 0 && decoder->crop_height > 0;
+}
+
+// 设置解码参数，开始解码并跳到剪裁区域的第一行。失败返回FALSE，错误信息在jerr.last_msg
+static boolean jpeg_decoder_start(jpeg_decoder* decoder, jpeg_decode_source* source, jpeg_decode_options* options) {
+    j_decompress_ptr dinfo = &decoder->dinfo;
+    JDIMENSION       tmp = 0;
+    JDIMENSION       real_left = 0;
+    JDIMENSION       real_width = 0;
+
+    if (!jpeg_decoder_setup(decoder, source, options)) {
+        return FALSE;
+    }
+    // jpeg_decoder_setup返回后setjmp_buf就失效了，需要重新设置
+    if (setjmp(decoder->jerr.setjmp_buf)) {
+        return FALSE;
     }
     // 开始解码图片
-    if (jpeg_start_decompress(&dinfo) == FALSE) {
-        goto bailout;
+    if (jpeg_start_decompress(dinfo) == FALSE) {
+        return FALSE;
     }
-    if (options != NULL && options->crop.width > 0 && options->crop.height > 0) {
-        // 有图片剪裁的情况，校验输入的crop_width, crop_height是否正确
-        if (options->crop.left >= dinfo.image_width || options->crop.top >= dinfo.image_height) {
-            goto bailout;
+    if (!decoder->need_crop) {
+        // 无图片剪裁的情况，只有CMYK需要一行buffer来转换，其他直接读到输出里，解码更快。
+        if (decoder->is_cmyk) {
+            decoder->row_buffer = (JSAMPROW)malloc(sizeof(JSAMPLE) * dinfo->output_width * dinfo->output_components);
+            if (decoder->row_buffer == NULL) {
+                return FALSE;
+            }
+            decoder->row_start = decoder->row_buffer;
         }
-        // 校准width和height，保证不超出图片范围
-        if (options->crop.left + options->crop.width > dinfo.image_width) {
-            crop_width = dinfo.image_width - options->crop.left;
-        } else {
-            crop_width = options->crop.width;
+        return TRUE;
+    }
+    real_left = (JDIMENSION)decoder->crop_left;
+    real_width = (JDIMENSION)decoder->crop_width;
+    // 需要局部解码图片的话，使用real_left和real_width，因为解码必须整个MCU操作，最终的出来的行还需要一次拷贝才完整。
+    // libjpeg的color quantizer不支持jpeg_crop_scanline和jpeg_skip_scanlines，只能解码整行再剪裁
+    if (dinfo->quantize_colors) {
+        real_left = 0;
+        real_width = dinfo->output_width;
+    } else if (decoder->crop_left > 0 || decoder->crop_width < dinfo->output_width) {
+        jpeg_crop_scanline(dinfo, &real_left, &real_width);
+    }
+    // 逐行读取scanlines，每行结果用row_buffer来接，因为MCU只能整个解码，实际real_width有可能比crop_width大。
+    decoder->row_buffer = (JSAMPROW)malloc(sizeof(JSAMPLE) * real_width * dinfo->output_components);
+    if (decoder->row_buffer == NULL) {
+        return FALSE;
+    }
+    decoder->row_start = decoder->row_buffer + (sizeof(JSAMPLE) * (decoder->crop_left - real_left) *
+        dinfo->output_components);
+    // 纵向跳过指定行数
+    if (dinfo->quantize_colors) {
+        while (dinfo->output_scanline < decoder->crop_top) {
+            if (jpeg_read_scanlines(dinfo, &decoder->row_buffer, 1) != 1) {
+                snprintf(decoder->jerr.last_msg, JMSG_LENGTH_MAX, "jpeg_read_scanlines() failed at line %u",
+                    dinfo->output_scanline);
+                return FALSE;
+            }
         }
-        if (options->crop.top + options->crop.height > dinfo.image_height) {
-            crop_height = dinfo.image_height - options->crop.top;
+    } else if (decoder->crop_top > 0 &&
+        (tmp = jpeg_skip_scanlines(dinfo, (JDIMENSION)decoder->crop_top)) != decoder->crop_top) {
+        snprintf(decoder->jerr.last_msg, JMSG_LENGTH_MAX, "jpeg_skip_scanlines() return %u rather than %u", tmp,
+            decoder->crop_top);
+        return FALSE;
+    }
+    return TRUE;
+}
+
+// 把libjpeg按分量存放的颜色表复制成按颜色连续存放的，失败返回FALSE
+static boolean jpeg_copy_colormap(j_decompress_ptr dinfo, jpeg_decode_result* jres) {
+    int i = 0, c = 0;
+
+    if (dinfo->colormap == NULL || dinfo->actual_number_of_colors <= 0) {
+        return FALSE;
+    }
+    jres->colormap = (unsigned char*)malloc(dinfo->actual_number_of_colors * dinfo->out_color_components);
+    if (jres->colormap == NULL) {
+        return FALSE;
+    }
+    for (i = 0; i < dinfo->actual_number_of_colors; i++) {
+        for (c = 0; c < dinfo->out_color_components; c++) {
+            jres->colormap[i * dinfo->out_color_components + c] = dinfo->colormap[c][i];
+        }
+    }
+    jres->num_colors = dinfo->actual_number_of_colors;
+    return TRUE;
+}
+
+// 读取最多num_rows行到dst，每行间隔stride字节，返回实际读到的行数，全部读完返回0，出错返回-1，错误信息在jerr.last_msg
+int jpeg_decoder_read(jpeg_decoder* decoder, unsigned char* dst, size_t stride, unsigned int num_rows) {
+    j_decompress_ptr dinfo = &decoder->dinfo;
+    JSAMPROW         rows[DECODER_BATCH_ROWS];
+    unsigned int     rows_read = 0;
+    JDIMENSION       n = 0, i = 0;
+
+    if (decoder->jerr.last_msg[0] != '\0') {
+        return -1;
+    }
+    if (setjmp(decoder->jerr.setjmp_buf)) {
+        return -1;
+    }
+    if (num_rows > decoder->crop_height - decoder->rows_read) {
+        num_rows = decoder->crop_height - decoder->rows_read;
+    }
+    while (rows_read < num_rows) {
+        if (decoder->row_buffer == NULL) {
+            // 不需要剪裁和转换，直接读到dst里
+            n = num_rows - rows_read > DECODER_BATCH_ROWS ? DECODER_BATCH_ROWS : num_rows - rows_read;
+            for (i = 0; i < n; i++) {
+                rows[i] = dst + (rows_read + i) * stride;
+            }
+            n = jpeg_read_scanlines(dinfo, rows, n);
         } else {
-            crop_height = options->crop.height;
+            // 每次只读一行，因为每行的前面有(crop_left-real_left)个像素被剪裁了，实际上读出来的scanlines会多于需要的像素，
+            // 所以复制一下到dst
+            n = jpeg_read_scanlines(dinfo, &decoder->row_buffer, 1);
+            if (n > 0 && decoder->is_cmyk) {
+                jpeg_convert_cmyk(decoder->row_start, dst + rows_read * stride, decoder->crop_width,
+                    dinfo->saw_Adobe_marker, decoder->out_color_space);
+            } else if (n > 0) {
+                memcpy(dst + rows_read * stride, decoder->row_start,
+                    sizeof(JSAMPLE) * decoder->crop_width * decoder->out_components);
+            }
         }
-        img_decoded = (JSAMPROW)malloc(sizeof(JSAMPLE) * crop_width * crop_height * dinfo.num_components);
-        if (img_decoded == NULL) {
-            goto bailout;
+        if (n == 0) {
+            snprintf(decoder->jerr.last_msg, JMSG_LENGTH_MAX, "jpeg_read_scanlines() return 0");
+            return -1;
         }
-        real_left = (JDIMENSION)options->crop.left;
-        real_width = (JDIMENSION)crop_width;
-        // 需要局部解码图片的话，使用real_left和real_width，因为解码必须整个MCU操作，最终的出来的行还需要一次拷贝才完整。
-        if (options->crop.left > 0 || crop_width < dinfo.image_width) {
-            jpeg_crop_scanline(&dinfo, &real_left, &real_width);
+        rows_read += n;
+        decoder->rows_read += n;
+    }
+    // 不剪裁的时候读完所有行，校验图片后面的数据
+    if (!decoder->need_crop && decoder->rows_read == decoder->crop_height && !decoder->finished) {
+        decoder->finished = TRUE;
+        jpeg_finish_decompress(dinfo);
+    }
+    // 解码过程中出现的警告也当作错误
+    if (decoder->jerr.last_msg[0] != '\0') {
+        return -1;
+    }
+    return (int)rows_read;
+}
+
+// 释放解码器
+void jpeg_decoder_destroy(jpeg_decoder* decoder) {
+    if (decoder == NULL) {
+        return;
+    }
+    if (decoder->created) {
+        jpeg_destroy_decompress(&decoder->dinfo);
+    }
+    if (decoder->row_buffer != NULL) {
+        free(decoder->row_buffer);
+    }
+    free(decoder);
+}
+
+// 从保存的APP1 marker中解析EXIF的Orientation，没有或者不合法时返回1
+static int jpeg_get_orientation(j_decompress_ptr dinfo) {
+    jpeg_saved_marker_ptr marker = NULL;
+    const JOCTET*         tiff = NULL;
+    unsigned int          size = 0, offset = 0, count = 0, i = 0, entry = 0, value = 0;
+    boolean               little_endian = FALSE;
+
+    for (marker = dinfo->marker_list; marker != NULL; marker = marker->next) {
+        if (marker->marker == JPEG_APP0 + 1 && marker->data_length >= 14 && memcmp(marker->data, "Exif\0\0", 6) == 0) {
+            break;
         }
-        // 纵向跳过指定行数
-        if (options->crop.top > 0 && (tmp = jpeg_skip_scanlines(&dinfo, (JDIMENSION)options->crop.top)) != options->crop.top) {
-            snprintf(jerr.last_msg, JMSG_LENGTH_MAX, "jpeg_skip_scanlines() return %u rather than %u", tmp, options->crop.top);
-            goto bailout;
+    }
+    if (marker == NULL) {
+        return 1;
+    }
+    // TIFF的header：字节序、42、IFD0的偏移，偏移都是相对TIFF header的开始
+    tiff = marker->data + 6;
+    size = marker->data_length - 6;
+    if (tiff[0] == 'I' && tiff[1] == 'I') {
+        little_endian = TRUE;
+    } else if (tiff[0] != 'M' || tiff[1] != 'M') {
+        return 1;
+    }
+#define EXIF_U16(p) (little_endian ? (unsigned int)((p)[0] | (p)[1] << 8) : (unsigned int)((p)[0] << 8 | (p)[1]))
+#define EXIF_U32(p) (little_endian ? (EXIF_U16(p) | EXIF_U16((p) + 2) << 16) : (EXIF_U16(p) << 16 | EXIF_U16((p) + 2)))
+    offset = EXIF_U32(tiff + 4);
+    if (offset > size - 2) {
+        return 1;
+    }
+    count = EXIF_U16(tiff + offset);
+    // 每个IFD entry是12字节：tag、类型、数量、值。size可能小于12，不能用size - 12比较，会溢出
+    for (i = 0; i < count; i++) {
+        entry = offset + 2 + i * 12;
+        if (entry + 12 > size) {
+            break;
         }
-        // 逐行读取scanlines，每行结果用img_row来接，因为MCU只能整个解码，实际real_width有可能比crop_width大。
-        img_row = (JSAMPROW)malloc(sizeof(JSAMPLE) * real_width * dinfo.num_components);
-        img_row_start = img_row + (sizeof(JSAMPLE) * (options->crop.left - real_left) * dinfo.num_components);
-        img_row_size = sizeof(JSAMPLE) * crop_width * dinfo.num_components;
-        current_row = img_decoded; // 指向当前第一行的指针
-        while (dinfo.output_scanline < options->crop.top + crop_height) {
-            // 每次只读一行，因为每行的前面有(options->crop.left-real_left)个像素被剪裁了
-            jpeg_read_scanlines(&dinfo, &img_row, 1);
-            // 实际上读出来的scanlines会多于需要的像素，所以复制一下到img_decoded
-            memcpy(current_row, img_row_start, img_row_size);
-            //每读完一行，current_row就移动到下一行
-            current_row += img_row_size;
+        if (EXIF_U16(tiff + entry) == 0x0112 && EXIF_U16(tiff + entry + 2) == 3) {
+            value = EXIF_U16(tiff + entry + 8);
+            break;
         }
+    }
+#undef EXIF_U32
+#undef EXIF_U16
+    return value >= 1 && value <= 8 ? (int)value : 1;
+}
+
+// 把旋转后图片的剪裁区域映射回原图的坐标。先按旋转后的宽高校准，保证不超出图片范围，映射后就不会出现负数
+static boolean jpeg_orient_crop(int orientation, unsigned int width, unsigned int height, crop_rect* crop) {
+    unsigned int oriented_width = orientation >= 5 ? height : width;
+    unsigned int oriented_height = orientation >= 5 ? width : height;
+    crop_rect    src = *crop;
+
+    if (orientation <= 1) {
+        return TRUE;
+    }
+    if (src.left >= oriented_width || src.top >= oriented_height) {
+        return FALSE;
+    }
+    if (src.width > oriented_width - src.left) {
+        src.width = oriented_width - src.left;
+    }
+    if (src.height > oriented_height - src.top) {
+        src.height = oriented_height - src.top;
+    }
+    switch (orientation) {
+    case 2:
+        // 水平翻转
+        crop->left = width - src.left - src.width;
+        break;
+    case 3:
+        // 旋转180度
+        crop->left = width - src.left - src.width;
+        crop->top = height - src.top - src.height;
+        break;
+    case 4:
+        // 垂直翻转
+        crop->top = height - src.top - src.height;
+        break;
+    case 5:
+        // 沿左上到右下的对角线翻转
+        crop->left = src.top;
+        crop->top = src.left;
+        break;
+    case 6:
+        // 顺时针旋转90度
+        crop->left = src.top;
+        crop->top = height - src.left - src.width;
+        break;
+    case 7:
+        // 沿右上到左下的对角线翻转
+        crop->left = width - src.top - src.height;
+        crop->top = height - src.left - src.width;
+        break;
+    case 8:
+        // 顺时针旋转270度
+        crop->left = width - src.top - src.height;
+        crop->top = src.left;
+        break;
+    }
+    if (orientation >= 5) {
+        crop->width = src.height;
+        crop->height = src.width;
     } else {
-        // 无图片剪裁的情况，直接一个buffer copy过去，解码更快。
-        img_decoded = (JSAMPROW)malloc(sizeof(JSAMPLE) * dinfo.output_width * dinfo.output_height * dinfo.num_components);
-        if (img_decoded == NULL) {
-            goto bailout;
+        crop->width = src.width;
+        crop->height = src.height;
+    }
+    return TRUE;
+}
+
+// 按照EXIF的Orientation旋转像素。逐个计算输出像素在原图的位置，src按行读取对缓存更友好
+static void jpeg_orient_pixels(int orientation, unsigned char* src, unsigned char* dst, unsigned int width,
+    unsigned int height, int components) {
+    unsigned int   dst_width = orientation >= 5 ? height : width;
+    unsigned int   x = 0, y = 0, dx = 0, dy = 0;
+    unsigned char* p = src;
+
+    for (y = 0; y < height; y++) {
+        for (x = 0; x < width; x++, p += components) {
+            switch (orientation) {
+            case 2:
+                dx = width - 1 - x;
+                dy = y;
+                break;
+            case 3:
+                dx = width - 1 - x;
+                dy = height - 1 - y;
+                break;
+            case 4:
+                dx = x;
+                dy = height - 1 - y;
+                break;
+            case 5:
+                dx = y;
+                dy = x;
+                break;
+            case 6:
+                dx = height - 1 - y;
+                dy = x;
+                break;
+            case 7:
+                dx = height - 1 - y;
+                dy = width - 1 - x;
+                break;
+            case 8:
+                dx = y;
+                dy = width - 1 - x;
+                break;
+            default:
+                dx = x;
+                dy = y;
+            }
+            memcpy(dst + ((size_t)dy * dst_width + dx) * components, p, components);
         }
-        crop_width = dinfo.output_width;
-        crop_height = dinfo.output_height;
-        // 初始化row_pointer
-        row_pointer = (JSAMPARRAY)malloc(sizeof(JSAMPROW) * dinfo.output_height);
-        if (row_pointer == NULL) {
+    }
+}
+
+// 读取jpeg图片header里所有的APPn和COM段，以及JFIF、Adobe和ICC profile的信息，不解码像素
+void jpeg_read_metadata(unsigned char* img, unsigned int img_size, jpeg_metadata_result* jres) {
+    struct jpeg_decompress_struct dinfo;
+    my_jpeg_err_mgr               jerr;
+    jpeg_saved_marker_ptr         marker = NULL;
+    JOCTET*                       icc_profile = NULL;
+    unsigned int                  icc_profile_size = 0;
+    boolean                       has_warning = FALSE;
+    int                           i = 0;
+
+    jerr.last_msg[0] = '\0';
+    dinfo.err = jpeg_std_error(&jerr.mgr);
+    jerr.mgr.output_message = jpeg_err_output_msg;
+    jerr.mgr.error_exit = jpeg_err_exit;
+    jpeg_create_decompress(&dinfo);
+    if (setjmp(jerr.setjmp_buf)) {
+        goto bailout;
+    }
+    jpeg_mem_src(&dinfo, img, img_size);
+    // 默认只保存了JFIF和Adobe需要的部分，这里把所有的段都完整地保存下来
+    jpeg_save_markers(&dinfo, JPEG_COM, 0xFFFF);
+    for (i = 0; i < 16; i++) {
+        jpeg_save_markers(&dinfo, JPEG_APP0 + i, 0xFFFF);
+    }
+    if (jpeg_read_header(&dinfo, TRUE) != JPEG_HEADER_OK) {
+        goto bailout;
+    }
+    for (marker = dinfo.marker_list; marker != NULL; marker = marker->next) {
+        jres->num_markers++;
+    }
+    if (jres->num_markers > 0) {
+        jres->markers = (jpeg_marker*)calloc(jres->num_markers, sizeof(jpeg_marker));
+        if (jres->markers == NULL) {
+            snprintf(jerr.last_msg, JMSG_LENGTH_MAX, "out of memory");
             goto bailout;
         }
-        img_row_size = sizeof(JSAMPLE) * dinfo.output_width * dinfo.num_components;
-        for (tmp = 0; tmp < dinfo.output_height; tmp++) {
-            row_pointer[tmp] = &img_decoded[tmp * img_row_size];
+    }
+    for (marker = dinfo.marker_list, i = 0; marker != NULL; marker = marker->next, i++) {
+        jres->markers[i].marker = marker->marker;
+        jres->markers[i].data_length = marker->data_length;
+        if (marker->data_length == 0) {
+            continue;
         }
-        while (dinfo.output_scanline < dinfo.output_height) {
-            jpeg_read_scanlines(&dinfo, &row_pointer[dinfo.output_scanline], dinfo.output_height - dinfo.output_scanline);
+        jres->markers[i].data = (unsigned char*)malloc(marker->data_length);
+        if (jres->markers[i].data == NULL) {
+            snprintf(jerr.last_msg, JMSG_LENGTH_MAX, "out of memory");
+            goto bailout;
         }
-        jpeg_finish_decompress(&dinfo);
+        memcpy(jres->markers[i].data, marker->data, marker->data_length);
     }
-bailout:
-    jres->img = img_decoded;
-    if (jres->img != NULL) {
-        jres->img_size = sizeof(JSAMPLE) * crop_width * crop_height * dinfo.num_components;
+    jres->saw_JFIF_marker = dinfo.saw_JFIF_marker;
+    jres->JFIF_major_version = dinfo.JFIF_major_version;
+    jres->JFIF_minor_version = dinfo.JFIF_minor_version;
+    jres->density_unit = dinfo.density_unit;
+    jres->X_density = dinfo.X_density;
+    jres->Y_density = dinfo.Y_density;
+    jres->saw_Adobe_marker = dinfo.saw_Adobe_marker;
+    jres->Adobe_transform = dinfo.Adobe_transform;
+    // ICC profile可能被拆到多个APP2里，jpeg_read_icc_profile会按序号拼起来。ICC profile不合法时只有警告，忽略掉就行，
+    // 原始的APP2段还在markers里
+    has_warning = jerr.last_msg[0] != '\0';
+    if (jpeg_read_icc_profile(&dinfo, &icc_profile, &icc_profile_size)) {
+        jres->icc_profile = icc_profile;
+        jres->icc_profile_size = icc_profile_size;
+    } else if (!has_warning) {
+        jerr.last_msg[0] = '\0';
     }
-    // 如果last_msg非空，从c的栈copy去堆上
+bailout:
     if (jerr.last_msg[0] != '\0') {
         jres->err = malloc(sizeof(char) * JMSG_LENGTH_MAX);
         memcpy(jres->err, jerr.last_msg, JMSG_LENGTH_MAX);
     }
-    jres->image_width = crop_width;
-    jres->image_height = crop_height;
+    jpeg_destroy_decompress(&dinfo);
+}
+
+// 释放jpeg_read_metadata分配的内存
+void jpeg_metadata_free(jpeg_metadata_result* jres) {
+    int i = 0;
+
+    if (jres->markers != NULL) {
+        for (i = 0; i < jres->num_markers; i++) {
+            if (jres->markers[i].data != NULL) {
+                free(jres->markers[i].data);
+            }
+        }
+        free(jres->markers);
+        jres->markers = NULL;
+    }
+    if (jres->icc_profile != NULL) {
+        free(jres->icc_profile);
+        jres->icc_profile = NULL;
+    }
+}
+
+// 只读取jpeg图片的header，不解码像素
+void jpeg_decode_config(unsigned char* img, unsigned int img_size, jpeg_decode_config_result* jres) {
+    struct jpeg_decompress_struct dinfo;
+    my_jpeg_err_mgr               jerr;
+
+    jerr.last_msg[0] = '\0';
+    dinfo.err = jpeg_std_error(&jerr.mgr);
+    jerr.mgr.output_message = jpeg_err_output_msg;
+    jerr.mgr.error_exit = jpeg_err_exit;
+    jpeg_create_decompress(&dinfo);
+    if (setjmp(jerr.setjmp_buf)) {
+        goto bailout;
+    }
+    jpeg_mem_src(&dinfo, img, img_size);
+    // jpeg_read_header遇到SOS就返回了，不会去读后面的图片数据
+    if (jpeg_read_header(&dinfo, TRUE) != JPEG_HEADER_OK) {
+        goto bailout;
+    }
     jres->origin_width = dinfo.image_width;
     jres->origin_height = dinfo.image_height;
     jres->color_space = dinfo.jpeg_color_space;
+    jres->sub_sample = jpeg_get_sub_sample(&dinfo);
     jres->num_components = dinfo.num_components;
+    jres->progressive = dinfo.progressive_mode;
+    jres->precision = dinfo.data_precision;
+bailout:
+    if (jerr.last_msg[0] != '\0') {
+        jres->err = malloc(sizeof(char) * JMSG_LENGTH_MAX);
+        memcpy(jres->err, jerr.last_msg, JMSG_LENGTH_MAX);
+    }
     jpeg_destroy_decompress(&dinfo);
-    if (img_row != NULL) {
-        free(img_row);
+}
+
+// 解码jpeg图片成YUV平面，不做颜色空间转换和升采样
+void jpeg_decode_yuv(unsigned char* img, unsigned int img_size, unsigned char* y_plane, unsigned char* cb_plane,
+    unsigned char* cr_plane, jpeg_decode_yuv_result* jres) {
+    tjhandle       tj_handler = NULL;
+    unsigned char* planes[3] = {y_plane, cb_plane, cr_plane};
+
+    tj_handler = tjInitDecompress();
+    if (tj_handler == NULL) {
+        goto bailout;
     }
-    if (row_pointer != NULL) {
-        free(row_pointer);
+    // width和height传0表示不缩放，strides传NULL表示每个平面的stride就是平面宽度
+    if (tjDecompressToYUVPlanes(tj_handler, img, img_size, planes, 0, NULL, 0, 0) < 0) {
+        goto bailout;
+    }
+    tjDestroy(tj_handler);
+    return;
+bailout:
+    jres->err = (char*)malloc(sizeof(char) * JMSG_LENGTH_MAX);
+    snprintf(jres->err, JMSG_LENGTH_MAX, "%s", tjGetErrorStr2(tj_handler));
+    if (tj_handler != NULL) {
+        tjDestroy(tj_handler);
     }
 }
 
-// 编码jpeg图片
-void jpeg_encode(unsigned char* img, int width, int height, int pixel_format, jpeg_encode_options* options,
-    jpeg_encode_result *jres) {
-    int            quality    = DEFAULT_QUALITY;
-    int            flag       = 0;
-    int            sub_sample = TJSAMP_420;
-    tjhandle       tj_handler = NULL;
+// 编码jpeg图片，dst不为NULL时直接编码到调用方的dst里，dst至少要有tjBufSize那么大。dst为NULL时由turbojpeg分配，放在返回值的img里。
+// quality不大于0、sub_sample小于0时使用默认值。参数和返回值都不是指针，Go调用时不需要在堆上分配。
+// compressor是复用的tjInitCompress的handle，为NULL时临时创建一个
+jpeg_encode_result jpeg_encode_into(tjhandle compressor, unsigned char* img, int width, int height, int pixel_format,
+    int quality, int tj_flag, int sub_sample, unsigned char* dst, unsigned long dst_size) {
+    jpeg_encode_result jres       = {NULL, 0, NULL};
+    tjhandle           tj_handler = compressor;
+    unsigned char*     out        = dst;
+    unsigned long      out_size   = dst_size;
+
+    if (quality <= 0) {
+        quality = DEFAULT_QUALITY;
+    }
+    if (sub_sample < 0) {
+        sub_sample = TJSAMP_420;
+    }
+    // TJFLAG_NOREALLOC时turbojpeg直接写到dst里，不会重新分配
+    if (dst != NULL) {
+        tj_flag |= TJFLAG_NOREALLOC;
+    }
+    if (tj_handler == NULL) {
+        tj_handler = tjInitCompress();
+    }
+    if (tj_handler == NULL) {
+        goto bailout;
+    }
+    if (tjCompress2(tj_handler, img, width, 0, height, pixel_format, &out, &out_size, sub_sample, quality,
+        tj_flag) < 0) {
+        goto bailout;
+    }
+    jres.img_size = out_size;
+    if (dst == NULL) {
+        jres.img = out;
+    }
+    if (tj_handler != compressor) {
+        tjDestroy(tj_handler);
+    }
+    return jres;
+bailout:
+    // turbojpeg分配的内存交给调用方释放
+    if (dst == NULL) {
+        jres.img = out;
+    }
+    // 错误异常处理
+    jres.err = (char*)malloc(sizeof(char) * JMSG_LENGTH_MAX);
+    memcpy(jres.err, tjGetErrorStr2(tj_handler), JMSG_LENGTH_MAX);
+    if (tj_handler != NULL && tj_handler != compressor) {
+        tjDestroy(tj_handler);
+    }
+    return jres;
+}
+
+// 把YUV平面编码成jpeg图片，省掉RGB到YCbCr的颜色空间转换和降采样
+void jpeg_encode_yuv(unsigned char* y_plane, unsigned char* cb_plane, unsigned char* cr_plane, int y_stride,
+    int c_stride, int width, int height, int sub_sample, jpeg_encode_options* options, jpeg_encode_result* jres) {
+    int                  quality    = DEFAULT_QUALITY;
+    int                  flag       = 0;
+    tjhandle             tj_handler = NULL;
+    const unsigned char* planes[3]  = {y_plane, cb_plane, cr_plane};
+    int                  strides[3] = {y_stride, c_stride, c_stride};
 
     tj_handler = tjInitCompress();
     if (tj_handler == NULL) {
@@ -177,48 +999,464 @@ void jpeg_encode(unsigned char* img, int width, int height, int pixel_format, jp
             quality = options->quality;
         }
         flag = options->tj_flag;
-        if (options->sub_sample >= 0) {
-            sub_sample = options->sub_sample;
-        }
     }
-    if (tjCompress2(tj_handler, img, width, 0, height, pixel_format, &(jres->img), &(jres->img_size), sub_sample,
-        quality, flag) < 0) {
+    if (tjCompressFromYUVPlanes(tj_handler, planes, width, strides, height, sub_sample, &(jres->img),
+        &(jres->img_size), quality, flag) < 0) {
         goto bailout;
     }
     tjDestroy(tj_handler);
     return;
 bailout:
-    // 错误异常处理
     jres->err = (char*)malloc(sizeof(char) * JMSG_LENGTH_MAX);
-    memcpy(jres->err, tjGetErrorStr2(tj_handler), JMSG_LENGTH_MAX);
+    snprintf(jres->err, JMSG_LENGTH_MAX, "%s", tjGetErrorStr2(tj_handler));
     if (tj_handler != NULL) {
         tjDestroy(tj_handler);
     }
 }
 
+// 无损变换jpeg图片，直接操作DCT系数，不需要解码和重新编码
+void jpeg_transform(unsigned char* img, unsigned long img_size, jpeg_transform_options* options,
+    jpeg_transform_result* jres) {
+    tjhandle    tj_handler = NULL;
+    tjtransform transform;
+
+    memset(&transform, 0, sizeof(tjtransform));
+    transform.op = options->op;
+    transform.options = options->options;
+    if (options->crop.width > 0 && options->crop.height > 0) {
+        transform.options |= TJXOPT_CROP;
+        transform.r.x = (int)options->crop.left;
+        transform.r.y = (int)options->crop.top;
+        transform.r.w = (int)options->crop.width;
+        transform.r.h = (int)options->crop.height;
+    }
+    tj_handler = tjInitTransform();
+    if (tj_handler == NULL) {
+        goto bailout;
+    }
+    if (tjTransform(tj_handler, img, img_size, 1, &(jres->img), &(jres->img_size), &transform, 0) < 0) {
+        goto bailout;
+    }
+    tjDestroy(tj_handler);
+    return;
+bailout:
+    jres->err = (char*)malloc(sizeof(char) * JMSG_LENGTH_MAX);
+    snprintf(jres->err, JMSG_LENGTH_MAX, "%s", tjGetErrorStr2(tj_handler));
+    if (tj_handler != NULL) {
+        tjDestroy(tj_handler);
+    }
+}
+
+// 和turbojpeg一样，TJPF对应的输入颜色空间
+static const J_COLOR_SPACE pixel_format_color_spaces[TJ_NUMPF] = {
+    JCS_EXT_RGB, JCS_EXT_BGR, JCS_EXT_RGBX, JCS_EXT_BGRX, JCS_EXT_XBGR, JCS_EXT_XRGB, JCS_GRAYSCALE,
+    JCS_EXT_RGBA, JCS_EXT_BGRA, JCS_EXT_ABGR, JCS_EXT_ARGB, JCS_CMYK
+};
+
+// 往Go的io.Writer写数据的destination manager，buffer写满了就交给Go
+static void jpeg_writer_init_destination(j_compress_ptr cinfo) {
+    jpeg_writer_destination_mgr* dest = (jpeg_writer_destination_mgr*)cinfo->dest;
+    dest->pub.next_output_byte = dest->buffer;
+    dest->pub.free_in_buffer = dest->buffer_size;
+}
+
+static boolean jpeg_writer_empty_output_buffer(j_compress_ptr cinfo) {
+    jpeg_writer_destination_mgr* dest = (jpeg_writer_destination_mgr*)cinfo->dest;
+
+    // empty_output_buffer的时候要写整个buffer，不管free_in_buffer
+    if (goJpegWriterWrite(dest->writer, dest->buffer, (int)dest->buffer_size) < 0) {
+        // 具体的错误由Go记录在writer里
+        ERREXIT(cinfo, JERR_FILE_WRITE);
+    }
+    dest->pub.next_output_byte = dest->buffer;
+    dest->pub.free_in_buffer = dest->buffer_size;
+    return TRUE;
+}
+
+static void jpeg_writer_term_destination(j_compress_ptr cinfo) {
+    jpeg_writer_destination_mgr* dest = (jpeg_writer_destination_mgr*)cinfo->dest;
+    size_t                       size = dest->buffer_size - dest->pub.free_in_buffer;
+
+    if (size > 0 && goJpegWriterWrite(dest->writer, dest->buffer, (int)size) < 0) {
+        ERREXIT(cinfo, JERR_FILE_WRITE);
+    }
+}
+
+// 设置往Go的io.Writer写数据的destination manager，内存由libjpeg管理，jpeg_destroy_compress时释放
+void jpeg_writer_dest(j_compress_ptr cinfo, uintptr_t writer, unsigned int buffer_size) {
+    jpeg_writer_destination_mgr* dest = NULL;
+
+    if (cinfo->dest == NULL) {
+        cinfo->dest = (struct jpeg_destination_mgr*)(*cinfo->mem->alloc_small)((j_common_ptr)cinfo, JPOOL_PERMANENT,
+            sizeof(jpeg_writer_destination_mgr));
+        dest = (jpeg_writer_destination_mgr*)cinfo->dest;
+        dest->buffer = (JOCTET*)(*cinfo->mem->alloc_large)((j_common_ptr)cinfo, JPOOL_PERMANENT,
+            buffer_size * sizeof(JOCTET));
+        dest->buffer_size = buffer_size;
+    }
+    dest = (jpeg_writer_destination_mgr*)cinfo->dest;
+    dest->pub.init_destination = jpeg_writer_init_destination;
+    dest->pub.empty_output_buffer = jpeg_writer_empty_output_buffer;
+    dest->pub.term_destination = jpeg_writer_term_destination;
+    dest->writer = writer;
+}
+
+// 创建逐行编码的编码器，编码结果写到Go的io.Writer。失败时返回NULL，错误信息写到jres->err
+jpeg_encoder* jpeg_encoder_create(uintptr_t writer, unsigned int buffer_size, int width, int height, int pixel_format,
+    jpeg_encode_options* options, jpeg_encode_result* jres) {
+    jpeg_encoder* encoder = NULL;
+
+    encoder = (jpeg_encoder*)calloc(1, sizeof(jpeg_encoder));
+    if (encoder == NULL) {
+        return NULL;
+    }
+    encoder->cinfo.err = jpeg_std_error(&encoder->jerr.mgr);
+    encoder->jerr.mgr.output_message = jpeg_err_output_msg;
+    encoder->jerr.mgr.error_exit = jpeg_err_exit;
+    if (setjmp(encoder->jerr.setjmp_buf)) {
+        goto bailout;
+    }
+    jpeg_create_compress(&encoder->cinfo);
+    encoder->created = TRUE;
+    if (pixel_format < 0 || pixel_format >= TJ_NUMPF || width <= 0 || height <= 0) {
+        snprintf(encoder->jerr.last_msg, JMSG_LENGTH_MAX, "invalid argument, width = %d, height = %d, "
+            "pixel_format = %d", width, height, pixel_format);
+        goto bailout;
+    }
+    jpeg_writer_dest(&encoder->cinfo, writer, buffer_size);
+    if (!jpeg_encoder_start(encoder, width, height, pixel_format, options)) {
+        goto bailout;
+    }
+    return encoder;
+bailout:
+    if (encoder->jerr.last_msg[0] != '\0') {
+        jres->err = malloc(sizeof(char) * JMSG_LENGTH_MAX);
+        memcpy(jres->err, encoder->jerr.last_msg, JMSG_LENGTH_MAX);
+    }
+    jpeg_encoder_destroy(encoder);
+    return NULL;
+}
+
+// 和tjCompress2一样设置编码参数，然后开始编码。失败返回FALSE，错误信息在jerr.last_msg
+static boolean jpeg_encoder_start(jpeg_encoder* encoder, int width, int height, int pixel_format,
+    jpeg_encode_options* options) {
+    j_compress_ptr cinfo = &encoder->cinfo;
+    int            quality = DEFAULT_QUALITY;
+    int            flag = 0;
+    int            sub_sample = TJSAMP_420;
+    int            i = 0;
+
+    if (setjmp(encoder->jerr.setjmp_buf)) {
+        return FALSE;
+    }
+    if (options != NULL) {
+        if (options->quality > 0) {
+            quality = options->quality;
+        }
+        flag = options->tj_flag;
+        if (options->sub_sample >= 0) {
+            sub_sample = options->sub_sample;
+        }
+    }
+    cinfo->image_width = (JDIMENSION)width;
+    cinfo->image_height = (JDIMENSION)height;
+    cinfo->in_color_space = pixel_format_color_spaces[pixel_format];
+    cinfo->input_components = tjPixelSize[pixel_format];
+    jpeg_set_defaults(cinfo);
+    jpeg_set_quality(cinfo, quality, TRUE);
+    cinfo->dct_method = quality >= 96 || (flag & TJFLAG_ACCURATEDCT) ? JDCT_ISLOW : JDCT_FASTEST;
+    // 灰度图只能编码成灰度的JPEG
+    if (sub_sample == TJSAMP_GRAY || pixel_format == TJPF_GRAY) {
+        sub_sample = TJSAMP_GRAY;
+        jpeg_set_colorspace(cinfo, JCS_GRAYSCALE);
+    } else if (pixel_format == TJPF_CMYK) {
+        jpeg_set_colorspace(cinfo, JCS_YCCK);
+    } else {
+        jpeg_set_colorspace(cinfo, JCS_YCbCr);
+    }
+    if (flag & TJFLAG_PROGRESSIVE) {
+        jpeg_simple_progression(cinfo);
+    }
+    cinfo->comp_info[0].h_samp_factor = tjMCUWidth[sub_sample] / 8;
+    cinfo->comp_info[0].v_samp_factor = tjMCUHeight[sub_sample] / 8;
+    if (cinfo->num_components > 1) {
+        cinfo->comp_info[1].h_samp_factor = 1;
+        cinfo->comp_info[1].v_samp_factor = 1;
+        cinfo->comp_info[2].h_samp_factor = 1;
+        cinfo->comp_info[2].v_samp_factor = 1;
+    }
+    if (cinfo->num_components > 3) {
+        cinfo->comp_info[3].h_samp_factor = tjMCUWidth[sub_sample] / 8;
+        cinfo->comp_info[3].v_samp_factor = tjMCUHeight[sub_sample] / 8;
+    }
+    // 输入的CMYK是0代表无墨的，而YCCK的JPEG按Adobe的约定是反转存储的，每行需要先反转到row_buffer
+    if (pixel_format == TJPF_CMYK) {
+        encoder->row_buffer = (JSAMPROW)malloc(sizeof(JSAMPLE) * width * 4);
+        if (encoder->row_buffer == NULL) {
+            return FALSE;
+        }
+    }
+    jpeg_set_cancel((j_common_ptr)cinfo, &encoder->progress, options != NULL ? options->cancel : NULL);
+    jpeg_start_compress(cinfo, TRUE);
+    // jpeg_start_compress已经写了SOI和JFIF或者Adobe，其他的段要在第一行像素之前写
+    if (options != NULL) {
+        if (options->icc_profile != NULL && options->icc_profile_size > 0) {
+            jpeg_write_icc_profile(cinfo, options->icc_profile, options->icc_profile_size);
+        }
+        for (i = 0; i < options->num_markers; i++) {
+            jpeg_write_marker(cinfo, options->markers[i].marker, options->markers[i].data,
+                options->markers[i].data_length);
+        }
+    }
+    return TRUE;
+}
+
+// 写入最多num_rows行，每行间隔stride字节，返回实际写入的行数，出错返回-1，错误信息在jerr.last_msg
+int jpeg_encoder_write(jpeg_encoder* encoder, unsigned char* src, size_t stride, unsigned int num_rows) {
+    j_compress_ptr cinfo = &encoder->cinfo;
+    JSAMPROW       rows[ENCODER_BATCH_ROWS];
+    unsigned int   rows_written = 0;
+    JDIMENSION     n = 0, i = 0;
+    size_t         row_size = 0;
+
+    if (encoder->jerr.last_msg[0] != '\0') {
+        return -1;
+    }
+    if (setjmp(encoder->jerr.setjmp_buf)) {
+        return -1;
+    }
+    if (num_rows > cinfo->image_height - cinfo->next_scanline) {
+        num_rows = cinfo->image_height - cinfo->next_scanline;
+    }
+    row_size = sizeof(JSAMPLE) * cinfo->image_width * cinfo->input_components;
+    while (rows_written < num_rows) {
+        if (encoder->row_buffer == NULL) {
+            n = num_rows - rows_written > ENCODER_BATCH_ROWS ? ENCODER_BATCH_ROWS : num_rows - rows_written;
+            for (i = 0; i < n; i++) {
+                rows[i] = src + (rows_written + i) * stride;
+            }
+            n = jpeg_write_scanlines(cinfo, rows, n);
+        } else {
+            for (i = 0; i < row_size; i++) {
+                encoder->row_buffer[i] = 0xFF - src[rows_written * stride + i];
+            }
+            n = jpeg_write_scanlines(cinfo, &encoder->row_buffer, 1);
+        }
+        if (n == 0) {
+            snprintf(encoder->jerr.last_msg, JMSG_LENGTH_MAX, "jpeg_write_scanlines() return 0");
+            return -1;
+        }
+        rows_written += n;
+    }
+    if (encoder->jerr.last_msg[0] != '\0') {
+        return -1;
+    }
+    return (int)rows_written;
+}
+
+// 结束编码，把剩下的数据写到writer里。所有行都写完了才能结束，成功返回0，出错返回-1
+int jpeg_encoder_finish(jpeg_encoder* encoder) {
+    j_compress_ptr cinfo = &encoder->cinfo;
+
+    if (encoder->jerr.last_msg[0] != '\0') {
+        return -1;
+    }
+    if (setjmp(encoder->jerr.setjmp_buf)) {
+        return -1;
+    }
+    if (cinfo->next_scanline < cinfo->image_height) {
+        snprintf(encoder->jerr.last_msg, JMSG_LENGTH_MAX, "only %u of %u scanlines written", cinfo->next_scanline,
+            cinfo->image_height);
+        return -1;
+    }
+    jpeg_finish_compress(cinfo);
+    return encoder->jerr.last_msg[0] != '\0' ? -1 : 0;
+}
+
+// 释放编码器
+void jpeg_encoder_destroy(jpeg_encoder* encoder) {
+    if (encoder == NULL) {
+        return;
+    }
+    if (encoder->created) {
+        jpeg_destroy_compress(&encoder->cinfo);
+    }
+    if (encoder->row_buffer != NULL) {
+        free(encoder->row_buffer);
+    }
+    free(encoder);
+}
+
 static void jpeg_find_denom(unsigned int width, unsigned int height, unsigned int expect_width,
     unsigned int expect_height, unsigned int *scale_num, unsigned int *scale_denom) {
-    static const tjscalingfactor scale_factors[] = {
-        {1, 1},
-        {1, 2},
-        {1, 4},
-        {1, 8}
-    };
-    int i = 0;
-    int tmp_width = 0, tmp_height = 0;
+    tjscalingfactor *scale_factors = NULL;
+    int              num_scale_factors = 0;
+    int              i = 0;
+    unsigned int     tmp_width = 0, tmp_height = 0;
+    unsigned int     best_width = width, best_height = height;
 
     if (scale_num == NULL || scale_denom == NULL) {
         return;
     }
-    // factors的缩小比例从小到大，scale_factors[0]是无缩放的
-    for (i = 1; i < sizeof(scale_factors) / sizeof(tjscalingfactor); ++i) {
-        tmp_width = TJSCALED(width, scale_factors[i]);
-        tmp_height = TJSCALED(height, scale_factors[i]);
-        if (tmp_width < expect_width || tmp_height < expect_height) {
-            //恰好小于dst，说明上一组的缩放比例正合适
-            *scale_num = (unsigned int)scale_factors[i - 1].num;
-            *scale_denom = (unsigned int)scale_factors[i - 1].denom;
-            return;
+    // 默认不缩放，期望值比原图还大的时候也保持原图大小
+    *scale_num = 1;
+    *scale_denom = 1;
+    scale_factors = tjGetScalingFactors(&num_scale_factors);
+    if (scale_factors == NULL) {
+        return;
+    }
+    // 遍历libjpeg-turbo支持的所有N/8缩放比例，只考虑缩小的，找出宽高都不小于期望值的最小尺寸
+    for (i = 0; i < num_scale_factors; ++i) {
+        if (scale_factors[i].num >= scale_factors[i].denom) {
+            continue;
+        }
+        tmp_width = (unsigned int)TJSCALED((int)width, scale_factors[i]);
+        tmp_height = (unsigned int)TJSCALED((int)height, scale_factors[i]);
+        if (tmp_width >= expect_width && tmp_height >= expect_height && tmp_width <= best_width &&
+            tmp_height <= best_height && (tmp_width < best_width || tmp_height < best_height)) {
+            best_width = tmp_width;
+            best_height = tmp_height;
+            *scale_num = (unsigned int)scale_factors[i].num;
+            *scale_denom = (unsigned int)scale_factors[i].denom;
+        }
+    }
+}
+
+// 转换CMYK像素。Adobe的CMYK是反转存储的（255代表无墨），统一转成0代表无墨，和image.CMYK一致。
+// 转成RGB格式的时候每个像素不会超过4字节，src和dst是同一块内存也不会覆盖没处理的数据。
+static void jpeg_convert_cmyk(JSAMPROW src, JSAMPROW dst, size_t pixels, boolean inverted, J_COLOR_SPACE out_color_space) {
+    size_t       i = 0;
+    unsigned int c = 0, m = 0, y = 0, k = 0;
+    boolean      to_rgb = out_color_space != JCS_CMYK;
+    int          red = 0, green = 0, blue = 0, pixel_size = 4;
+
+    if (to_rgb) {
+        jpeg_rgb_layout(out_color_space, &red, &green, &blue, &pixel_size);
+    }
+
+    for (i = 0; i < pixels; i++) {
+        // 先统一成反转的值，即255代表无墨
+        c = src[0];
+        m = src[1];
+        y = src[2];
+        k = src[3];
+        if (!inverted) {
+            c = MAXJSAMPLE - c;
+            m = MAXJSAMPLE - m;
+            y = MAXJSAMPLE - y;
+            k = MAXJSAMPLE - k;
+        }
+        if (to_rgb) {
+            // 4字节的格式，剩下的那个X或者A分量的偏移是0+1+2+3减去RGB的偏移，和libjpeg一样填0xFF
+            if (pixel_size == 4) {
+                dst[6 - red - green - blue] = MAXJSAMPLE;
+            }
+            dst[red] = (JSAMPLE)((c * k + MAXJSAMPLE / 2) / MAXJSAMPLE);
+            dst[green] = (JSAMPLE)((m * k + MAXJSAMPLE / 2) / MAXJSAMPLE);
+            dst[blue] = (JSAMPLE)((y * k + MAXJSAMPLE / 2) / MAXJSAMPLE);
+            dst += pixel_size;
+        } else {
+            dst[0] = (JSAMPLE)(MAXJSAMPLE - c);
+            dst[1] = (JSAMPLE)(MAXJSAMPLE - m);
+            dst[2] = (JSAMPLE)(MAXJSAMPLE - y);
+            dst[3] = (JSAMPLE)(MAXJSAMPLE - k);
+            dst += 4;
+        }
+        src += 4;
+    }
+}
+
+// 获取RGB格式中各个分量的偏移和每个像素的字节数，不需要的参数可以传NULL
+static boolean jpeg_rgb_layout(J_COLOR_SPACE color_space, int* red, int* green, int* blue, int* pixel_size) {
+    int r = 0, g = 1, b = 2, size = 3;
+
+    switch (color_space) {
+    case JCS_RGB:
+    case JCS_EXT_RGB:
+        break;
+    case JCS_EXT_BGR:
+        r = 2;
+        b = 0;
+        break;
+    case JCS_EXT_RGBX:
+    case JCS_EXT_RGBA:
+        size = 4;
+        break;
+    case JCS_EXT_BGRX:
+    case JCS_EXT_BGRA:
+        r = 2;
+        b = 0;
+        size = 4;
+        break;
+    case JCS_EXT_XBGR:
+    case JCS_EXT_ABGR:
+        r = 3;
+        g = 2;
+        b = 1;
+        size = 4;
+        break;
+    case JCS_EXT_XRGB:
+    case JCS_EXT_ARGB:
+        r = 1;
+        g = 2;
+        b = 3;
+        size = 4;
+        break;
+    default:
+        return FALSE;
+    }
+    if (red != NULL) {
+        *red = r;
+    }
+    if (green != NULL) {
+        *green = g;
+    }
+    if (blue != NULL) {
+        *blue = b;
+    }
+    if (pixel_size != NULL) {
+        *pixel_size = size;
+    }
+    return TRUE;
+}
+
+// 根据各个颜色分量的采样因子推算出TJSAMP，和turbojpeg内部的getSubsamp逻辑一致
+static int jpeg_get_sub_sample(j_decompress_ptr dinfo) {
+    int i = 0, k = 0;
+    int match = 0;
+    int h_ref = 1, v_ref = 1;
+    boolean is_cmyk = dinfo->jpeg_color_space == JCS_CMYK || dinfo->jpeg_color_space == JCS_YCCK;
+
+    if (dinfo->num_components == 1 && dinfo->jpeg_color_space == JCS_GRAYSCALE) {
+        return TJSAMP_GRAY;
+    }
+    if (dinfo->num_components != 3 && !(is_cmyk && dinfo->num_components == 4)) {
+        return -1;
+    }
+    for (i = 0; i < TJ_NUMSAMP; i++) {
+        if (i == TJSAMP_GRAY) {
+            continue;
+        }
+        if (dinfo->comp_info[0].h_samp_factor != tjMCUWidth[i] / 8 ||
+            dinfo->comp_info[0].v_samp_factor != tjMCUHeight[i] / 8) {
+            continue;
+        }
+        // 除了Y（CMYK的话还有K）以外，其余分量都应该是1x1的
+        match = 0;
+        for (k = 1; k < dinfo->num_components; k++) {
+            h_ref = 1;
+            v_ref = 1;
+            if (is_cmyk && k == 3) {
+                h_ref = tjMCUWidth[i] / 8;
+                v_ref = tjMCUHeight[i] / 8;
+            }
+            if (dinfo->comp_info[k].h_samp_factor == h_ref && dinfo->comp_info[k].v_samp_factor == v_ref) {
+                match++;
+            }
+        }
+        if (match == dinfo->num_components - 1) {
+            return i;
         }
     }
+    return -1;
 }
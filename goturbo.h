@@ -5,10 +5,16 @@
 #include <memory.h>
 #include <stdlib.h>
 #include <setjmp.h>
+#include <stdint.h>
 #include "turbojpeg.h"
 #include "jpeglib.h"
+#include "jerror.h"
 
 #define DEFAULT_QUALITY 95
+// 不需要剪裁和转换时，每次调用jpeg_read_scanlines最多读取的行数
+#define DECODER_BATCH_ROWS 16
+// 每次调用jpeg_write_scanlines最多写入的行数
+#define ENCODER_BATCH_ROWS 16
 
 // 搞一个新的err mgr，因为原来的不能保存last_msg信息。
 typedef struct my_jpeg_err_mgr {
@@ -17,6 +23,12 @@ typedef struct my_jpeg_err_mgr {
     char last_msg[JMSG_LENGTH_MAX];
 } my_jpeg_err_mgr;
 
+// 检查是否取消的progress monitor，cancel由Go在context取消时设置，不为0时中止编解码
+typedef struct jpeg_cancel_progress_mgr {
+    struct jpeg_progress_mgr pub;
+    int* cancel;
+} jpeg_cancel_progress_mgr;
+
 typedef struct crop_rect {
     unsigned int left;
     unsigned int top;
@@ -33,8 +45,58 @@ typedef struct jpeg_decode_options {
     boolean do_fancy_upsampling;
     unsigned int scale_num, scale_denom;
     unsigned int expect_width, expect_height;
+    boolean cmyk_to_rgb;
+    J_COLOR_SPACE out_color_space;
+    // 按照EXIF的Orientation旋转图片，剪裁区域和期望的宽高都是旋转后的坐标
+    boolean auto_orient;
+    // 读取ICC profile，放到jpeg_decode_result里
+    boolean read_icc_profile;
+    // 用libjpeg的color quantizer输出颜色表的下标，颜色表放到jpeg_decode_result里，不支持CMYK
+    boolean quantize_colors;
+    // 不为NULL时，解码过程中*cancel不为0就中止解码
+    int* cancel;
 } jpeg_decode_options;
 
+// 从Go的io.Reader读取数据的source manager，reader是cgo.Handle
+typedef struct jpeg_reader_source_mgr {
+    struct jpeg_source_mgr pub;
+    uintptr_t reader;
+    JOCTET* buffer;
+    unsigned int buffer_size;
+    boolean start_of_file;
+} jpeg_reader_source_mgr;
+
+// 解码的数据来源，img非空时从内存读取，否则从reader读取
+typedef struct jpeg_decode_source {
+    unsigned char* img;
+    unsigned int img_size;
+    uintptr_t reader;
+    unsigned int buffer_size;
+} jpeg_decode_source;
+
+// 逐行解码的解码器，需要在多次调用之间保存解码的状态，所以放在堆上
+typedef struct jpeg_decoder {
+    struct jpeg_decompress_struct dinfo;
+    my_jpeg_err_mgr jerr;
+    boolean created;
+    boolean finished;
+    boolean is_cmyk;
+    boolean need_crop;
+    J_COLOR_SPACE out_color_space;
+    int out_components;
+    // 输出坐标的剪裁区域，不剪裁时就是整个输出图片
+    unsigned int crop_left, crop_top, crop_width, crop_height;
+    // 需要剪裁或者转换CMYK时，每行先读到row_buffer，row_start是剪裁区域在这一行的开始
+    JSAMPROW row_buffer;
+    JSAMPROW row_start;
+    unsigned int rows_read;
+    // EXIF的Orientation，1表示不需要旋转，没有设置auto_orient时总是1
+    int orientation;
+    // jpeg_decoder_alloc创建的解码器，用完之后重置状态，不会被释放
+    boolean reusable;
+    jpeg_cancel_progress_mgr progress;
+} jpeg_decoder;
+
 typedef struct jpeg_decode_result {
     unsigned char* img;
     unsigned int img_size;
@@ -44,15 +106,99 @@ typedef struct jpeg_decode_result {
     unsigned int origin_height;
     J_COLOR_SPACE color_space;
     int num_components;
+    // 设置了read_icc_profile并且图片有ICC profile的时候才有，需要用free释放
+    unsigned char* icc_profile;
+    unsigned int icc_profile_size;
+    // 设置了quantize_colors时的颜色表，num_colors个颜色，每个颜色num_components个分量连续存放，需要用free释放
+    unsigned char* colormap;
+    int num_colors;
     char* err;
 } jpeg_decode_result;
 
+typedef struct jpeg_decode_config_result {
+    unsigned int origin_width;
+    unsigned int origin_height;
+    J_COLOR_SPACE color_space;
+    int sub_sample;
+    int num_components;
+    boolean progressive;
+    int precision;
+    char* err;
+} jpeg_decode_config_result;
+
+typedef struct jpeg_decode_yuv_result {
+    char* err;
+} jpeg_decode_yuv_result;
+
+// 一个APPn或者COM段，data不包括marker和长度
+typedef struct jpeg_marker {
+    int marker;
+    unsigned int data_length;
+    unsigned char* data;
+} jpeg_marker;
+
 typedef struct jpeg_encode_options {
     int quality;
     int tj_flag;
     int sub_sample;
+    // 写在JFIF或者Adobe后面的ICC profile和其他段，只有jpeg_encoder支持
+    unsigned char* icc_profile;
+    unsigned int icc_profile_size;
+    jpeg_marker* markers;
+    int num_markers;
+    // 不为NULL时，编码过程中*cancel不为0就中止编码，只有jpeg_encoder支持
+    int* cancel;
 } jpeg_encode_options;
 
+typedef struct jpeg_transform_options {
+    int op;
+    int options;
+    // 剪裁区域是变换后图片的坐标，left和top需要是MCU的整数倍
+    struct crop_rect crop;
+} jpeg_transform_options;
+
+typedef struct jpeg_transform_result {
+    unsigned char* img;
+    unsigned long img_size;
+    char* err;
+} jpeg_transform_result;
+
+typedef struct jpeg_metadata_result {
+    // 按照在文件中的顺序保存的APPn和COM段，需要用jpeg_metadata_free释放
+    jpeg_marker* markers;
+    int num_markers;
+    boolean saw_JFIF_marker;
+    unsigned char JFIF_major_version;
+    unsigned char JFIF_minor_version;
+    unsigned char density_unit;
+    unsigned int X_density;
+    unsigned int Y_density;
+    boolean saw_Adobe_marker;
+    unsigned char Adobe_transform;
+    // 多个APP2拼起来的ICC profile
+    unsigned char* icc_profile;
+    unsigned int icc_profile_size;
+    char* err;
+} jpeg_metadata_result;
+
+// 往Go的io.Writer写数据的destination manager，writer是cgo.Handle
+typedef struct jpeg_writer_destination_mgr {
+    struct jpeg_destination_mgr pub;
+    uintptr_t writer;
+    JOCTET* buffer;
+    unsigned int buffer_size;
+} jpeg_writer_destination_mgr;
+
+// 逐行编码的编码器，需要在多次调用之间保存编码的状态，所以放在堆上
+typedef struct jpeg_encoder {
+    struct jpeg_compress_struct cinfo;
+    my_jpeg_err_mgr jerr;
+    boolean created;
+    // CMYK需要每行先反转到row_buffer
+    JSAMPROW row_buffer;
+    jpeg_cancel_progress_mgr progress;
+} jpeg_encoder;
+
 typedef struct jpeg_encode_result {
     unsigned char* img;
     unsigned long img_size;
@@ -65,13 +211,139 @@ static void jpeg_err_output_msg(j_common_ptr cinfo);
 // 覆盖原来的error_exit方法，因为原来的错误会调用exit函数导致进程退出。
 static void jpeg_err_exit(j_common_ptr cinfo);
 
-// 解码jpeg图片
-void jpeg_decode(unsigned char* img, unsigned int img_size, jpeg_decode_options* options, jpeg_decode_result* jres);
+// cancel不为NULL时设置检查是否取消的progress monitor，否则去掉progress monitor
+static void jpeg_set_cancel(j_common_ptr cinfo, jpeg_cancel_progress_mgr* progress, int* cancel);
+
+// 取消编解码，Go在context取消时调用，可以和编解码并发
+void jpeg_cancel(int* cancel);
+
+// Go导出的函数，从reader读取最多size字节到buf，返回读到的字节数，0表示EOF，-1表示出错
+extern int goJpegReaderRead(uintptr_t reader, unsigned char* buf, int size);
+
+// 设置从Go的io.Reader读取数据的source manager
+void jpeg_reader_src(j_decompress_ptr dinfo, uintptr_t reader, unsigned int buffer_size);
+
+// 解码jpeg图片，decompressor是复用的解码器，为NULL时临时创建一个
+void jpeg_decode(jpeg_decoder* decompressor, unsigned char* img, unsigned int img_size, jpeg_decode_options* options,
+    jpeg_decode_result* jres);
+
+// 解码jpeg图片到调用方的dst里，dst不够大时只在jres->img_size返回需要的大小
+void jpeg_decode_into(jpeg_decoder* decompressor, unsigned char* img, unsigned int img_size,
+    jpeg_decode_options* options, unsigned char* dst, size_t dst_size, jpeg_decode_result* jres);
+
+// 只读取header，计算解码后的宽高等信息和像素需要的字节数
+void jpeg_decode_output_size(jpeg_decoder* decompressor, unsigned char* img, unsigned int img_size,
+    jpeg_decode_options* options, jpeg_decode_result* jres);
+
+// 流式解码jpeg图片，数据从Go的io.Reader中分块读取，buffer_size是每次读取的大小
+void jpeg_decode_reader(uintptr_t reader, unsigned int buffer_size, jpeg_decode_options* options,
+    jpeg_decode_result* jres);
+
+// 内存不够时设置jres->err，否则调用方会把没有解码的buffer当成结果
+static void jpeg_decode_oom(jpeg_decode_result* jres);
+
+// 解码jpeg图片，数据来源是内存或者Go的io.Reader
+static void jpeg_decode_src(jpeg_decoder* decompressor, jpeg_decode_source* source, jpeg_decode_options* options,
+    unsigned char* dst, size_t dst_size, jpeg_decode_result* jres);
+
+// 创建逐行解码的解码器，数据从Go的io.Reader中分块读取，输出的宽高等信息写到jres里。失败时返回NULL
+jpeg_decoder* jpeg_decoder_create(uintptr_t reader, unsigned int buffer_size, jpeg_decode_options* options,
+    jpeg_decode_result* jres);
+
+// 创建可以复用的解码器，只能解码内存里的图片，失败时返回NULL
+jpeg_decoder* jpeg_decoder_alloc();
+
+// 用完解码器，可以复用的重置状态，否则释放
+static void jpeg_decoder_release(jpeg_decoder* decoder);
+
+// 创建或者复用解码器并开始解码，失败时返回NULL，错误信息写到jres->err
+static jpeg_decoder* jpeg_decoder_new(jpeg_decoder* decompressor, jpeg_decode_source* source,
+    jpeg_decode_options* options, boolean header_only, jpeg_decode_result* jres);
+
+// 读取header，设置解码参数并计算输出的尺寸，不开始解码，失败返回FALSE
+static boolean jpeg_decoder_setup(jpeg_decoder* decoder, jpeg_decode_source* source, jpeg_decode_options* options);
+
+// 读取header，设置解码参数并开始解码，失败返回FALSE
+static boolean jpeg_decoder_start(jpeg_decoder* decoder, jpeg_decode_source* source, jpeg_decode_options* options);
+
+// 把quantize_colors生成的颜色表复制到jres->colormap，失败返回FALSE
+static boolean jpeg_copy_colormap(j_decompress_ptr dinfo, jpeg_decode_result* jres);
+
+// 读取最多num_rows行到dst，每行间隔stride字节，返回实际读到的行数，全部读完返回0，出错返回-1
+int jpeg_decoder_read(jpeg_decoder* decoder, unsigned char* dst, size_t stride, unsigned int num_rows);
+
+// 释放解码器
+void jpeg_decoder_destroy(jpeg_decoder* decoder);
+
+// 从保存的APP1 marker中解析EXIF的Orientation，没有或者不合法时返回1
+static int jpeg_get_orientation(j_decompress_ptr dinfo);
+
+// 把旋转后图片的剪裁区域映射回原图的坐标，width和height是原图的宽高。剪裁区域超出图片时返回FALSE
+static boolean jpeg_orient_crop(int orientation, unsigned int width, unsigned int height, crop_rect* crop);
+
+// 按照EXIF的Orientation旋转像素，src是width*height的原图，dst的宽高在orientation>=5时交换
+static void jpeg_orient_pixels(int orientation, unsigned char* src, unsigned char* dst, unsigned int width,
+    unsigned int height, int components);
+
+// 读取jpeg图片header里所有的APPn和COM段，以及JFIF、Adobe和ICC profile的信息，不解码像素
+void jpeg_read_metadata(unsigned char* img, unsigned int img_size, jpeg_metadata_result* jres);
+
+// 释放jpeg_read_metadata分配的内存，err需要自己释放
+void jpeg_metadata_free(jpeg_metadata_result* jres);
+
+// 只读取jpeg图片的header，不解码像素
+void jpeg_decode_config(unsigned char* img, unsigned int img_size, jpeg_decode_config_result* jres);
+
+// 解码jpeg图片成YUV平面，各个平面需要按照tjPlaneWidth和tjPlaneHeight事先分配好，灰度图只有y_plane
+void jpeg_decode_yuv(unsigned char* img, unsigned int img_size, unsigned char* y_plane, unsigned char* cb_plane,
+    unsigned char* cr_plane, jpeg_decode_yuv_result* jres);
+
+// 编码jpeg图片，dst不为NULL时直接编码到dst里，dst至少要有tjBufSize那么大，dst为NULL时由turbojpeg分配。
+// compressor为NULL时临时创建一个handle
+jpeg_encode_result jpeg_encode_into(tjhandle compressor, unsigned char* img, int width, int height, int pixel_format,
+    int quality, int tj_flag, int sub_sample, unsigned char* dst, unsigned long dst_size);
+
+// 无损变换jpeg图片，结果需要用tjFree释放
+void jpeg_transform(unsigned char* img, unsigned long img_size, jpeg_transform_options* options,
+    jpeg_transform_result* jres);
+
+// Go导出的函数，把buf中size字节写到writer，成功返回0，出错返回-1
+extern int goJpegWriterWrite(uintptr_t writer, unsigned char* buf, int size);
+
+// 设置往Go的io.Writer写数据的destination manager
+void jpeg_writer_dest(j_compress_ptr cinfo, uintptr_t writer, unsigned int buffer_size);
+
+// 创建逐行编码的编码器，编码结果写到Go的io.Writer。失败时返回NULL，错误信息写到jres->err
+jpeg_encoder* jpeg_encoder_create(uintptr_t writer, unsigned int buffer_size, int width, int height, int pixel_format,
+    jpeg_encode_options* options, jpeg_encode_result* jres);
+
+// 设置编码参数并开始编码，失败返回FALSE
+static boolean jpeg_encoder_start(jpeg_encoder* encoder, int width, int height, int pixel_format,
+    jpeg_encode_options* options);
+
+// 写入最多num_rows行，每行间隔stride字节，返回实际写入的行数，出错返回-1
+int jpeg_encoder_write(jpeg_encoder* encoder, unsigned char* src, size_t stride, unsigned int num_rows);
+
+// 结束编码，成功返回0，出错返回-1
+int jpeg_encoder_finish(jpeg_encoder* encoder);
+
+// 释放编码器
+void jpeg_encoder_destroy(jpeg_encoder* encoder);
+
+// 转换CMYK像素，统一成0代表无墨的CMYK，或者转换成out_color_space指定的RGB格式。src和dst可以是同一块内存。
+static void jpeg_convert_cmyk(JSAMPROW src, JSAMPROW dst, size_t pixels, boolean inverted, J_COLOR_SPACE out_color_space);
+
+// 获取RGB格式中各个分量的偏移和每个像素的字节数，不是RGB格式时返回FALSE
+static boolean jpeg_rgb_layout(J_COLOR_SPACE color_space, int* red, int* green, int* blue, int* pixel_size);
+
+// 根据各个颜色分量的采样因子推算出TJSAMP，无法识别返回-1
+static int jpeg_get_sub_sample(j_decompress_ptr dinfo);
 
-// 编码jpeg图片
-void jpeg_encode(unsigned char* img, int width, int height, int pixel_format, jpeg_encode_options* options,
-    jpeg_encode_result *jres);
+// 把YUV平面编码成jpeg图片，灰度图只需要y_plane
+void jpeg_encode_yuv(unsigned char* y_plane, unsigned char* cb_plane, unsigned char* cr_plane, int y_stride,
+    int c_stride, int width, int height, int sub_sample, jpeg_encode_options* options, jpeg_encode_result* jres);
 
+// 从libjpeg-turbo支持的缩放比例中找出缩小后宽高都不小于期望值的最小比例
 static void jpeg_find_denom(unsigned int width, unsigned int height, unsigned int expect_width,
     unsigned int expect_height, unsigned int *scale_num, unsigned int *scale_denom);
 
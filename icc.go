@@ -0,0 +1,258 @@
+package gojpegturbo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	// ErrICCProfileUnsupported ICC profile不是RGB的matrix/TRC profile，内置的实现转换不了
+	ErrICCProfileUnsupported = errors.New("icc profile unsupported")
+)
+
+// srgbFromXYZ 把D50的XYZ转换到线性的sRGB，是sRGB经过Bradford适配到D50之后的矩阵的逆矩阵，和ICC的PCS一致
+var srgbFromXYZ = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbLinearSize 线性sRGB编码查找表的大小，精度足够8bit输出
+const srgbLinearSize = 4096
+
+// srgbTransform 把matrix/TRC profile的RGB转换到sRGB的查找表
+type srgbTransform struct {
+	toLinear [3][256]float32           // 各个通道按照TRC解码成线性值
+	matrix   [3][3]float32             // 线性的RGB转换到线性的sRGB
+	encode   [srgbLinearSize + 1]uint8 // 线性的sRGB编码成8bit
+}
+
+// newSRGBTransform 根据ICC profile创建转换到sRGB的查找表。profile本身就是sRGB（转换前后误差不超过1）时返回nil。
+func newSRGBTransform(profile []byte) (*srgbTransform, error) {
+	toXYZ, trc, err := parseICCProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	t := &srgbTransform{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			var v float64
+			for k := 0; k < 3; k++ {
+				v += srgbFromXYZ[i][k] * toXYZ[k][j]
+			}
+			t.matrix[i][j] = float32(v)
+		}
+		for v := 0; v < 256; v++ {
+			t.toLinear[i][v] = float32(trc[i](float64(v) / 255))
+		}
+	}
+	for i := range t.encode {
+		t.encode[i] = uint8(math.Round(srgbEncode(float64(i)/srgbLinearSize) * 255))
+	}
+	// 检查一下所有的灰阶和纯色，都不变的话就是sRGB，不需要转换
+	for v := 0; v < 256; v++ {
+		for _, pixel := range [][3]uint8{{uint8(v), uint8(v), uint8(v)}, {uint8(v), 0, 0}, {0, uint8(v), 0},
+			{0, 0, uint8(v)}} {
+			r, g, b := t.convertPixel(pixel[0], pixel[1], pixel[2])
+			if absDiffUint8(r, pixel[0]) > 1 || absDiffUint8(g, pixel[1]) > 1 || absDiffUint8(b, pixel[2]) > 1 {
+				return t, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// newSRGBTransformFor 输出是pixelFormat时，根据ICC profile创建转换到sRGB的查找表，不需要转换或者转换不了时返回nil
+func newSRGBTransformFor(profile []byte, pixelFormat TJPixelFormat) *srgbTransform {
+	if len(profile) == 0 || pixelRedOffset[pixelFormat] < 0 {
+		return nil
+	}
+	t, err := newSRGBTransform(profile)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// convert 转换pix中的所有像素，pixelFormat必须是RGB类的格式
+func (t *srgbTransform) convert(pix []byte, pixelFormat TJPixelFormat) {
+	size := pixelSize[pixelFormat]
+	red, green, blue := pixelRedOffset[pixelFormat], pixelGreenOffset[pixelFormat], pixelBlueOffset[pixelFormat]
+	for i := 0; i+size <= len(pix); i += size {
+		pix[i+red], pix[i+green], pix[i+blue] = t.convertPixel(pix[i+red], pix[i+green], pix[i+blue])
+	}
+}
+
+// convertPixel 转换一个像素，超出sRGB色域的部分直接截断
+func (t *srgbTransform) convertPixel(r, g, b uint8) (uint8, uint8, uint8) {
+	lr, lg, lb := t.toLinear[0][r], t.toLinear[1][g], t.toLinear[2][b]
+	return t.encodeLinear(t.matrix[0][0]*lr + t.matrix[0][1]*lg + t.matrix[0][2]*lb),
+		t.encodeLinear(t.matrix[1][0]*lr + t.matrix[1][1]*lg + t.matrix[1][2]*lb),
+		t.encodeLinear(t.matrix[2][0]*lr + t.matrix[2][1]*lg + t.matrix[2][2]*lb)
+}
+
+// encodeLinear 把线性的sRGB值编码成8bit
+func (t *srgbTransform) encodeLinear(v float32) uint8 {
+	switch {
+	case v <= 0 || v != v: // NaN也当作0
+		return 0
+	case v >= 1:
+		return 255
+	}
+	return t.encode[int(v*srgbLinearSize+0.5)]
+}
+
+// srgbEncode sRGB的传递函数，把线性值编码成非线性值
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func absDiffUint8(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// parseICCProfile 解析RGB的matrix/TRC profile，返回RGB到D50的XYZ的矩阵和各个通道的TRC
+func parseICCProfile(profile []byte) ([3][3]float64, [3]func(float64) float64, error) {
+	var toXYZ [3][3]float64
+	var trc [3]func(float64) float64
+	// header是128字节，后面是tag的数量和tag表
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return toXYZ, trc, ErrICCProfileUnsupported
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+i*12+12 <= len(profile); i++ {
+		entry := profile[132+i*12:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			continue
+		}
+		tags[string(entry[:4])] = profile[offset : offset+size]
+	}
+	for i, name := range []string{"r", "g", "b"} {
+		// XYZType：'XYZ '、4字节保留、3个s15Fixed16
+		xyz := tags[name+"XYZ"]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return toXYZ, trc, ErrICCProfileUnsupported
+		}
+		for j := 0; j < 3; j++ {
+			toXYZ[j][i] = s15Fixed16(xyz[8+j*4:])
+			if !isFinite(toXYZ[j][i]) {
+				return toXYZ, trc, ErrICCProfileUnsupported
+			}
+		}
+		curve, err := parseICCCurve(tags[name+"TRC"])
+		if err != nil {
+			return toXYZ, trc, err
+		}
+		trc[i] = curve
+	}
+	return toXYZ, trc, nil
+}
+
+// parseICCCurve 解析curveType或者parametricCurveType。曲线在8bit的各个输入上都要是非负的有限值，负的gamma之类的参数会在0处
+// 得到Inf，矩阵运算之后变成NaN。
+func parseICCCurve(data []byte) (func(float64) float64, error) {
+	curve, err := parseICCCurveFunc(data)
+	if err != nil {
+		return nil, err
+	}
+	for v := 0; v < 256; v++ {
+		if y := curve(float64(v) / 255); !isFinite(y) || y < 0 {
+			return nil, ErrICCProfileUnsupported
+		}
+	}
+	return curve, nil
+}
+
+// parseICCCurveFunc 把curveType或者parametricCurveType转成函数，不检查结果
+func parseICCCurveFunc(data []byte) (func(float64) float64, error) {
+	if len(data) < 12 {
+		return nil, ErrICCProfileUnsupported
+	}
+	switch string(data[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(data[8:]))
+		switch {
+		case count == 0:
+			return func(v float64) float64 { return v }, nil
+		case count == 1 && len(data) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		case count > 1 && len(data) >= 12+count*2:
+			table := make([]float64, count)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(data[12+i*2:])) / 65535
+			}
+			// 表中的点在0到1之间均匀分布，中间线性插值
+			return func(v float64) float64 {
+				pos := v * float64(count-1)
+				i := int(pos)
+				if i >= count-1 {
+					return table[count-1]
+				}
+				return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+			}, nil
+		}
+	case "para":
+		// 参数的个数由函数类型决定，都是s15Fixed16
+		paramCounts := []int{1, 3, 4, 5, 7}
+		typ := int(binary.BigEndian.Uint16(data[8:]))
+		if typ >= len(paramCounts) || len(data) < 12+paramCounts[typ]*4 {
+			break
+		}
+		p := make([]float64, 7)
+		for i := 0; i < paramCounts[typ]; i++ {
+			p[i] = s15Fixed16(data[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch typ {
+		case 0:
+			return func(v float64) float64 { return math.Pow(v, g) }, nil
+		case 1:
+			return func(v float64) float64 { return paraPow(a*v+b, g, v >= -b/a) }, nil
+		case 2:
+			return func(v float64) float64 { return paraPow(a*v+b, g, v >= -b/a) + c }, nil
+		case 3:
+			return func(v float64) float64 {
+				if v >= d {
+					return math.Pow(a*v+b, g)
+				}
+				return c * v
+			}, nil
+		case 4:
+			return func(v float64) float64 {
+				if v >= d {
+					return math.Pow(a*v+b, g) + e
+				}
+				return c*v + f
+			}, nil
+		}
+	}
+	return nil, ErrICCProfileUnsupported
+}
+
+// isFinite 不是NaN也不是Inf
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// paraPow 参数曲线的幂函数部分，不满足条件时是0
+func paraPow(v, g float64, ok bool) float64 {
+	if !ok || v <= 0 {
+		return 0
+	}
+	return math.Pow(v, g)
+}
+
+// s15Fixed16 ICC的定点数，16位整数部分和16位小数部分
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
@@ -0,0 +1,276 @@
+package gojpegturbo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 各个profile的rXYZ、gXYZ、bXYZ（D50）
+var (
+	displayP3Primaries = [3][3]float64{{0.5151, 0.2412, -0.0011}, {0.2920, 0.6922, 0.0419}, {0.1571, 0.0666, 0.7841}}
+	adobeRGBPrimaries  = [3][3]float64{{0.6097, 0.3111, 0.0195}, {0.2053, 0.6257, 0.0609}, {0.1492, 0.0632, 0.7446}}
+	srgbPrimaries      = [3][3]float64{{0.4361, 0.2225, 0.0139}, {0.3851, 0.7169, 0.0971}, {0.1431, 0.0606, 0.7141}}
+)
+
+// sRGB的TRC，parametricCurveType的类型3
+var srgbTRC = paraCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+
+func s15Fixed16Bytes(v float64) []byte {
+	return appendUint32(nil, uint32(int32(math.Round(v*65536))))
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	return append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func paraCurve(typ uint16, params ...float64) []byte {
+	data := append([]byte("para"), 0, 0, 0, 0, byte(typ>>8), byte(typ), 0, 0)
+	for _, p := range params {
+		data = append(data, s15Fixed16Bytes(p)...)
+	}
+	return data
+}
+
+func gammaCurve(gamma float64) []byte {
+	v := uint16(math.Round(gamma * 256))
+	return []byte{'c', 'u', 'r', 'v', 0, 0, 0, 0, 0, 0, 0, 1, byte(v >> 8), byte(v)}
+}
+
+// buildICCProfile 构造RGB的matrix/TRC profile，三个通道共用一个TRC
+func buildICCProfile(colorSpace string, primaries [3][3]float64, trc []byte) []byte {
+	profile := make([]byte, 128)
+	copy(profile[12:], "mntr")
+	copy(profile[16:], colorSpace)
+	copy(profile[20:], "XYZ ")
+	copy(profile[36:], "acsp")
+	names := []string{"rXYZ", "gXYZ", "bXYZ"}
+	profile = appendUint32(profile, uint32(len(names)+3))
+	offset := 128 + 4 + (len(names)+3)*12
+	for _, name := range names {
+		profile = append(profile, name...)
+		profile = appendUint32(profile, uint32(offset))
+		profile = appendUint32(profile, 20)
+		offset += 20
+	}
+	for _, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		profile = append(profile, name...)
+		profile = appendUint32(profile, uint32(offset))
+		profile = appendUint32(profile, uint32(len(trc)))
+	}
+	for _, xyz := range primaries {
+		profile = append(profile, "XYZ \x00\x00\x00\x00"...)
+		for _, v := range xyz {
+			profile = append(profile, s15Fixed16Bytes(v)...)
+		}
+	}
+	profile = append(profile, trc...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// withICCProfile 给图片加上一个ICC profile，分成两个APP2
+func withICCProfile(img, profile []byte) []byte {
+	half := len(profile) / 2
+	return withMarkers(img, iccMarker(1, 2, profile[:half]), iccMarker(2, 2, profile[half:]))
+}
+
+// wantSRGB 用D65下线性RGB到线性sRGB的矩阵计算期望的颜色
+func wantSRGB(matrix [3][3]float64, decodeGamma func(float64) float64, r, g, b uint8) [3]uint8 {
+	linear := [3]float64{decodeGamma(float64(r) / 255), decodeGamma(float64(g) / 255), decodeGamma(float64(b) / 255)}
+	var out [3]uint8
+	for i := range out {
+		v := matrix[i][0]*linear[0] + matrix[i][1]*linear[1] + matrix[i][2]*linear[2]
+		out[i] = uint8(math.Round(srgbEncode(math.Min(math.Max(v, 0), 1)) * 255))
+	}
+	return out
+}
+
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func TestDecodeConvertToSRGB(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	original, err := Decode(buf, NewDecodeOptions())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		profile []byte
+		matrix  [3][3]float64         // D65下线性RGB到线性sRGB的矩阵
+		gamma   func(float64) float64 // 为nil的时候不转换
+	}{
+		{
+			name:    "display p3",
+			profile: buildICCProfile("RGB ", displayP3Primaries, srgbTRC),
+			matrix:  [3][3]float64{{1.2249, -0.2247, 0}, {-0.0420, 1.0419, 0}, {-0.0197, -0.0786, 1.0979}},
+			gamma:   srgbDecode,
+		},
+		{
+			name:    "adobe rgb",
+			profile: buildICCProfile("RGB ", adobeRGBPrimaries, gammaCurve(563.0/256)),
+			matrix:  [3][3]float64{{1.3982, -0.3982, 0}, {0, 1, 0}, {0, -0.0429, 1.0429}},
+			gamma:   func(v float64) float64 { return math.Pow(v, 563.0/256) },
+		},
+		{
+			name:    "srgb",
+			profile: buildICCProfile("RGB ", srgbPrimaries, srgbTRC),
+		},
+		{
+			name:    "cmyk profile",
+			profile: buildICCProfile("CMYK", displayP3Primaries, srgbTRC),
+		},
+		{
+			name:    "truncated profile",
+			profile: buildICCProfile("RGB ", displayP3Primaries, srgbTRC)[:200],
+		},
+		{
+			name: "no profile",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := buf
+			if tt.profile != nil {
+				img = withICCProfile(buf, tt.profile)
+			}
+			options := NewDecodeOptions()
+			options.ConvertToSRGB = true
+			got, err := Decode(img, options)
+			require.NoError(t, err)
+			if tt.gamma == nil {
+				assert.False(t, got.ConvertedToSRGB)
+				assert.Equal(t, original.Img, got.Img)
+				return
+			}
+			require.True(t, got.ConvertedToSRGB)
+			require.Len(t, got.Img, len(original.Img))
+			for i := 0; i < len(got.Img); i += 3 * 97 {
+				want := wantSRGB(tt.matrix, tt.gamma, original.Img[i], original.Img[i+1], original.Img[i+2])
+				for j := 0; j < 3; j++ {
+					assert.InDelta(t, want[j], got.Img[i+j], 2, "pixel %d", i/3)
+				}
+			}
+
+			// 流式解码和逐行解码的结果应该一样
+			fromReader, err := DecodeReader(bytes.NewReader(img), options)
+			require.NoError(t, err)
+			assert.True(t, fromReader.ConvertedToSRGB)
+			assert.Equal(t, got.Img, fromReader.Img)
+			decoder, err := NewDecoder(bytes.NewReader(img), options)
+			require.NoError(t, err)
+			defer decoder.Close()
+			assert.True(t, decoder.ConvertedToSRGB)
+			var rows []byte
+			for {
+				row, err := decoder.Next()
+				if err != nil {
+					break
+				}
+				rows = append(rows, row...)
+			}
+			assert.Equal(t, got.Img, rows)
+
+			// 其他RGB类的像素格式也要转换
+			options.OutputPixelFormat = TJPixelFormatBGRA.Ptr()
+			bgra, err := Decode(img, options)
+			require.NoError(t, err)
+			assert.True(t, bgra.ConvertedToSRGB)
+			assert.Equal(t, got.Img[:3], []byte{bgra.Img[2], bgra.Img[1], bgra.Img[0]})
+			assert.Equal(t, uint8(0xff), bgra.Img[3])
+
+			// 灰度输出不转换
+			options.OutputPixelFormat = TJPixelFormatGray.Ptr()
+			gray, err := Decode(img, options)
+			require.NoError(t, err)
+			assert.False(t, gray.ConvertedToSRGB)
+		})
+	}
+}
+
+func TestSRGBTransform(t *testing.T) {
+	// Display P3和sRGB的白点、TRC一样，灰色转换后还是灰色
+	transform, err := newSRGBTransform(buildICCProfile("RGB ", displayP3Primaries, srgbTRC))
+	require.NoError(t, err)
+	require.NotNil(t, transform)
+	for v := 0; v < 256; v++ {
+		r, g, b := transform.convertPixel(uint8(v), uint8(v), uint8(v))
+		assert.InDelta(t, v, r, 1)
+		assert.InDelta(t, v, g, 1)
+		assert.InDelta(t, v, b, 1)
+	}
+	// P3的纯红在sRGB色域外，截断到255
+	r, g, b := transform.convertPixel(255, 0, 0)
+	assert.Equal(t, [3]uint8{255, 0, 0}, [3]uint8{r, g, b})
+
+	// 各种TRC
+	curves := []struct {
+		name string
+		trc  []byte
+		want func(float64) float64
+	}{
+		{name: "identity", trc: []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), want: func(v float64) float64 { return v }},
+		{name: "gamma", trc: gammaCurve(1.8), want: func(v float64) float64 { return math.Pow(v, 1.8) }},
+		{
+			name: "table",
+			trc:  []byte("curv\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x40\x00\xff\xff"),
+			want: func(v float64) float64 {
+				if v < 0.5 {
+					return v * 0.5
+				}
+				return 0.25 + (v-0.5)*(1-0.25)/0.5
+			},
+		},
+		{name: "para0", trc: paraCurve(0, 2.2), want: func(v float64) float64 { return math.Pow(v, 2.2) }},
+		{name: "para3", trc: srgbTRC, want: srgbDecode},
+		{
+			name: "para4",
+			trc:  paraCurve(4, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045, 0.01, 0.01),
+			want: func(v float64) float64 { return srgbDecode(v) + 0.01 },
+		},
+	}
+	for _, tt := range curves {
+		t.Run(tt.name, func(t *testing.T) {
+			curve, err := parseICCCurve(tt.trc)
+			require.NoError(t, err)
+			for v := 0.0; v <= 1; v += 0.125 {
+				assert.InDelta(t, tt.want(v), curve(v), 0.001, "v = %f", v)
+			}
+		})
+	}
+
+	_, err = parseICCCurve([]byte("mAB \x00\x00\x00\x00\x00\x00\x00\x00"))
+	assert.Equal(t, ErrICCProfileUnsupported, err)
+	_, err = newSRGBTransform(buildICCProfile("GRAY", displayP3Primaries, srgbTRC))
+	assert.Equal(t, ErrICCProfileUnsupported, err)
+
+	// 负的gamma在0处是Inf，各个分量正负混合的矩阵算出来是NaN
+	mixedPrimaries := [3][3]float64{{0.5, -0.2, 0.1}, {-0.3, 0.7, 0.1}, {0.2, 0.1, -0.6}}
+	for _, trc := range [][]byte{paraCurve(0, -2.2), paraCurve(3, -1, 1, 0, 0, 0), paraCurve(4, 2.2, 1, 0, 1, 0.5, 0, -0.1)} {
+		_, err = parseICCCurve(trc)
+		assert.Equal(t, ErrICCProfileUnsupported, err)
+		_, err = newSRGBTransform(buildICCProfile("RGB ", mixedPrimaries, trc))
+		assert.Equal(t, ErrICCProfileUnsupported, err)
+	}
+	assert.Equal(t, uint8(0), transform.encodeLinear(float32(math.NaN())))
+	assert.Equal(t, uint8(255), transform.encodeLinear(float32(math.Inf(1))))
+	assert.Equal(t, uint8(0), transform.encodeLinear(float32(math.Inf(-1))))
+
+	// 带着这样的profile解码也不会panic，只是不转换
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(withICCProfile(buf, buildICCProfile("RGB ", mixedPrimaries, paraCurve(0, -2.2))),
+		&DecodeOptions{ConvertToSRGB: true})
+	require.NoError(t, err)
+	assert.False(t, img.ConvertedToSRGB)
+}
@@ -14,14 +14,18 @@ type ImageAttr struct {
 	Img                       []byte
 	ImageWidth, ImageHeight   int        // 输出的图片宽高，若没有剪裁，和Origin的宽高一样
 	OriginWidth, OriginHeight int        // 原始图片宽高
-	ColorSpace                ColorSpace // 色彩空间。目前只有gray和YCbCr。
+	ColorSpace                ColorSpace // 色彩空间。默认是JPEG的gray、YCbCr或CMYK，指定了输出格式时为对应的色彩空间。
 	ComponentsNum             int        // 颜色分量数，如YCbCr就是3。
+	ConvertedToSRGB           bool       // 是否按照ICC profile把像素转换到了sRGB，见DecodeOptions的ConvertToSRGB
 }
 
 // ColorModel 色彩空间
 func (img *ImageAttr) ColorModel() color.Model {
-	if img.ColorSpace == ColorSpaceGrayScale {
+	switch img.ColorSpace {
+	case ColorSpaceGrayScale:
 		return color.GrayModel
+	case ColorSpaceCMYK:
+		return color.CMYKModel
 	}
 	return color.RGBAModel
 }
@@ -39,34 +43,112 @@ func (img *ImageAttr) Bounds() image.Rectangle {
 // At 获取指定像素点的RBG颜色
 func (img *ImageAttr) At(x, y int) color.Color {
 	offset := (x + y*img.ImageWidth) * img.ComponentsNum
-	if img.ColorSpace == ColorSpaceGrayScale {
+	switch img.ColorSpace {
+	case ColorSpaceGrayScale:
 		return &color.Gray{Y: img.Img[offset]}
+	case ColorSpaceCMYK:
+		return &color.CMYK{
+			C: img.Img[offset],
+			M: img.Img[offset+1],
+			Y: img.Img[offset+2],
+			K: img.Img[offset+3],
+		}
 	}
+	pixelFormat := img.PixelFormat()
 	return &color.RGBA{
-		R: img.Img[offset],
-		G: img.Img[offset+1],
-		B: img.Img[offset+2],
+		R: img.Img[offset+pixelRedOffset[pixelFormat]],
+		G: img.Img[offset+pixelGreenOffset[pixelFormat]],
+		B: img.Img[offset+pixelBlueOffset[pixelFormat]],
+		A: 0xff,
 	}
 }
 
-// PixelFormat 像素格式
+// PixelFormat 像素格式，和Img实际的像素排列一致
 func (img *ImageAttr) PixelFormat() TJPixelFormat {
-	if img.ColorSpace == ColorSpaceGrayScale {
+	switch img.ColorSpace {
+	case ColorSpaceGrayScale:
 		return TJPixelFormatGray
+	case ColorSpaceCMYK:
+		return TJPixelFormatCMYK
+	case ColorSpaceExtBGR:
+		return TJPixelFormatBGR
+	case ColorSpaceExtRGBX:
+		return TJPixelFormatRGBX
+	case ColorSpaceExtBGRX:
+		return TJPixelFormatBGRX
+	case ColorSpaceExtXBGR:
+		return TJPixelFormatXBGR
+	case ColorSpaceExtXRGB:
+		return TJPixelFormatXRGB
+	case ColorSpaceExtRGBA:
+		return TJPixelFormatRGBA
+	case ColorSpaceExtBGRA:
+		return TJPixelFormatBGRA
+	case ColorSpaceExtABGR:
+		return TJPixelFormatABGR
+	case ColorSpaceExtARGB:
+		return TJPixelFormatARGB
 	}
 	return TJPixelFormatRGB
 }
 
+// ToImage 转换成标准库的图片类型，灰度图为*image.Gray，CMYK图为*image.CMYK，RGBA和RGBX为*image.RGBA（这几种共用Img内存），
+// RGB图转换成*image.RGBA。其他格式直接返回自身。
+func (img *ImageAttr) ToImage() image.Image {
+	rect := img.Bounds()
+	switch img.PixelFormat() {
+	case TJPixelFormatGray:
+		return &image.Gray{
+			Pix:    img.Img,
+			Stride: img.ImageWidth,
+			Rect:   rect,
+		}
+	case TJPixelFormatCMYK:
+		return &image.CMYK{
+			Pix:    img.Img,
+			Stride: img.ImageWidth * 4,
+			Rect:   rect,
+		}
+	case TJPixelFormatRGBA, TJPixelFormatRGBX:
+		// libjpeg输出的A和X分量都是0xFF，可以直接当作不透明的RGBA
+		return &image.RGBA{
+			Pix:    img.Img,
+			Stride: img.ImageWidth * 4,
+			Rect:   rect,
+		}
+	case TJPixelFormatRGB:
+		dst := image.NewRGBA(rect)
+		for i, j := 0, 0; i < len(img.Img); i, j = i+3, j+4 {
+			dst.Pix[j] = img.Img[i]
+			dst.Pix[j+1] = img.Img[i+1]
+			dst.Pix[j+2] = img.Img[i+2]
+			dst.Pix[j+3] = 0xff
+		}
+		return dst
+	}
+	return img
+}
+
 // ResizeArea 用 INTER_AREA 方法缩小图片，这个方法不能用于图片放大。
 func (img *ImageAttr) ResizeArea(dstWidth, dstHeight int) (*ImageAttr, error) {
 	return ResizeArea(img, dstWidth, dstHeight)
 }
 
+// ResizeAreaInto 和ResizeArea一样，结果写到dst里，见ResizeAreaInto
+func (img *ImageAttr) ResizeAreaInto(dst *ImageAttr, dstWidth, dstHeight int) error {
+	return ResizeAreaInto(img, dst, dstWidth, dstHeight)
+}
+
 // ResizeNN 使用 NearestNeighbor 算法缩放图片，速度很快，但是会有锯齿。
 func (img *ImageAttr) ResizeNN(dstWidth, dstHeight int) *ImageAttr {
 	return ResizeNN(img, dstWidth, dstHeight)
 }
 
+// ResizeNNInto 和ResizeNN一样，结果写到dst里，见ResizeNNInto
+func (img *ImageAttr) ResizeNNInto(dst *ImageAttr, dstWidth, dstHeight int) error {
+	return ResizeNNInto(img, dst, dstWidth, dstHeight)
+}
+
 // ResizeBilinear 使用 Bilinear （双线插值）算法，速度次之，但是锯齿会少很多。
 func (img *ImageAttr) ResizeBilinear(dstWidth, dstHeight uint) image.Image {
 	return resize.Resize(dstWidth, dstHeight, img, resize.Bilinear)
@@ -52,6 +52,20 @@ func TestImageAttr(t *testing.T) {
 				pixelFormat: TJPixelFormatGray,
 			},
 		},
+		{
+			name:     "case 3-cmyk",
+			filename: "./testdata/cmyk.jpg",
+			want: want{
+				colorModel: color.CMYKModel,
+				bounds: image.Rectangle{
+					Max: image.Point{
+						X: 300,
+						Y: 400,
+					},
+				},
+				pixelFormat: TJPixelFormatCMYK,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -68,6 +82,62 @@ func TestImageAttr(t *testing.T) {
 	}
 }
 
+func TestImageAttr_ToImage(t *testing.T) {
+	tests := []struct {
+		name        string
+		filename    string
+		pixelFormat TJPixelFormat
+		wantType    image.Image
+	}{
+		{
+			name:        "case 1-YCbCr",
+			filename:    "./testdata/test.jpg",
+			pixelFormat: TJPixelFormatUnknown,
+			wantType:    &image.RGBA{},
+		},
+		{
+			name:        "case 2-gray",
+			filename:    "./testdata/gray.jpg",
+			pixelFormat: TJPixelFormatUnknown,
+			wantType:    &image.Gray{},
+		},
+		{
+			name:        "case 3-cmyk",
+			filename:    "./testdata/cmyk.jpg",
+			pixelFormat: TJPixelFormatUnknown,
+			wantType:    &image.CMYK{},
+		},
+		{
+			name:        "case 4-rgba",
+			filename:    "./testdata/test.jpg",
+			pixelFormat: TJPixelFormatRGBA,
+			wantType:    &image.RGBA{},
+		},
+		{
+			name:        "case 5-bgra",
+			filename:    "./testdata/test.jpg",
+			pixelFormat: TJPixelFormatBGRA,
+			wantType:    &ImageAttr{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := ioutil.ReadFile(tt.filename)
+			require.NoError(t, err)
+			options := NewDecodeOptions()
+			options.OutputPixelFormat = tt.pixelFormat.Ptr()
+			img, err := Decode(buf, options)
+			require.NoError(t, err)
+			got := img.ToImage()
+			assert.IsType(t, tt.wantType, got)
+			assert.Equal(t, img.Bounds(), got.Bounds())
+			r, g, b, _ := img.At(123, 234).RGBA()
+			gotR, gotG, gotB, gotA := got.At(123, 234).RGBA()
+			assert.Equal(t, []uint32{r, g, b, 0xffff}, []uint32{gotR, gotG, gotB, gotA})
+		})
+	}
+}
+
 func TestImageAttr_ResizeArea(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -120,6 +190,38 @@ func TestImageAttr_ResizeArea(t *testing.T) {
 	}
 }
 
+func TestImageAttr_ResizeAreaSolid(t *testing.T) {
+	tests := []struct {
+		name          string
+		componentsNum int
+		colorSpace    ColorSpace
+	}{
+		{name: "rgb", componentsNum: 3, colorSpace: ColorSpaceRGB},
+		{name: "gray", componentsNum: 1, colorSpace: ColorSpaceGrayScale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 纯色的图片缩小后还是纯色，包括最后一行
+			img := &ImageAttr{
+				Img:           make([]byte, 100*80*tt.componentsNum),
+				ImageWidth:    100,
+				ImageHeight:   80,
+				ColorSpace:    tt.colorSpace,
+				ComponentsNum: tt.componentsNum,
+			}
+			for i := range img.Img {
+				img.Img[i] = 200
+			}
+			got, err := img.ResizeArea(30, 7)
+			require.NoError(t, err)
+			require.Len(t, got.Img, 30*7*tt.componentsNum)
+			for i, v := range got.Img {
+				assert.InDelta(t, 200, v, 1, "index %d", i)
+			}
+		})
+	}
+}
+
 func TestImageAttr_ResizeNN(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -158,11 +260,72 @@ func TestImageAttr_ResizeNN(t *testing.T) {
 	}
 }
 
+func TestImageAttr_ResizeInto(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	rgb, err := Decode(buf, nil)
+	require.NoError(t, err)
+	grayBuf, err := ioutil.ReadFile("./testdata/gray.jpg")
+	require.NoError(t, err)
+	gray, err := Decode(grayBuf, nil)
+	require.NoError(t, err)
+	resizeArea := func(img *ImageAttr, w, h int) *ImageAttr {
+		got, err := img.ResizeArea(w, h)
+		require.NoError(t, err)
+		return got
+	}
+	tests := []struct {
+		name   string
+		img    *ImageAttr
+		want   func(img *ImageAttr, w, h int) *ImageAttr
+		resize func(img, dst *ImageAttr, w, h int) error
+	}{
+		{name: "area rgb", img: rgb, want: resizeArea, resize: ResizeAreaInto},
+		{name: "area gray", img: gray, want: resizeArea, resize: ResizeAreaInto},
+		{name: "nn rgb", img: rgb, want: ResizeNN, resize: ResizeNNInto},
+		{name: "nn gray", img: gray, want: ResizeNN, resize: ResizeNNInto},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 同一个dst按不同尺寸反复缩放，旧的像素不能影响结果
+			dst := &ImageAttr{Img: make([]byte, 500*500*3)}
+			for i := range dst.Img {
+				dst.Img[i] = 0xaa
+			}
+			for _, size := range [][2]int{{233, 455}, {500, 100}, {233, 455}, {1, 1}} {
+				require.NoError(t, tt.resize(tt.img, dst, size[0], size[1]))
+				assert.Equal(t, tt.want(tt.img, size[0], size[1]), dst)
+			}
+
+			small := &ImageAttr{Img: make([]byte, 10)}
+			assert.Equal(t, ErrBufferTooSmall, tt.resize(tt.img, small, 100, 100))
+			assert.Len(t, small.Img, 10)
+			assert.Equal(t, 0, small.ImageWidth)
+			assert.Equal(t, ErrWrongDstSize, tt.resize(tt.img, dst, 0, 100))
+		})
+	}
+	assert.Equal(t, ErrWrongDstSize, ResizeAreaInto(rgb, &ImageAttr{}, rgb.ImageWidth+1, 100))
+
+	// 纯色的图片缩小后还是纯色，包括最后一行
+	solid := &ImageAttr{Img: make([]byte, 100*80*3), ImageWidth: 100, ImageHeight: 80, ComponentsNum: 3}
+	for i := range solid.Img {
+		solid.Img[i] = 200
+	}
+	dst := &ImageAttr{Img: make([]byte, 30*7*3)}
+	require.NoError(t, solid.ResizeAreaInto(dst, 30, 7))
+	for i, v := range dst.Img {
+		assert.InDelta(t, 200, v, 1, "index %d", i)
+	}
+	require.NoError(t, solid.ResizeNNInto(dst, 30, 7))
+	assert.Equal(t, solid.Img[:len(dst.Img)], dst.Img)
+}
+
 func BenchmarkImageAttr_ResizeArea(b *testing.B) {
 	buf, err := ioutil.ReadFile("./testdata/test.jpg")
 	require.NoError(b, err)
 	img, err := Decode(buf, nil)
 	require.NoError(b, err)
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		_, err := img.ResizeArea(233, 455)
@@ -175,6 +338,7 @@ func BenchmarkImageAttr_ResizeNN(b *testing.B) {
 	require.NoError(b, err)
 	img, err := Decode(buf, nil)
 	require.NoError(b, err)
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		_ = img.ResizeNN(233, 455)
@@ -191,3 +355,31 @@ func BenchmarkImageAttr_ResizeBilinear(b *testing.B) {
 		_ = img.ResizeBilinear(233, 455)
 	}
 }
+
+func BenchmarkImageAttr_ResizeAreaInto(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	img, err := Decode(buf, nil)
+	require.NoError(b, err)
+	dst := &ImageAttr{Img: make([]byte, 233*455*img.ComponentsNum)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := img.ResizeAreaInto(dst, 233, 455)
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkImageAttr_ResizeNNInto(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	img, err := Decode(buf, nil)
+	require.NoError(b, err)
+	dst := &ImageAttr{Img: make([]byte, 233*455*img.ComponentsNum)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := img.ResizeNNInto(dst, 233, 455)
+		require.NoError(b, err)
+	}
+}
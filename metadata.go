@@ -0,0 +1,391 @@
+package gojpegturbo
+
+/*
+#cgo linux LDFLAGS: -lturbojpeg
+#cgo darwin LDFLAGS: -L/usr/local/opt/libjpeg-turbo/lib -lturbojpeg
+#cgo darwin CFLAGS: -I/usr/local/opt/libjpeg-turbo/include
+
+#include "goturbo.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// JPEG中保存元数据的标记，APPn是MarkerAPP0+n
+const (
+	// MarkerAPP0 JFIF
+	MarkerAPP0 = C.JPEG_APP0
+	// MarkerAPP1 EXIF和XMP
+	MarkerAPP1 = C.JPEG_APP0 + 1
+	// MarkerAPP2 ICC profile
+	MarkerAPP2 = C.JPEG_APP0 + 2
+	// MarkerAPP14 Adobe
+	MarkerAPP14 = C.JPEG_APP0 + 14
+	// MarkerCOM 注释
+	MarkerCOM = C.JPEG_COM
+)
+
+var (
+	// ErrMarkerInvalid 段的标记不是APPn或者COM，是编码器自己会写的JFIF或Adobe段，或者内容超过了一个段的最大长度
+	ErrMarkerInvalid = errors.New("marker invalid")
+)
+
+// maxMarkerDataLength 一个段的最大长度，长度字段本身占2个字节
+const maxMarkerDataLength = 65533
+
+// 各个段的开头，用来区分同一个APPn里不同的内容
+var (
+	// xmpHeader APP1里XMP的开头，后面是XMP packet
+	xmpHeader   = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccHeader   = []byte("ICC_PROFILE\x00")
+	jfifHeader  = []byte("JFIF\x00")
+	adobeHeader = []byte("Adobe")
+)
+
+// Marker JPEG中的一个APPn或者COM段
+type Marker struct {
+	Marker int    // 段的标记，如MarkerAPP1
+	Data   []byte // 段的内容，不包括标记和长度
+}
+
+// JFIF APP0中JFIF的信息
+type JFIF struct {
+	MajorVersion int // 主版本号，一般是1
+	MinorVersion int // 次版本号
+	DensityUnit  int // 像素密度的单位，0是没有单位（只表示宽高比），1是每英寸，2是每厘米
+	XDensity     int // 水平方向的像素密度
+	YDensity     int // 垂直方向的像素密度
+}
+
+// Adobe APP14中Adobe的信息
+type Adobe struct {
+	// Transform 颜色分量的变换，0是没有变换（RGB或者CMYK），1是YCbCr，2是YCCK
+	Transform int
+}
+
+// Metadata JPEG图片的元数据
+type Metadata struct {
+	Markers    []Marker // 所有的APPn和COM段，按照在文件中的顺序
+	JFIF       *JFIF    // 没有JFIF的时候是nil
+	Adobe      *Adobe   // 没有Adobe的时候是nil
+	ICCProfile []byte   // 多个APP2拼起来的ICC profile，没有或者不完整的时候是nil
+}
+
+// ReadMetadata 读取JPEG图片header里的元数据，不会解码像素
+func ReadMetadata(img []byte) (*Metadata, error) {
+	if len(img) == 0 {
+		return nil, ErrEmptyImage
+	}
+	jres := C.jpeg_metadata_result{}
+	C.jpeg_read_metadata((*C.uchar)(unsafe.Pointer(&img[0])), C.uint(uint(len(img))), &jres)
+	defer C.jpeg_metadata_free(&jres)
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return nil, fmt.Errorf("jpeg_read_metadata failed, err = %s", C.GoString(jres.err))
+	}
+	metadata := &Metadata{}
+	if jres.num_markers > 0 {
+		markers := unsafe.Slice(jres.markers, int(jres.num_markers))
+		metadata.Markers = make([]Marker, 0, len(markers))
+		for _, marker := range markers {
+			metadata.Markers = append(metadata.Markers, Marker{
+				Marker: int(marker.marker),
+				Data:   C.GoBytes(unsafe.Pointer(marker.data), C.int(int(marker.data_length))),
+			})
+		}
+	}
+	if jres.saw_JFIF_marker != 0 {
+		metadata.JFIF = &JFIF{
+			MajorVersion: int(jres.JFIF_major_version),
+			MinorVersion: int(jres.JFIF_minor_version),
+			DensityUnit:  int(jres.density_unit),
+			XDensity:     int(jres.X_density),
+			YDensity:     int(jres.Y_density),
+		}
+	}
+	if jres.saw_Adobe_marker != 0 {
+		metadata.Adobe = &Adobe{Transform: int(jres.Adobe_transform)}
+	}
+	if jres.icc_profile != nil {
+		metadata.ICCProfile = C.GoBytes(unsafe.Pointer(jres.icc_profile), C.int(int(jres.icc_profile_size)))
+	}
+	return metadata, nil
+}
+
+// EXIF 解析第一个EXIF段，没有EXIF的时候返回nil
+func (m *Metadata) EXIF() (*Exif, error) {
+	for _, marker := range m.Markers {
+		if marker.Marker == MarkerAPP1 && bytes.HasPrefix(marker.Data, exifHeader) {
+			return ParseExif(marker.Data[len(exifHeader):])
+		}
+	}
+	return nil, nil
+}
+
+// XMP 返回第一个XMP packet，没有XMP的时候返回nil。超过64KB的扩展XMP放在别的段里，不会被拼起来。
+func (m *Metadata) XMP() []byte {
+	for _, marker := range m.Markers {
+		if marker.Marker == MarkerAPP1 && bytes.HasPrefix(marker.Data, xmpHeader) {
+			return marker.Data[len(xmpHeader):]
+		}
+	}
+	return nil
+}
+
+// Comments 返回所有COM段的内容
+func (m *Metadata) Comments() []string {
+	var comments []string
+	for _, marker := range m.Markers {
+		if marker.Marker == MarkerCOM {
+			comments = append(comments, string(marker.Data))
+		}
+	}
+	return comments
+}
+
+// MetadataPolicy CopyMetadataFrom时要复制哪些元数据，可以组合使用
+type MetadataPolicy int
+
+const (
+	// MetadataICC 复制ICC profile
+	MetadataICC MetadataPolicy = 1 << iota
+	// MetadataEXIF 复制EXIF
+	MetadataEXIF
+	// MetadataXMP 复制XMP
+	MetadataXMP
+	// MetadataComments 复制COM段的注释
+	MetadataComments
+	// MetadataOther 复制其他的APPn段，JFIF和Adobe除外
+	MetadataOther
+	// MetadataResetOrientation 把复制的EXIF里的Orientation改成1，解码时用了AutoOrient的话需要加上
+	MetadataResetOrientation
+	// MetadataAll 复制所有的元数据
+	MetadataAll = MetadataICC | MetadataEXIF | MetadataXMP | MetadataComments | MetadataOther
+)
+
+// CopyMetadataFrom 从原图src中按policy复制元数据到options里，重新编码的时候写到新的图片。JFIF和Adobe由编码器自己写，不会复制。
+// 复制的元数据会追加到已有的Comments和Markers后面，原图有ICC profile、EXIF或者XMP的时候会覆盖options里的，EXIF和XMP只复制
+// 第一个。
+func (options *EncodeOptions) CopyMetadataFrom(src []byte, policy MetadataPolicy) error {
+	metadata, err := ReadMetadata(src)
+	if err != nil {
+		return err
+	}
+	if policy&MetadataICC != 0 && metadata.ICCProfile != nil {
+		options.ICCProfile = metadata.ICCProfile
+	}
+	copiedEXIF, copiedXMP := false, false
+	for _, marker := range metadata.Markers {
+		switch {
+		case marker.Marker == MarkerAPP1 && bytes.HasPrefix(marker.Data, exifHeader):
+			if policy&MetadataEXIF != 0 && !copiedEXIF {
+				copiedEXIF = true
+				options.EXIF = marker.Data[len(exifHeader):]
+				if policy&MetadataResetOrientation != 0 {
+					if _, offset, order := exifOrientation(options.EXIF); offset >= 0 {
+						order.PutUint16(options.EXIF[offset:], 1)
+					}
+				}
+			}
+		case marker.Marker == MarkerAPP1 && bytes.HasPrefix(marker.Data, xmpHeader):
+			if policy&MetadataXMP != 0 && !copiedXMP {
+				copiedXMP = true
+				options.XMP = marker.Data[len(xmpHeader):]
+			}
+		case marker.Marker == MarkerCOM:
+			if policy&MetadataComments != 0 {
+				options.Comments = append(options.Comments, string(marker.Data))
+			}
+		case marker.Marker == MarkerAPP2 && bytes.HasPrefix(marker.Data, iccHeader):
+			// ICC profile已经拼好了，由jpeg_write_icc_profile重新拆分
+		case marker.Marker == MarkerAPP0 && bytes.HasPrefix(marker.Data, jfifHeader):
+		case marker.Marker == MarkerAPP14 && bytes.HasPrefix(marker.Data, adobeHeader):
+		default:
+			if policy&MetadataOther != 0 {
+				options.Markers = append(options.Markers, marker)
+			}
+		}
+	}
+	return nil
+}
+
+// markers 除了ICC profile以外，编码时要写的所有段
+func (options *EncodeOptions) markers() []Marker {
+	if options == nil {
+		return nil
+	}
+	var markers []Marker
+	if options.EXIF != nil {
+		markers = append(markers, Marker{Marker: MarkerAPP1, Data: append(append([]byte{}, exifHeader...), options.EXIF...)})
+	}
+	if options.XMP != nil {
+		markers = append(markers, Marker{Marker: MarkerAPP1, Data: append(append([]byte{}, xmpHeader...), options.XMP...)})
+	}
+	for _, comment := range options.Comments {
+		markers = append(markers, Marker{Marker: MarkerCOM, Data: []byte(comment)})
+	}
+	return append(markers, options.Markers...)
+}
+
+// hasMetadata 是否需要写元数据
+func (options *EncodeOptions) hasMetadata() bool {
+	return options != nil && (len(options.ICCProfile) > 0 || options.EXIF != nil || options.XMP != nil ||
+		len(options.Comments) > 0 || len(options.Markers) > 0)
+}
+
+// setCMetadata 把元数据复制到C的内存里，设置到co上。返回的函数用来释放这些内存，出错时不需要调用。
+func (options *EncodeOptions) setCMetadata(co *C.jpeg_encode_options) (func(), error) {
+	if !options.hasMetadata() {
+		return func() {}, nil
+	}
+	markers := options.markers()
+	for _, marker := range markers {
+		if (marker.Marker < MarkerAPP0 || marker.Marker > MarkerAPP0+15) && marker.Marker != MarkerCOM {
+			return nil, ErrMarkerInvalid
+		}
+		// JFIF和Adobe由编码器自己写，再写一次就重复了
+		if (marker.Marker == MarkerAPP0 && bytes.HasPrefix(marker.Data, jfifHeader)) ||
+			(marker.Marker == MarkerAPP14 && bytes.HasPrefix(marker.Data, adobeHeader)) {
+			return nil, ErrMarkerInvalid
+		}
+		if len(marker.Data) > maxMarkerDataLength {
+			return nil, ErrMarkerInvalid
+		}
+	}
+	if len(options.ICCProfile) > 0 {
+		co.icc_profile = (*C.uchar)(C.CBytes(options.ICCProfile))
+		co.icc_profile_size = C.uint(uint(len(options.ICCProfile)))
+	}
+	if len(markers) > 0 {
+		co.markers = (*C.jpeg_marker)(C.malloc(C.size_t(len(markers)) * C.size_t(unsafe.Sizeof(C.jpeg_marker{}))))
+		co.num_markers = C.int(len(markers))
+		cMarkers := unsafe.Slice(co.markers, len(markers))
+		for i, marker := range markers {
+			cMarkers[i] = C.jpeg_marker{marker: C.int(marker.Marker), data_length: C.uint(uint(len(marker.Data)))}
+			if len(marker.Data) > 0 {
+				cMarkers[i].data = (*C.uchar)(C.CBytes(marker.Data))
+			}
+		}
+	}
+	return func() {
+		if co.icc_profile != nil {
+			C.free(unsafe.Pointer(co.icc_profile))
+		}
+		if co.markers != nil {
+			for _, marker := range unsafe.Slice(co.markers, int(co.num_markers)) {
+				if marker.data != nil {
+					C.free(unsafe.Pointer(marker.data))
+				}
+			}
+			C.free(unsafe.Pointer(co.markers))
+		}
+	}, nil
+}
+
+// MarkerFilter StripMetadata时要保留哪些元数据，可以组合使用
+type MarkerFilter int
+
+const (
+	// KeepICCProfile 保留ICC profile，去掉之后颜色可能会不准
+	KeepICCProfile MarkerFilter = 1 << iota
+	// KeepOrientation 只保留EXIF里的Orientation，GPS、相机型号等其他EXIF都会被去掉
+	KeepOrientation
+	// KeepEXIF 保留完整的EXIF
+	KeepEXIF
+	// KeepXMP 保留XMP
+	KeepXMP
+	// KeepComments 保留COM段的注释
+	KeepComments
+	// KeepOther 保留其他的APPn段
+	KeepOther
+	// KeepNone 去掉所有的元数据，只保留编码器自己写的JFIF或者Adobe
+	KeepNone MarkerFilter = 0
+)
+
+// StripMetadata 去掉图片中的元数据（如带有GPS和相机信息的EXIF），keep指定要保留的部分。走的是无损变换，不会解码和重新编码，像素
+// 不会有任何变化，适合在公开图片之前保护用户隐私。
+func StripMetadata(img []byte, keep MarkerFilter) ([]byte, error) {
+	config, err := DecodeConfig(img)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := ReadMetadata(img)
+	if err != nil {
+		return nil, err
+	}
+	out, err := Transform(img, TransformNone, &TransformOptions{CopyNone: true, Progressive: config.Progressive})
+	if err != nil {
+		return nil, err
+	}
+	var markers []Marker
+	for _, marker := range metadata.Markers {
+		switch {
+		case marker.Marker == MarkerAPP1 && bytes.HasPrefix(marker.Data, exifHeader):
+			if keep&KeepEXIF != 0 {
+				markers = append(markers, marker)
+				break
+			}
+			orientation, offset, _ := exifOrientation(marker.Data[len(exifHeader):])
+			if keep&KeepOrientation != 0 && offset >= 0 {
+				markers = append(markers, Marker{Marker: MarkerAPP1, Data: orientationExif(orientation)})
+			}
+		case marker.Marker == MarkerAPP1 && bytes.HasPrefix(marker.Data, xmpHeader):
+			if keep&KeepXMP != 0 {
+				markers = append(markers, marker)
+			}
+		case marker.Marker == MarkerAPP2 && bytes.HasPrefix(marker.Data, iccHeader):
+			if keep&KeepICCProfile != 0 {
+				markers = append(markers, marker)
+			}
+		case marker.Marker == MarkerCOM:
+			if keep&KeepComments != 0 {
+				markers = append(markers, marker)
+			}
+		case marker.Marker == MarkerAPP0 && bytes.HasPrefix(marker.Data, jfifHeader):
+		case marker.Marker == MarkerAPP14 && bytes.HasPrefix(marker.Data, adobeHeader):
+		default:
+			if keep&KeepOther != 0 {
+				markers = append(markers, marker)
+			}
+		}
+	}
+	return insertMarkers(out, markers), nil
+}
+
+// orientationExif 只有Orientation的EXIF段，包括开头的"Exif\0\0"
+func orientationExif(orientation int) []byte {
+	data := append([]byte{}, exifHeader...)
+	// TIFF header，IFD0紧跟在header后面
+	data = append(data, 'M', 'M', 0, 42, 0, 0, 0, 8)
+	// IFD0只有一个entry：Orientation，类型SHORT，数量1，后面没有IFD1
+	data = append(data, 0, 1, 0x01, 0x12, 0, tiffTypeShort, 0, 0, 0, 1, byte(orientation>>8), byte(orientation), 0, 0)
+	return append(data, 0, 0, 0, 0)
+}
+
+// insertMarkers 把markers插到JPEG的SOI以及开头的JFIF和Adobe后面
+func insertMarkers(img []byte, markers []Marker) []byte {
+	if len(markers) == 0 {
+		return img
+	}
+	pos := 2
+	for pos+4 <= len(img) && img[pos] == 0xff && (img[pos+1] == MarkerAPP0 || img[pos+1] == MarkerAPP14) {
+		pos += 2 + int(binary.BigEndian.Uint16(img[pos+2:]))
+	}
+	size := len(img)
+	for _, marker := range markers {
+		size += 4 + len(marker.Data)
+	}
+	out := make([]byte, 0, size)
+	out = append(out, img[:pos]...)
+	for _, marker := range markers {
+		out = append(out, 0xff, byte(marker.Marker), byte((len(marker.Data)+2)>>8), byte(len(marker.Data)+2))
+		out = append(out, marker.Data...)
+	}
+	return append(out, img[pos:]...)
+}
@@ -0,0 +1,446 @@
+package gojpegturbo
+
+import (
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTIFFEntry 构造TIFF用的entry，value是已经按字节序编码好的值
+type testTIFFEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// buildTIFF 构造只有IFD0和Exif IFD的TIFF，exifEntries非空时在IFD0里加上Exif IFD的指针
+func buildTIFF(order binary.ByteOrder, entries, exifEntries []testTIFFEntry) []byte {
+	tiff := []byte{'I', 'I', 0, 0, 0, 0, 0, 0}
+	if order == binary.BigEndian {
+		tiff[0], tiff[1] = 'M', 'M'
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	if len(exifEntries) > 0 {
+		entries = append(entries, testTIFFEntry{tag: exifTagExifIFD, typ: tiffTypeLong, count: 1})
+	}
+	// 先写IFD0，再写Exif IFD，最后是超过4字节的值
+	ifd0Size := 2 + 12*len(entries) + 4
+	exifIFD := 8 + ifd0Size
+	dataOffset := exifIFD
+	if len(exifEntries) > 0 {
+		dataOffset += 2 + 12*len(exifEntries) + 4
+	}
+	var data []byte
+	writeIFD := func(entries []testTIFFEntry) {
+		ifd := make([]byte, 2+12*len(entries)+4)
+		order.PutUint16(ifd, uint16(len(entries)))
+		for i, entry := range entries {
+			start := 2 + i*12
+			order.PutUint16(ifd[start:], entry.tag)
+			order.PutUint16(ifd[start+2:], entry.typ)
+			order.PutUint32(ifd[start+4:], entry.count)
+			if entry.tag == exifTagExifIFD {
+				order.PutUint32(ifd[start+8:], uint32(exifIFD))
+			} else if len(entry.value) <= 4 {
+				copy(ifd[start+8:], entry.value)
+			} else {
+				order.PutUint32(ifd[start+8:], uint32(dataOffset+len(data)))
+				data = append(data, entry.value...)
+			}
+		}
+		tiff = append(tiff, ifd...)
+	}
+	writeIFD(entries)
+	if len(exifEntries) > 0 {
+		writeIFD(exifEntries)
+	}
+	return append(tiff, data...)
+}
+
+// asciiEntry ASCII类型的entry，结尾带\0
+func asciiEntry(tag uint16, value string) testTIFFEntry {
+	return testTIFFEntry{tag: tag, typ: tiffTypeASCII, count: uint32(len(value) + 1), value: append([]byte(value), 0)}
+}
+
+// withMarkers 在SOI后面依次插入markers
+func withMarkers(img []byte, markers ...Marker) []byte {
+	out := append([]byte{}, img[:2]...)
+	for _, marker := range markers {
+		out = append(out, 0xff, byte(marker.Marker), byte((len(marker.Data)+2)>>8), byte(len(marker.Data)+2))
+		out = append(out, marker.Data...)
+	}
+	return append(out, img[2:]...)
+}
+
+// iccMarker ICC profile的第seq个APP2段，一共count个
+func iccMarker(seq, count int, data []byte) Marker {
+	return Marker{Marker: MarkerAPP2, Data: append([]byte{'I', 'C', 'C', '_', 'P', 'R', 'O', 'F', 'I', 'L', 'E', 0,
+		byte(seq), byte(count)}, data...)}
+}
+
+func TestReadMetadata(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	metadata, err := ReadMetadata(buf)
+	require.NoError(t, err)
+	assert.Equal(t, &JFIF{MajorVersion: 1, MinorVersion: 1, DensityUnit: 0, XDensity: 1, YDensity: 1}, metadata.JFIF)
+	assert.Nil(t, metadata.Adobe)
+	assert.Nil(t, metadata.ICCProfile)
+	require.Len(t, metadata.Markers, 1)
+	assert.Equal(t, MarkerAPP0, metadata.Markers[0].Marker)
+	exif, err := metadata.EXIF()
+	assert.NoError(t, err)
+	assert.Nil(t, exif)
+	assert.Nil(t, metadata.XMP())
+	assert.Nil(t, metadata.Comments())
+
+	cmyk, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	metadata, err = ReadMetadata(cmyk)
+	require.NoError(t, err)
+	assert.Nil(t, metadata.JFIF)
+	assert.Equal(t, &Adobe{Transform: 2}, metadata.Adobe)
+
+	// 各种元数据都有的图片，ICC profile被拆成了两段，而且顺序是反的
+	tiff := buildTIFF(binary.LittleEndian, []testTIFFEntry{
+		asciiEntry(exifTagMake, "Canon"),
+		asciiEntry(exifTagModel, "EOS"),
+		{tag: exifTagOrientation, typ: tiffTypeShort, count: 1, value: []byte{6, 0}},
+		asciiEntry(exifTagDateTime, "2021:01:02 03:04:05"),
+	}, nil)
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+	img := withMarkers(buf,
+		Marker{Marker: MarkerAPP1, Data: append([]byte("Exif\x00\x00"), tiff...)},
+		Marker{Marker: MarkerAPP1, Data: append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...)},
+		iccMarker(2, 2, []byte("world")),
+		iccMarker(1, 2, []byte("hello ")),
+		Marker{Marker: MarkerCOM, Data: []byte("first")},
+		Marker{Marker: MarkerAPP0 + 5, Data: nil},
+		Marker{Marker: MarkerCOM, Data: []byte("second")},
+	)
+	metadata, err = ReadMetadata(img)
+	require.NoError(t, err)
+	require.Len(t, metadata.Markers, 8)
+	wantMarkers := []int{MarkerAPP1, MarkerAPP1, MarkerAPP2, MarkerAPP2, MarkerCOM, MarkerAPP0 + 5, MarkerCOM, MarkerAPP0}
+	for i, marker := range metadata.Markers {
+		assert.Equal(t, wantMarkers[i], marker.Marker)
+	}
+	assert.Empty(t, metadata.Markers[5].Data)
+	assert.Equal(t, []byte("hello world"), metadata.ICCProfile)
+	assert.Equal(t, xmp, metadata.XMP())
+	assert.Equal(t, []string{"first", "second"}, metadata.Comments())
+	exif, err = metadata.EXIF()
+	require.NoError(t, err)
+	assert.Equal(t, tiff, exif.TIFF)
+	assert.Equal(t, binary.LittleEndian, exif.ByteOrder)
+	assert.Equal(t, 6, exif.Orientation)
+	assert.Equal(t, "Canon", exif.Make)
+	assert.Equal(t, "EOS", exif.Model)
+	assert.Equal(t, "2021:01:02 03:04:05", exif.DateTime)
+
+	// ICC profile不完整的时候忽略掉
+	metadata, err = ReadMetadata(withMarkers(buf, iccMarker(1, 2, []byte("hello "))))
+	require.NoError(t, err)
+	assert.Nil(t, metadata.ICCProfile)
+	assert.Len(t, metadata.Markers, 2)
+
+	_, err = ReadMetadata(nil)
+	assert.Equal(t, ErrEmptyImage, err)
+	errorImg, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+	_, err = ReadMetadata(errorImg)
+	assert.Error(t, err)
+}
+
+func TestParseExif(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			pixelX := make([]byte, 4)
+			order.PutUint32(pixelX, 4000)
+			pixelY := make([]byte, 2)
+			order.PutUint16(pixelY, 3000)
+			orientation := make([]byte, 2)
+			order.PutUint16(orientation, 8)
+			tiff := buildTIFF(order, []testTIFFEntry{
+				asciiEntry(exifTagMake, "NIKON CORPORATION"),
+				asciiEntry(exifTagModel, "Z 6"),
+				{tag: exifTagOrientation, typ: tiffTypeShort, count: 1, value: orientation},
+				asciiEntry(exifTagSoftware, "Ver.1.00"),
+				// 数量超出TIFF的entry会被忽略
+				{tag: exifTagDateTime, typ: tiffTypeASCII, count: 1000},
+			}, []testTIFFEntry{
+				asciiEntry(exifTagDateTimeOriginal, "2020:05:06 07:08:09"),
+				{tag: exifTagPixelXDimension, typ: tiffTypeLong, count: 1, value: pixelX},
+				{tag: exifTagPixelYDimension, typ: tiffTypeShort, count: 1, value: pixelY},
+			})
+			exif, err := ParseExif(tiff)
+			require.NoError(t, err)
+			assert.Equal(t, &Exif{
+				TIFF:             tiff,
+				ByteOrder:        order,
+				Orientation:      8,
+				Make:             "NIKON CORPORATION",
+				Model:            "Z 6",
+				Software:         "Ver.1.00",
+				DateTimeOriginal: "2020:05:06 07:08:09",
+				PixelXDimension:  4000,
+				PixelYDimension:  3000,
+			}, exif)
+		})
+	}
+
+	for _, tiff := range [][]byte{nil, []byte("IIxx\x08\x00\x00\x00"), []byte("XX\x2a\x00\x08\x00\x00\x00")} {
+		_, err := ParseExif(tiff)
+		assert.Equal(t, ErrExifInvalid, err)
+	}
+	// IFD0的偏移超出范围时没有任何tag
+	exif, err := ParseExif([]byte("II\x2a\x00\xff\x00\x00\x00"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, exif.Orientation)
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	// 超过一个段大小的ICC profile会被拆成多个APP2
+	icc := make([]byte, 150000)
+	for i := range icc {
+		icc[i] = byte(i * 7)
+	}
+	tiff := buildTIFF(binary.BigEndian, []testTIFFEntry{asciiEntry(exifTagMake, "Apple")}, nil)
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+	options := &EncodeOptions{
+		Quality:    90,
+		ICCProfile: icc,
+		EXIF:       tiff,
+		XMP:        xmp,
+		Comments:   []string{"hello", "world"},
+		Markers:    []Marker{{Marker: MarkerAPP0 + 9, Data: []byte("custom")}},
+	}
+	out, err := Encode(img, options)
+	require.NoError(t, err)
+	got, err := Decode(out, nil)
+	require.NoError(t, err)
+	assertSimilar(t, img, got)
+
+	metadata, err := ReadMetadata(out)
+	require.NoError(t, err)
+	wantMarkers := []int{MarkerAPP0, MarkerAPP2, MarkerAPP2, MarkerAPP2, MarkerAPP1, MarkerAPP1, MarkerCOM, MarkerCOM,
+		MarkerAPP0 + 9}
+	require.Len(t, metadata.Markers, len(wantMarkers))
+	for i, marker := range metadata.Markers {
+		assert.Equal(t, wantMarkers[i], marker.Marker)
+	}
+	assert.NotNil(t, metadata.JFIF)
+	assert.Equal(t, icc, metadata.ICCProfile)
+	assert.Equal(t, xmp, metadata.XMP())
+	assert.Equal(t, []string{"hello", "world"}, metadata.Comments())
+	assert.Equal(t, []byte("custom"), metadata.Markers[8].Data)
+	exif, err := metadata.EXIF()
+	require.NoError(t, err)
+	assert.Equal(t, "Apple", exif.Make)
+
+	// CMYK的图片元数据写在Adobe后面
+	cmyk, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	cmykImg, err := Decode(cmyk, nil)
+	require.NoError(t, err)
+	out, err = Encode(cmykImg, &EncodeOptions{Comments: []string{"cmyk"}})
+	require.NoError(t, err)
+	metadata, err = ReadMetadata(out)
+	require.NoError(t, err)
+	require.Len(t, metadata.Markers, 2)
+	assert.Equal(t, MarkerAPP14, metadata.Markers[0].Marker)
+	assert.Equal(t, []string{"cmyk"}, metadata.Comments())
+	got, err = Decode(out, nil)
+	require.NoError(t, err)
+	assertSimilar(t, cmykImg, got)
+
+	_, err = Encode(img, &EncodeOptions{Markers: []Marker{{Marker: 0xc0, Data: []byte("sof")}}})
+	assert.Equal(t, ErrMarkerInvalid, err)
+	_, err = Encode(img, &EncodeOptions{EXIF: make([]byte, maxMarkerDataLength)})
+	assert.Equal(t, ErrMarkerInvalid, err)
+	_, err = Encode(img, &EncodeOptions{Markers: []Marker{{Marker: MarkerAPP0, Data: []byte("JFIF\x00\x01\x01")}}})
+	assert.Equal(t, ErrMarkerInvalid, err)
+	err = EncodeWriter(ioutil.Discard, img, &EncodeOptions{Markers: []Marker{{Marker: MarkerAPP14, Data: []byte("Adobe\x00\x64")}}})
+	assert.Equal(t, ErrMarkerInvalid, err)
+	// 其他的APP0和APP14可以写
+	_, err = Encode(img, &EncodeOptions{Markers: []Marker{{Marker: MarkerAPP0, Data: []byte("JFXX\x00")},
+		{Marker: MarkerAPP14, Data: []byte("other")}}})
+	assert.NoError(t, err)
+	_, err = EncodeYUV(image.NewYCbCr(image.Rect(0, 0, 16, 16), image.YCbCrSubsampleRatio420), &EncodeOptions{XMP: xmp})
+	assert.Equal(t, ErrOptionsUnsupported, err)
+}
+
+func TestCopyMetadataFrom(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	src := withMarkers(withOrientation(buf, 6, false),
+		Marker{Marker: MarkerAPP1, Data: []byte("http://ns.adobe.com/xap/1.0/\x00<xmp/>")},
+		iccMarker(1, 2, []byte("hello ")),
+		iccMarker(2, 2, []byte("world")),
+		Marker{Marker: MarkerCOM, Data: []byte("copyright")},
+		Marker{Marker: MarkerAPP0 + 9, Data: []byte("custom")},
+	)
+	tests := []struct {
+		name            string
+		policy          MetadataPolicy
+		wantICC         []byte
+		wantOrientation int
+		wantXMP         []byte
+		wantComments    []string
+		wantMarkers     int
+	}{
+		{
+			name: "all", policy: MetadataAll, wantICC: []byte("hello world"), wantOrientation: 6, wantXMP: []byte("<xmp/>"),
+			wantComments: []string{"copyright"}, wantMarkers: 6,
+		},
+		{
+			name: "icc and exif", policy: MetadataICC | MetadataEXIF | MetadataResetOrientation,
+			wantICC: []byte("hello world"), wantOrientation: 1, wantMarkers: 3,
+		},
+		{name: "comments", policy: MetadataComments, wantComments: []string{"copyright"}, wantMarkers: 2},
+		{name: "none", wantMarkers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := NewEncodeOptions()
+			require.NoError(t, options.CopyMetadataFrom(src, tt.policy))
+			out, err := Encode(img, options)
+			require.NoError(t, err)
+			metadata, err := ReadMetadata(out)
+			require.NoError(t, err)
+			assert.Len(t, metadata.Markers, tt.wantMarkers)
+			// JFIF只有编码器写的一个
+			assert.Equal(t, MarkerAPP0, metadata.Markers[0].Marker)
+			assert.Equal(t, tt.wantICC, metadata.ICCProfile)
+			assert.Equal(t, tt.wantXMP, metadata.XMP())
+			assert.Equal(t, tt.wantComments, metadata.Comments())
+			exif, err := metadata.EXIF()
+			require.NoError(t, err)
+			if tt.wantOrientation == 0 {
+				assert.Nil(t, exif)
+			} else {
+				assert.Equal(t, tt.wantOrientation, exif.Orientation)
+			}
+		})
+	}
+	// 原图不会被修改
+	orientation, _, _ := findOrientation(src)
+	assert.Equal(t, 6, orientation)
+
+	assert.Error(t, NewEncodeOptions().CopyMetadataFrom(nil, MetadataAll))
+}
+
+func TestStripMetadata(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	want, err := Decode(buf, nil)
+	require.NoError(t, err)
+	// 带GPS和相机信息的EXIF
+	tiff := buildTIFF(binary.LittleEndian, []testTIFFEntry{
+		asciiEntry(exifTagMake, "Canon"),
+		{tag: exifTagOrientation, typ: tiffTypeShort, count: 1, value: []byte{6, 0}},
+		{tag: 0x8825, typ: tiffTypeLong, count: 1, value: []byte{0, 0, 0, 0}},
+	}, nil)
+	src := withMarkers(buf,
+		Marker{Marker: MarkerAPP1, Data: append([]byte("Exif\x00\x00"), tiff...)},
+		Marker{Marker: MarkerAPP1, Data: []byte("http://ns.adobe.com/xap/1.0/\x00<xmp/>")},
+		iccMarker(1, 2, []byte("hello ")),
+		iccMarker(2, 2, []byte("world")),
+		Marker{Marker: MarkerCOM, Data: []byte("copyright")},
+		Marker{Marker: MarkerAPP0 + 9, Data: []byte("custom")},
+	)
+	tests := []struct {
+		name            string
+		keep            MarkerFilter
+		wantMarkers     []int
+		wantICC         []byte
+		wantOrientation int
+		wantMake        string
+	}{
+		{name: "none", keep: KeepNone, wantMarkers: []int{MarkerAPP0}},
+		{
+			name: "icc and orientation", keep: KeepICCProfile | KeepOrientation,
+			wantMarkers: []int{MarkerAPP0, MarkerAPP1, MarkerAPP2, MarkerAPP2}, wantICC: []byte("hello world"),
+			wantOrientation: 6,
+		},
+		{
+			name: "exif", keep: KeepEXIF | KeepOrientation, wantMarkers: []int{MarkerAPP0, MarkerAPP1},
+			wantOrientation: 6, wantMake: "Canon",
+		},
+		{
+			name: "others", keep: KeepXMP | KeepComments | KeepOther,
+			wantMarkers: []int{MarkerAPP0, MarkerAPP1, MarkerCOM, MarkerAPP0 + 9},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := StripMetadata(src, tt.keep)
+			require.NoError(t, err)
+			metadata, err := ReadMetadata(out)
+			require.NoError(t, err)
+			require.Len(t, metadata.Markers, len(tt.wantMarkers))
+			for i, marker := range metadata.Markers {
+				assert.Equal(t, tt.wantMarkers[i], marker.Marker)
+			}
+			assert.Equal(t, tt.wantICC, metadata.ICCProfile)
+			exif, err := metadata.EXIF()
+			require.NoError(t, err)
+			if tt.wantOrientation == 0 {
+				assert.Nil(t, exif)
+			} else {
+				assert.Equal(t, tt.wantOrientation, exif.Orientation)
+				assert.Equal(t, tt.wantMake, exif.Make)
+			}
+			// 像素不会有任何变化
+			got, err := Decode(out, nil)
+			require.NoError(t, err)
+			assert.Equal(t, want.Img, got.Img)
+		})
+	}
+
+	// 渐进式和CMYK的图片
+	progressive, err := Transform(src, TransformNone, &TransformOptions{Progressive: true})
+	require.NoError(t, err)
+	out, err := StripMetadata(progressive, KeepNone)
+	require.NoError(t, err)
+	config, err := DecodeConfig(out)
+	require.NoError(t, err)
+	assert.True(t, config.Progressive)
+	metadata, err := ReadMetadata(out)
+	require.NoError(t, err)
+	assert.Len(t, metadata.Markers, 1)
+
+	cmyk, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	want, err = Decode(cmyk, nil)
+	require.NoError(t, err)
+	out, err = StripMetadata(withMarkers(cmyk, Marker{Marker: MarkerCOM, Data: []byte("cmyk")}), KeepComments)
+	require.NoError(t, err)
+	metadata, err = ReadMetadata(out)
+	require.NoError(t, err)
+	require.Len(t, metadata.Markers, 2)
+	assert.Equal(t, MarkerAPP14, metadata.Markers[0].Marker)
+	assert.Equal(t, []string{"cmyk"}, metadata.Comments())
+	got, err := Decode(out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, want.Img, got.Img)
+
+	_, err = StripMetadata(nil, KeepNone)
+	assert.Equal(t, ErrEmptyImage, err)
+	errorImg, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+	_, err = StripMetadata(errorImg, KeepNone)
+	assert.Error(t, err)
+}
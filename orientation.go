@@ -0,0 +1,105 @@
+package gojpegturbo
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// orientationTransforms EXIF的Orientation对应的无损变换，变换后的图片就是正向的
+var orientationTransforms = map[int]TransformOp{
+	1: TransformNone,
+	2: TransformHFlip,
+	3: TransformRot180,
+	4: TransformVFlip,
+	5: TransformTranspose,
+	6: TransformRot90,
+	7: TransformTransverse,
+	8: TransformRot270,
+}
+
+// NormalizeOrientation 按照EXIF的Orientation无损旋转图片，并把Orientation改成1，不认EXIF的客户端（老的浏览器、一些邮件客户端）
+// 也能正确地显示，图片不需要重新编码。
+//
+// 先尝试完美的变换（见TransformOptions的Perfect），图片的宽高不变；边缘有不完整的MCU无法完美变换时，才丢掉这部分MCU（见
+// TransformOptions的Trim），图片最多少一个MCU。渐进式的图片输出的还是渐进式的。EXIF等markers会原样保留，但EXIF里的缩略图不会旋转。
+// 没有EXIF或者Orientation已经是1的时候直接返回img。
+func NormalizeOrientation(img []byte) ([]byte, error) {
+	if len(img) == 0 {
+		return nil, ErrEmptyImage
+	}
+	orientation, _, _ := findOrientation(img)
+	op, ok := orientationTransforms[orientation]
+	if !ok || op == TransformNone {
+		return img, nil
+	}
+	config, err := DecodeConfig(img)
+	if err != nil {
+		return nil, err
+	}
+	out, err := Transform(img, op, &TransformOptions{Perfect: true, Progressive: config.Progressive})
+	if err == ErrTransformNotPerfect {
+		out, err = Transform(img, op, &TransformOptions{Trim: true, Progressive: config.Progressive})
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 变换时EXIF原样复制过去了，直接改输出里的Orientation，长度不变
+	if _, offset, order := findOrientation(out); offset >= 0 {
+		order.PutUint16(out[offset:], 1)
+	}
+	return out, nil
+}
+
+// findOrientation 找到EXIF里的Orientation，返回它的值、值在img中的偏移和EXIF的字节序。没有找到时偏移是-1。
+func findOrientation(img []byte) (int, int, binary.ByteOrder) {
+	if len(img) < 4 || img[0] != 0xff || img[1] != 0xd8 {
+		return 0, -1, nil
+	}
+	for i := 2; i+4 <= len(img); {
+		if img[i] != 0xff {
+			return 0, -1, nil
+		}
+		marker := img[i+1]
+		// 标记前面允许有任意个0xff填充
+		if marker == 0xff {
+			i++
+			continue
+		}
+		// SOS之后是图片数据，EXIF只会在前面
+		if marker == 0xda || marker == 0xd9 {
+			return 0, -1, nil
+		}
+		// TEM和RSTn是没有长度的标记
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(img[i+2:]))
+		if length < 2 || i+2+length > len(img) {
+			return 0, -1, nil
+		}
+		data := img[i+4 : i+2+length]
+		if marker == MarkerAPP1 && bytes.HasPrefix(data, exifHeader) {
+			orientation, offset, order := exifOrientation(data[len(exifHeader):])
+			if offset >= 0 {
+				return orientation, i + 4 + len(exifHeader) + offset, order
+			}
+		}
+		i += 2 + length
+	}
+	return 0, -1, nil
+}
+
+// exifOrientation 从TIFF格式的EXIF中找到IFD0里的Orientation，偏移是相对tiff的开始
+func exifOrientation(tiff []byte) (int, int, binary.ByteOrder) {
+	order, offset, ok := readTIFFHeader(tiff)
+	if !ok {
+		return 0, -1, nil
+	}
+	for _, entry := range readIFD(tiff, order, offset) {
+		if entry.tag == exifTagOrientation && entry.typ == tiffTypeShort && entry.count > 0 {
+			return int(order.Uint16(tiff[entry.offset:])), entry.offset, order
+		}
+	}
+	return 0, -1, nil
+}
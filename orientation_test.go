@@ -0,0 +1,122 @@
+package gojpegturbo
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeOrientation(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, bigEndian := range []bool{false, true} {
+			img := withOrientation(buf, uint16(orientation), bigEndian)
+			out, err := NormalizeOrientation(img)
+			require.NoError(t, err)
+			if orientation == 1 {
+				assert.Equal(t, img, out)
+				continue
+			}
+			value, offset, _ := findOrientation(out)
+			assert.Equal(t, 1, value)
+			assert.Greater(t, offset, 0)
+
+			// 结果和Trim的无损变换一样，再按EXIF旋转也不会有变化
+			transformed, err := Transform(buf, orientationTransforms[orientation], &TransformOptions{Trim: true})
+			require.NoError(t, err)
+			want, err := Decode(transformed, nil)
+			require.NoError(t, err)
+			got, err := Decode(out, &DecodeOptions{AutoOrient: true})
+			require.NoError(t, err)
+			assertSimilar(t, want, got)
+		}
+	}
+
+	out, err := NormalizeOrientation(buf)
+	require.NoError(t, err)
+	assert.Equal(t, buf, out)
+	out, err = NormalizeOrientation(withOrientation(buf, 0, false))
+	require.NoError(t, err)
+	assert.Len(t, out, len(buf)+36)
+	_, err = NormalizeOrientation(nil)
+	assert.Equal(t, ErrEmptyImage, err)
+	errorImg, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+	out, err = NormalizeOrientation(errorImg)
+	require.NoError(t, err)
+	assert.Equal(t, errorImg, out)
+}
+
+func TestNormalizeOrientationProgressive(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	img, err := Decode(buf, nil)
+	require.NoError(t, err)
+	// 4:2:0的MCU是16*16，test.jpg是600*800，宽度不是MCU的整数倍
+	mcuAligned, err := img.ResizeArea(592, 800)
+	require.NoError(t, err)
+	tests := []struct {
+		name        string
+		img         *ImageAttr
+		orientation uint16
+		wantWidth   int
+		wantHeight  int
+	}{
+		{name: "perfect", img: mcuAligned, orientation: 8, wantWidth: 800, wantHeight: 592},
+		// 逆时针旋转90度时右边不完整的MCU会移到上面，只能丢掉
+		{name: "trim", img: img, orientation: 8, wantWidth: 800, wantHeight: 592},
+		// 顺时针旋转90度只需要下边是完整的MCU
+		{name: "rotate 90", img: img, orientation: 6, wantWidth: 800, wantHeight: 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, progressive := range []bool{false, true} {
+				encoded, err := Encode(tt.img, &EncodeOptions{Quality: 90, SubSample: TjSubSample420, Progressive: progressive})
+				require.NoError(t, err)
+				out, err := NormalizeOrientation(withOrientation(encoded, tt.orientation, false))
+				require.NoError(t, err)
+				config, err := DecodeConfig(out)
+				require.NoError(t, err)
+				assert.Equal(t, progressive, config.Progressive)
+				assert.Equal(t, tt.wantWidth, config.OriginWidth)
+				assert.Equal(t, tt.wantHeight, config.OriginHeight)
+			}
+		})
+	}
+	// 只翻转上下时，右边不完整的MCU不用移动，可以完美变换，宽高不变
+	encoded, err := Encode(img, &EncodeOptions{Quality: 90, SubSample: TjSubSample420})
+	require.NoError(t, err)
+	out, err := NormalizeOrientation(withOrientation(encoded, 4, false))
+	require.NoError(t, err)
+	config, err := DecodeConfig(out)
+	require.NoError(t, err)
+	assert.Equal(t, 600, config.OriginWidth)
+	assert.Equal(t, 800, config.OriginHeight)
+}
+
+func TestFindOrientation(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	tests := []struct {
+		name       string
+		img        []byte
+		want       int
+		wantOffset int
+	}{
+		{name: "little endian", img: withOrientation(buf, 6, false), want: 6, wantOffset: 30},
+		{name: "big endian", img: withOrientation(buf, 8, true), want: 8, wantOffset: 30},
+		{name: "no exif", img: buf, wantOffset: -1},
+		{name: "truncated", img: withOrientation(buf, 6, false)[:20], wantOffset: -1},
+		{name: "not jpeg", img: []byte("P5 1 1 255"), wantOffset: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, offset, _ := findOrientation(tt.img)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantOffset, offset)
+		})
+	}
+}
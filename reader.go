@@ -0,0 +1,71 @@
+package gojpegturbo
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// readerBufferSize 流式解码时每次从io.Reader读取的大小
+const readerBufferSize = 32 * 1024
+
+// maxEmptyReads 连续读到0字节且没有错误的最大次数，超过就认为reader没有进展，和bufio一样返回io.ErrNoProgress
+const maxEmptyReads = 100
+
+// jpegReader 给libjpeg的source manager读取数据用，通过cgo.Handle传给C，C里只保存handle，不持有Go的指针
+type jpegReader struct {
+	r     io.Reader
+	err   error // reader返回的错误，io.EOF也会记录下来
+	total int64 // 已经读取的字节数
+}
+
+// goJpegReaderRead 给C调用的读取函数，直接把数据读进C分配的buffer里。返回读到的字节数，0表示EOF，-1表示出错。
+//
+//export goJpegReaderRead
+func goJpegReaderRead(handle C.uintptr_t, buf *C.uchar, size C.int) (n C.int) {
+	reader := cgo.Handle(handle).Value().(*jpegReader)
+	// panic不能穿过C的栈，转成错误交给libjpeg处理
+	defer func() {
+		if r := recover(); r != nil {
+			reader.err = fmt.Errorf("read jpeg panic: %v", r)
+			n = -1
+		}
+	}()
+	return C.int(reader.read(unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))))
+}
+
+// read 读取数据到p，至少读到1个字节才返回，返回0表示EOF，-1表示出错
+func (reader *jpegReader) read(p []byte) int {
+	for i := 0; i < maxEmptyReads; i++ {
+		if reader.err != nil {
+			if reader.err == io.EOF {
+				return 0
+			}
+			return -1
+		}
+		n, err := reader.r.Read(p)
+		reader.total += int64(n)
+		if err != nil {
+			reader.err = err
+		}
+		if n > 0 {
+			return n
+		}
+	}
+	reader.err = io.ErrNoProgress
+	return -1
+}
+
+// readErr 返回reader读取时出现的错误，EOF不算错误
+func (reader *jpegReader) readErr() error {
+	if reader.err == io.EOF {
+		return nil
+	}
+	return reader.err
+}
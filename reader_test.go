@@ -0,0 +1,145 @@
+package gojpegturbo
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// panicReader 读取时panic，用来校验callback里的panic不会穿过C的栈
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) {
+	panic("read panic")
+}
+
+// emptyReader 一直返回0字节且没有错误
+type emptyReader struct{}
+
+func (emptyReader) Read([]byte) (int, error) {
+	return 0, nil
+}
+
+func TestDecodeReader(t *testing.T) {
+	errRead := errors.New("read failed")
+	tests := []struct {
+		name      string
+		filename  string
+		reader    func(buf []byte) io.Reader
+		options   *DecodeOptions
+		wantErr   error
+		wantError bool
+	}{
+		{
+			name:     "case 1",
+			filename: "./testdata/test.jpg",
+			reader:   func(buf []byte) io.Reader { return bytes.NewReader(buf) },
+		},
+		{
+			name:     "case 2-one byte reader",
+			filename: "./testdata/test.jpg",
+			reader:   func(buf []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(buf)) },
+		},
+		{
+			name:     "case 3-half reader",
+			filename: "./testdata/gray.jpg",
+			reader:   func(buf []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(buf)) },
+		},
+		{
+			name:     "case 4-data err reader",
+			filename: "./testdata/cmyk.jpg",
+			reader:   func(buf []byte) io.Reader { return iotest.DataErrReader(bytes.NewReader(buf)) },
+		},
+		{
+			name:     "case 5-crop&scale",
+			filename: "./testdata/test.jpg",
+			reader:   func(buf []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(buf)) },
+			options: &DecodeOptions{
+				CropRect:   &image.Rectangle{Min: image.Point{X: 13, Y: 27}, Max: image.Point{X: 301, Y: 250}},
+				ScaleNum:   3,
+				ScaleDenom: 8,
+			},
+		},
+		{
+			name:     "case 6-read error",
+			filename: "./testdata/test.jpg",
+			reader: func(buf []byte) io.Reader {
+				return io.MultiReader(bytes.NewReader(buf[:1000]), iotest.ErrReader(errRead))
+			},
+			wantErr: errRead,
+		},
+		{
+			name:     "case 7-timeout",
+			filename: "./testdata/test.jpg",
+			reader:   func(buf []byte) io.Reader { return iotest.TimeoutReader(bytes.NewReader(buf)) },
+			wantErr:  iotest.ErrTimeout,
+		},
+		{
+			name:     "case 8-empty",
+			filename: "./testdata/test.jpg",
+			reader:   func(buf []byte) io.Reader { return bytes.NewReader(nil) },
+			wantErr:  ErrEmptyImage,
+		},
+		{
+			name:     "case 9-no progress",
+			filename: "./testdata/test.jpg",
+			reader:   func(buf []byte) io.Reader { return emptyReader{} },
+			wantErr:  io.ErrNoProgress,
+		},
+		{
+			name:      "case 10-truncated",
+			filename:  "./testdata/test.jpg",
+			reader:    func(buf []byte) io.Reader { return bytes.NewReader(buf[:len(buf)/2]) },
+			wantError: true,
+		},
+		{
+			name:      "case 11-panic",
+			filename:  "./testdata/test.jpg",
+			reader:    func(buf []byte) io.Reader { return panicReader{} },
+			wantError: true,
+		},
+		{
+			name:      "case 12-error",
+			filename:  "./testdata/error.jpg",
+			reader:    func(buf []byte) io.Reader { return bytes.NewReader(buf) },
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := ioutil.ReadFile(tt.filename)
+			require.NoError(t, err)
+			got, err := DecodeReader(tt.reader(buf), tt.options)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			want, err := Decode(buf, tt.options)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func BenchmarkDecodeReader(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := DecodeReader(bytes.NewReader(buf), nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
@@ -0,0 +1,81 @@
+// Package register 把gojpegturbo注册成image包的"jpeg"格式解码器。只需要匿名引入：
+//
+//	import _ "github.com/picone/gojpegturbo/register"
+//
+// 之后所有通过image.Decode和image.DecodeConfig解码的JPEG图片都会使用libjpeg-turbo。
+//
+// 不要和image/jpeg一起使用。两个包注册的都是"jpeg"格式，image包只会用先注册的那个，而注册的先后取决于包的初始化顺序，
+// 程序（包括所有间接依赖）里只要引入了image/jpeg，这里注册的解码器就可能不会生效，而且没有任何报错。无法确定依赖里没有
+// image/jpeg时，直接调用这个包的Decode和DecodeConfig，不要通过image.Decode。
+package register
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+
+	"github.com/picone/gojpegturbo"
+)
+
+func init() {
+	image.RegisterFormat("jpeg", "\xff\xd8", Decode, DecodeConfig)
+}
+
+// Decode 解码JPEG图片，返回标准库的图片类型。和image/jpeg一样，YCbCr的图片为*image.YCbCr，灰度图为*image.Gray，
+// CMYK图为*image.CMYK。采样方式不规则等情况下为*image.RGBA。
+func Decode(r io.Reader) (image.Image, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	config, err := gojpegturbo.DecodeConfig(buf)
+	if err != nil {
+		return nil, err
+	}
+	options := gojpegturbo.NewDecodeOptions()
+	switch colorModel(config) {
+	case color.YCbCrModel:
+		// 直接输出YUV平面，省掉颜色空间转换和升采样
+		return gojpegturbo.DecodeToYCbCr(buf)
+	case color.RGBAModel:
+		// 让libjpeg直接输出RGBA，省掉一次Go里的像素转换
+		options.OutputPixelFormat = gojpegturbo.TJPixelFormatRGBA.Ptr()
+	}
+	img, err := gojpegturbo.Decode(buf, options)
+	if err != nil {
+		return nil, err
+	}
+	return img.ToImage(), nil
+}
+
+// DecodeConfig 只读取JPEG图片的header，返回图片宽高和Decode结果对应的颜色模型。
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	config, err := gojpegturbo.DecodeConfigReader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: colorModel(config),
+		Width:      config.OriginWidth,
+		Height:     config.OriginHeight,
+	}, nil
+}
+
+// colorModel 和Decode返回的图片类型保持一致
+func colorModel(config *gojpegturbo.ImageConfig) color.Model {
+	switch config.ColorSpace {
+	case gojpegturbo.ColorSpaceGrayScale:
+		return color.GrayModel
+	case gojpegturbo.ColorSpaceCMYK, gojpegturbo.ColorSpaceYCCK:
+		return color.CMYKModel
+	case gojpegturbo.ColorSpaceYCbCr:
+		// DecodeToYCbCr只支持image.YCbCrSubsampleRatio有的采样方法，其他的（如libjpeg-turbo 3的4:4:1）输出RGBA
+		switch config.SubSample {
+		case gojpegturbo.TjSubSample444, gojpegturbo.TjSubSample422, gojpegturbo.TjSubSample420,
+			gojpegturbo.TjSubSample440, gojpegturbo.TjSubSample411:
+			return color.YCbCrModel
+		}
+	}
+	return color.RGBAModel
+}
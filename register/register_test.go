@@ -0,0 +1,78 @@
+package register
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name       string
+		filename   string
+		wantType   image.Image
+		wantModel  color.Model
+		wantBounds image.Rectangle
+	}{
+		{
+			name:       "case 1-YCbCr",
+			filename:   "../testdata/test.jpg",
+			wantType:   &image.YCbCr{},
+			wantModel:  color.YCbCrModel,
+			wantBounds: image.Rect(0, 0, 600, 800),
+		},
+		{
+			name:       "case 2-gray",
+			filename:   "../testdata/gray.jpg",
+			wantType:   &image.Gray{},
+			wantModel:  color.GrayModel,
+			wantBounds: image.Rect(0, 0, 600, 800),
+		},
+		{
+			name:       "case 3-cmyk",
+			filename:   "../testdata/cmyk.jpg",
+			wantType:   &image.CMYK{},
+			wantModel:  color.CMYKModel,
+			wantBounds: image.Rect(0, 0, 300, 400),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := ioutil.ReadFile(tt.filename)
+			require.NoError(t, err)
+			img, format, err := image.Decode(bytes.NewReader(buf))
+			require.NoError(t, err)
+			assert.Equal(t, "jpeg", format)
+			assert.IsType(t, tt.wantType, img)
+			assert.Equal(t, tt.wantBounds, img.Bounds())
+			config, format, err := image.DecodeConfig(bytes.NewReader(buf))
+			require.NoError(t, err)
+			assert.Equal(t, "jpeg", format)
+			assert.Equal(t, tt.wantModel, config.ColorModel)
+			assert.Equal(t, tt.wantBounds.Dx(), config.Width)
+			assert.Equal(t, tt.wantBounds.Dy(), config.Height)
+
+			// 直接调用的结果和image.Decode一样，不受image/jpeg影响
+			direct, err := Decode(bytes.NewReader(buf))
+			require.NoError(t, err)
+			assert.Equal(t, img, direct)
+			directConfig, err := DecodeConfig(bytes.NewReader(buf))
+			require.NoError(t, err)
+			assert.Equal(t, config, directConfig)
+		})
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	buf, err := ioutil.ReadFile("../testdata/test.jpg")
+	require.NoError(t, err)
+	_, err = Decode(bytes.NewReader(buf[:len(buf)/2]))
+	assert.Error(t, err)
+	_, err = DecodeConfig(bytes.NewReader(buf[:10]))
+	assert.Error(t, err)
+}
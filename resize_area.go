@@ -3,6 +3,7 @@ package gojpegturbo
 import (
 	"errors"
 	"math"
+	"sync"
 )
 
 type areaTableItem struct {
@@ -16,13 +17,49 @@ var (
 	ErrWrongDstSize = errors.New("error input dst image width or height")
 )
 
+// resizeAreaWorkspace ResizeArea用到的权重表和行缓存，放在池子里复用。尺寸不变时权重表不需要重新计算
+type resizeAreaWorkspace struct {
+	hKey, vKey [3]int // 计算权重表的srcSize、dstSize、pixel
+	hTb, vTb   []areaTableItem
+	srcRowBuf  []float32
+	dstRowBuf  []float32
+}
+
+var resizeAreaPool = sync.Pool{
+	New: func() interface{} {
+		return &resizeAreaWorkspace{}
+	},
+}
+
 // ResizeArea 参考opencv的INTER_AREA算法，目前只能用于图片缩小，放大场景下效果不佳。
 func ResizeArea(src *ImageAttr, dstWidth, dstHeight int) (*ImageAttr, error) {
-	if dstWidth > src.ImageWidth || dstHeight > src.ImageHeight || dstWidth == 0 || dstHeight == 0 {
+	if dstWidth > src.ImageWidth || dstHeight > src.ImageHeight || dstWidth <= 0 || dstHeight <= 0 {
 		return nil, ErrWrongDstSize
 	}
-	dst := &ImageAttr{
-		Img:           make([]byte, dstWidth*dstHeight*src.ComponentsNum),
+	dst := newResizedImage(src, make([]byte, dstWidth*dstHeight*src.ComponentsNum), dstWidth, dstHeight)
+	resizeArea(src, dst)
+	return dst, nil
+}
+
+// ResizeAreaInto 和ResizeArea一样，但是结果写到dst.Img里，dst.Img的容量（cap）至少是dstWidth*dstHeight*src.ComponentsNum，
+// 不够时返回ErrBufferTooSmall，dst不会被修改。权重表和行缓存都是复用的，同样尺寸的缩放没有内存分配。dst不能是src。
+func ResizeAreaInto(src, dst *ImageAttr, dstWidth, dstHeight int) error {
+	if dstWidth > src.ImageWidth || dstHeight > src.ImageHeight || dstWidth <= 0 || dstHeight <= 0 {
+		return ErrWrongDstSize
+	}
+	size := dstWidth * dstHeight * src.ComponentsNum
+	if cap(dst.Img) < size {
+		return ErrBufferTooSmall
+	}
+	*dst = *newResizedImage(src, dst.Img[:size], dstWidth, dstHeight)
+	resizeArea(src, dst)
+	return nil
+}
+
+// newResizedImage 缩放结果的ImageAttr，像素放在pix里
+func newResizedImage(src *ImageAttr, pix []byte, dstWidth, dstHeight int) *ImageAttr {
+	return &ImageAttr{
+		Img:           pix,
 		ImageWidth:    dstWidth,
 		ImageHeight:   dstHeight,
 		OriginWidth:   dstWidth,
@@ -30,14 +67,38 @@ func ResizeArea(src *ImageAttr, dstWidth, dstHeight int) (*ImageAttr, error) {
 		ColorSpace:    src.ColorSpace,
 		ComponentsNum: src.ComponentsNum,
 	}
+}
+
+// resizeArea 缩放src到dst，dst的宽高和Img已经设置好了
+func resizeArea(src, dst *ImageAttr) {
+	ws := resizeAreaPool.Get().(*resizeAreaWorkspace)
+	defer resizeAreaPool.Put(ws)
+	dstWidth := dst.ImageWidth
+	rowSize := dstWidth * src.ComponentsNum
 	// 计算各个缩放cell的index和对应权重
-	hTb := calcAreaTable(src.ImageWidth, dst.ImageWidth, src.ComponentsNum)
-	vTb := calcAreaTable(src.ImageHeight, dst.ImageHeight, src.ComponentsNum)
-	dstRowBuf := make([]float32, dstWidth*src.ComponentsNum)
+	if key := [3]int{src.ImageWidth, dst.ImageWidth, src.ComponentsNum}; ws.hKey != key {
+		ws.hTb = calcAreaTable(ws.hTb[:0], src.ImageWidth, dst.ImageWidth, src.ComponentsNum)
+		ws.hKey = key
+	}
+	if key := [3]int{src.ImageHeight, dst.ImageHeight, src.ComponentsNum}; ws.vKey != key {
+		ws.vTb = calcAreaTable(ws.vTb[:0], src.ImageHeight, dst.ImageHeight, src.ComponentsNum)
+		ws.vKey = key
+	}
+	hTb, vTb := ws.hTb, ws.vTb
+	if cap(ws.dstRowBuf) < rowSize {
+		ws.srcRowBuf = make([]float32, rowSize)
+		ws.dstRowBuf = make([]float32, rowSize)
+	}
+	srcRowBuf, dstRowBuf := ws.srcRowBuf[:rowSize], ws.dstRowBuf[:rowSize]
+	for i := range dstRowBuf {
+		dstRowBuf[i] = 0
+	}
 	prevDstIdx := 0
 	for _, vItem := range vTb {
 		// 统计每一行各个pixel加权结果
-		srcRowBuf := make([]float32, dstWidth*src.ComponentsNum)
+		for i := range srcRowBuf {
+			srcRowBuf[i] = 0
+		}
 		srcRowIdx := src.ImageWidth * vItem.srcIdx // 计算当前行src.Img的下标开始
 		if src.ComponentsNum == 3 {
 			for _, hItem := range hTb {
@@ -58,21 +119,24 @@ func ResizeArea(src *ImageAttr, dstWidth, dstHeight int) (*ImageAttr, error) {
 		}
 		// 统计这行并加上vItem.alpha。若是新的dstIdx则输出结果到dst.Img
 		if vItem.dstIdx != prevDstIdx {
-			for i := 0; i < dstWidth*src.ComponentsNum; i++ {
+			for i := 0; i < rowSize; i++ {
 				dst.Img[prevDstIdx*dstWidth+i] = byte(dstRowBuf[i])
 				dstRowBuf[i] = vItem.alpha * srcRowBuf[i]
 			}
 			prevDstIdx = vItem.dstIdx
 		} else {
-			for i := 0; i < dstWidth*src.ComponentsNum; i++ {
+			for i := 0; i < rowSize; i++ {
 				dstRowBuf[i] += vItem.alpha * srcRowBuf[i]
 			}
 		}
 	}
-	return dst, nil
+	// 最后一行在循环里没有输出
+	for i := 0; i < rowSize; i++ {
+		dst.Img[prevDstIdx*dstWidth+i] = byte(dstRowBuf[i])
+	}
 }
 
-// calcAreaTable 计算每个像素的权重。
+// calcAreaTable 计算每个像素的权重，追加到tb后面。
 //
 //	各个变量的位置分布长这样：
 //	0      0.25               1            ...            10              10.75
@@ -80,9 +144,11 @@ func ResizeArea(src *ImageAttr, dstWidth, dstHeight int) (*ImageAttr, error) {
 //	        ↑                 ↑                           ↑                 ↑
 //	     srcStart         srcStartInt      ...        srcEndInt          srcEnd
 //	<---------------------------- cell_width ------------------------------>
-func calcAreaTable(srcSize, dstSize, pixel int) []areaTableItem {
+func calcAreaTable(tb []areaTableItem, srcSize, dstSize, pixel int) []areaTableItem {
 	factor := float32(srcSize) / float32(dstSize)
-	tb := make([]areaTableItem, 0, 2*dstSize) // 2倍的dstSize肯定够用，多申请点避免重新申请内存
+	if cap(tb) < 2*dstSize {
+		tb = make([]areaTableItem, 0, 2*dstSize) // 2倍的dstSize肯定够用，多申请点避免重新申请内存
+	}
 	for i := 0; i < dstSize; i++ {
 		srcStart := float32(i) * factor
 		srcEnd := srcStart + factor // (i+1) * factor
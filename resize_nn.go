@@ -1,22 +1,51 @@
 package gojpegturbo
 
-import "math"
+import (
+	"math"
+	"sync"
+)
+
+// resizeNNPool ResizeNN用到的映射表，放在池子里复用
+var resizeNNPool = sync.Pool{
+	New: func() interface{} {
+		return &[]int{}
+	},
+}
 
 // ResizeNN 邻近插值法缩放图片
 func ResizeNN(src *ImageAttr, dstWidth, dstHeight int) *ImageAttr {
+	dst := newResizedImage(src, make([]byte, dstWidth*dstHeight*src.ComponentsNum), dstWidth, dstHeight)
+	resizeNN(src, dst)
+	return dst
+}
+
+// ResizeNNInto 和ResizeNN一样，但是结果写到dst.Img里，dst.Img的容量（cap）至少是dstWidth*dstHeight*src.ComponentsNum，
+// 不够时返回ErrBufferTooSmall，dst不会被修改。映射表是复用的，缩放时没有内存分配。dst不能是src。
+func ResizeNNInto(src, dst *ImageAttr, dstWidth, dstHeight int) error {
+	if dstWidth <= 0 || dstHeight <= 0 {
+		return ErrWrongDstSize
+	}
+	size := dstWidth * dstHeight * src.ComponentsNum
+	if cap(dst.Img) < size {
+		return ErrBufferTooSmall
+	}
+	*dst = *newResizedImage(src, dst.Img[:size], dstWidth, dstHeight)
+	resizeNN(src, dst)
+	return nil
+}
+
+// resizeNN 缩放src到dst，dst的宽高和Img已经设置好了
+func resizeNN(src, dst *ImageAttr) {
+	dstWidth, dstHeight := dst.ImageWidth, dst.ImageHeight
 	hFactor := float32(src.ImageWidth) / float32(dstWidth)
 	vFactor := float32(src.ImageHeight) / float32(dstHeight)
-	dst := &ImageAttr{
-		Img:           make([]byte, dstWidth*dstHeight*src.ComponentsNum),
-		ImageWidth:    dstWidth,
-		ImageHeight:   dstHeight,
-		OriginWidth:   dstWidth,
-		OriginHeight:  dstHeight,
-		ColorSpace:    src.ColorSpace,
-		ComponentsNum: src.ComponentsNum,
-	}
 	// 先计算映射表，避免后面多次计算。下标代表目标idx，值代表src图片的idx
-	hTb := make([]int, dstWidth)
+	tb := resizeNNPool.Get().(*[]int)
+	defer resizeNNPool.Put(tb)
+	if cap(*tb) < dstWidth {
+		*tb = make([]int, dstWidth)
+	}
+	hTb := (*tb)[:dstWidth]
 	for i := 0; i < dstWidth; i++ {
 		hTb[i] = int(math.Floor(float64(float32(i)*hFactor))) * src.ComponentsNum
 		if hTb[i] >= src.ImageWidth*src.ComponentsNum {
@@ -50,5 +79,4 @@ func ResizeNN(src *ImageAttr, dstWidth, dstHeight int) *ImageAttr {
 			}
 		}
 	}
-	return dst
 }
@@ -0,0 +1,208 @@
+package gojpegturbo
+
+/*
+#cgo linux LDFLAGS: -lturbojpeg
+#cgo darwin LDFLAGS: -L/usr/local/opt/libjpeg-turbo/lib -lturbojpeg
+#cgo darwin CFLAGS: -I/usr/local/opt/libjpeg-turbo/include
+
+#include "goturbo.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+var (
+	// ErrTransformNotPerfect 图片的宽高不是MCU的整数倍，边缘不完整的MCU无法完美地变换
+	ErrTransformNotPerfect = errors.New("transform is not perfect")
+	// ErrCropRectInvalid 剪裁区域不合法，如和图片没有交集，或者无损剪裁时左上角没有对齐MCU
+	ErrCropRectInvalid = errors.New("crop rect invalid")
+)
+
+// TransformOp 无损变换的操作
+type TransformOp int
+
+const (
+	// TransformNone 不变换，可以用来只转成灰度图或者渐进式
+	TransformNone TransformOp = C.TJXOP_NONE
+	// TransformHFlip 水平翻转
+	TransformHFlip TransformOp = C.TJXOP_HFLIP
+	// TransformVFlip 垂直翻转
+	TransformVFlip TransformOp = C.TJXOP_VFLIP
+	// TransformTranspose 沿左上到右下的对角线翻转
+	TransformTranspose TransformOp = C.TJXOP_TRANSPOSE
+	// TransformTransverse 沿右上到左下的对角线翻转
+	TransformTransverse TransformOp = C.TJXOP_TRANSVERSE
+	// TransformRot90 顺时针旋转90度
+	TransformRot90 TransformOp = C.TJXOP_ROT90
+	// TransformRot180 旋转180度
+	TransformRot180 TransformOp = C.TJXOP_ROT180
+	// TransformRot270 顺时针旋转270度，即逆时针旋转90度
+	TransformRot270 TransformOp = C.TJXOP_ROT270
+)
+
+// TransformOptions 无损变换的选项
+//
+// 变换是以MCU为单位进行的，图片的宽高不是MCU的整数倍时，右边和下边不完整的MCU没法移动到其他位置。默认这部分会保留原样不变换，
+// 翻转和旋转后图片的边缘会有一条没变换的像素。设置Trim会丢掉这部分像素，设置Perfect会直接返回ErrTransformNotPerfect。
+type TransformOptions struct {
+	// Perfect 变换无法完美进行时返回ErrTransformNotPerfect，保证图片不会有任何改变
+	Perfect bool
+	// Trim 丢掉边缘不完整的MCU，图片会比原来小一点（最多少一个MCU），但是不会有没变换的边缘
+	Trim bool
+	// Grayscale 只保留亮度分量，输出灰度图
+	Grayscale bool
+	// Progressive 输出渐进式的JPEG
+	Progressive bool
+	// CopyNone 不复制原图中的任何markers，EXIF、ICC profile等都会被去掉
+	CopyNone bool
+	// CropRect 无损剪裁的区域，默认不剪裁。坐标是变换后图片的坐标，Min需要对齐变换后图片的MCU，可以用LosslessCropRect对齐，
+	// 超出图片的部分会被忽略。
+	CropRect *image.Rectangle
+}
+
+// toCOptions 转成C的struct
+func (options *TransformOptions) toCOptions(op TransformOp) *C.jpeg_transform_options {
+	co := &C.jpeg_transform_options{op: C.int(op)}
+	if options == nil {
+		return co
+	}
+	if options.Perfect {
+		co.options |= C.TJXOPT_PERFECT
+	}
+	if options.Trim {
+		co.options |= C.TJXOPT_TRIM
+	}
+	if options.Grayscale {
+		co.options |= C.TJXOPT_GRAY
+	}
+	if options.Progressive {
+		co.options |= C.TJXOPT_PROGRESSIVE
+	}
+	if options.CopyNone {
+		co.options |= C.TJXOPT_COPYNONE
+	}
+	return co
+}
+
+// Transform 无损变换JPEG图片，直接操作DCT系数，不需要解码和重新编码，图片质量不会有任何损失，而且比解码再编码快得多。
+// 图片中的EXIF等markers默认会原样复制过去。
+func Transform(img []byte, op TransformOp, options *TransformOptions) ([]byte, error) {
+	if len(img) == 0 {
+		return nil, ErrEmptyImage
+	}
+	if op < TransformNone || op > TransformRot270 {
+		return nil, ErrOptionsUnsupported
+	}
+	co := options.toCOptions(op)
+	if options != nil && (options.Perfect || options.CropRect != nil) {
+		config, err := DecodeConfig(img)
+		if err != nil {
+			return nil, err
+		}
+		if options.Perfect && !transformPerfect(config, op, options.Grayscale) {
+			return nil, ErrTransformNotPerfect
+		}
+		if options.CropRect != nil {
+			rect, err := alignCropRect(config, *options.CropRect, op, options.Grayscale)
+			if err != nil {
+				return nil, err
+			}
+			if rect.Min != options.CropRect.Min {
+				return nil, ErrCropRectInvalid
+			}
+			co.crop.left = C.uint(uint(rect.Min.X))
+			co.crop.top = C.uint(uint(rect.Min.Y))
+			co.crop.width = C.uint(uint(rect.Dx()))
+			co.crop.height = C.uint(uint(rect.Dy()))
+		}
+	}
+	jres := C.jpeg_transform_result{}
+	C.jpeg_transform((*C.uchar)(unsafe.Pointer(&img[0])), C.ulong(len(img)), co, &jres)
+	if jres.img != nil {
+		defer C.tjFree(jres.img)
+	}
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return nil, fmt.Errorf("jpeg_transform failed, err = %s", C.GoString(jres.err))
+	}
+	return C.GoBytes(unsafe.Pointer(jres.img), C.int(int(jres.img_size))), nil
+}
+
+// transformPerfect 判断变换能否完美进行，即需要移动的边缘都是完整的MCU。和libjpeg-turbo的jtransform_perfect_transform一致。
+func transformPerfect(config *ImageConfig, op TransformOp, grayscale bool) bool {
+	width, height := transformMCUSize(config, grayscale)
+	if width == 0 || height == 0 {
+		// 采样因子不规则的图片交给turbojpeg判断
+		return true
+	}
+	switch op {
+	case TransformHFlip, TransformRot270:
+		return config.OriginWidth%width == 0
+	case TransformVFlip, TransformRot90:
+		return config.OriginHeight%height == 0
+	case TransformTransverse, TransformRot180:
+		return config.OriginWidth%width == 0 && config.OriginHeight%height == 0
+	}
+	return true
+}
+
+// transformMCUSize 变换时原图MCU的宽高，只保留亮度的时候以8x8的块为单位
+func transformMCUSize(config *ImageConfig, grayscale bool) (int, int) {
+	if config.ComponentsNum == 1 || (grayscale && config.ColorSpace == ColorSpaceYCbCr) {
+		return 8, 8
+	}
+	if config.SubSample < 0 || int(config.SubSample) >= len(mcuWidth) {
+		return 0, 0
+	}
+	return mcuWidth[config.SubSample], mcuHeight[config.SubSample]
+}
+
+// LosslessCrop 无损剪裁JPEG图片，不需要解码和重新编码。无损剪裁只能从MCU的边界开始，rect会先用LosslessCropRect对齐，
+// 返回实际剪裁的区域。
+func LosslessCrop(img []byte, rect image.Rectangle) ([]byte, image.Rectangle, error) {
+	config, err := DecodeConfig(img)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	aligned, err := LosslessCropRect(config, rect)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	out, err := Transform(img, TransformNone, &TransformOptions{CropRect: &aligned})
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	return out, aligned, nil
+}
+
+// LosslessCropRect 把任意的剪裁区域对齐成可以无损剪裁的区域：左上角向左上对齐到MCU的边界，右下角不需要对齐，超出图片的部分会被
+// 去掉。对齐后的区域总是包含原来的区域（在图片内的部分）。如4:2:0的图片MCU是16x16，(13,27)-(301,250)会对齐成(0,16)-(301,250)。
+func LosslessCropRect(config *ImageConfig, rect image.Rectangle) (image.Rectangle, error) {
+	return alignCropRect(config, rect, TransformNone, false)
+}
+
+// alignCropRect 按变换后图片的MCU对齐剪裁区域
+func alignCropRect(config *ImageConfig, rect image.Rectangle, op TransformOp, grayscale bool) (image.Rectangle, error) {
+	mcuW, mcuH := transformMCUSize(config, grayscale)
+	if mcuW == 0 || mcuH == 0 {
+		return image.Rectangle{}, ErrSubSampleUnsupported
+	}
+	width, height := config.OriginWidth, config.OriginHeight
+	// 转置类的变换，MCU和图片的宽高都要交换
+	if op == TransformTranspose || op == TransformTransverse || op == TransformRot90 || op == TransformRot270 {
+		mcuW, mcuH = mcuH, mcuW
+		width, height = height, width
+	}
+	rect = rect.Intersect(image.Rect(0, 0, width, height))
+	if rect.Empty() {
+		return image.Rectangle{}, ErrCropRectInvalid
+	}
+	rect.Min.X -= rect.Min.X % mcuW
+	rect.Min.Y -= rect.Min.Y % mcuH
+	return rect, nil
+}
@@ -0,0 +1,238 @@
+package gojpegturbo
+
+import (
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// transformImage 在像素上做和op一样的变换，用来校验无损变换的结果
+func transformImage(img image.Image, op TransformOp) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	transposed := op == TransformTranspose || op == TransformTransverse || op == TransformRot90 || op == TransformRot270
+	dw, dh := w, h
+	if transposed {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch op {
+			case TransformHFlip:
+				sx = w - 1 - x
+			case TransformVFlip:
+				sy = h - 1 - y
+			case TransformTranspose:
+				sx, sy = y, x
+			case TransformTransverse:
+				sx, sy = w-1-y, h-1-x
+			case TransformRot90:
+				sx, sy = y, h-1-x
+			case TransformRot180:
+				sx, sy = w-1-x, h-1-y
+			case TransformRot270:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+func TestTransform(t *testing.T) {
+	// test.jpg是600x800的4:2:0图片，MCU是16x16，宽度不是MCU的整数倍
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	src, err := Decode(buf, nil)
+	require.NoError(t, err)
+	tests := []struct {
+		name        string
+		op          TransformOp
+		wantPerfect bool
+		// 丢掉不完整的MCU后，参与变换的原图区域
+		wantTrimmed image.Rectangle
+	}{
+		{name: "none", op: TransformNone, wantPerfect: true, wantTrimmed: image.Rect(0, 0, 600, 800)},
+		{name: "hflip", op: TransformHFlip, wantTrimmed: image.Rect(0, 0, 592, 800)},
+		{name: "vflip", op: TransformVFlip, wantPerfect: true, wantTrimmed: image.Rect(0, 0, 600, 800)},
+		{name: "transpose", op: TransformTranspose, wantPerfect: true, wantTrimmed: image.Rect(0, 0, 600, 800)},
+		{name: "transverse", op: TransformTransverse, wantTrimmed: image.Rect(0, 0, 592, 800)},
+		{name: "rot90", op: TransformRot90, wantPerfect: true, wantTrimmed: image.Rect(0, 0, 600, 800)},
+		{name: "rot180", op: TransformRot180, wantTrimmed: image.Rect(0, 0, 592, 800)},
+		{name: "rot270", op: TransformRot270, wantTrimmed: image.Rect(0, 0, 592, 800)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := transformImage(src.ToImage().(*image.RGBA).SubImage(tt.wantTrimmed), tt.op)
+
+			out, err := Transform(buf, tt.op, &TransformOptions{Trim: true})
+			require.NoError(t, err)
+			got, err := Decode(out, nil)
+			require.NoError(t, err)
+			assertSimilar(t, want, got)
+
+			out, err = Transform(buf, tt.op, &TransformOptions{Perfect: true})
+			if !tt.wantPerfect {
+				assert.Equal(t, ErrTransformNotPerfect, err)
+				return
+			}
+			require.NoError(t, err)
+			got, err = Decode(out, nil)
+			require.NoError(t, err)
+			assertSimilar(t, want, got)
+		})
+	}
+}
+
+func TestTransformUntrimmed(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	src, err := Decode(buf, nil)
+	require.NoError(t, err)
+	// 不设置Trim的时候尺寸不变，右边不完整的8列保留原样
+	out, err := Transform(buf, TransformHFlip, nil)
+	require.NoError(t, err)
+	got, err := Decode(out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, image.Point{X: 600, Y: 800}, got.Bounds().Size())
+	want := transformImage(src.ToImage().(*image.RGBA).SubImage(image.Rect(0, 0, 592, 800)), TransformHFlip)
+	assertSimilar(t, want, got.ToImage().(*image.RGBA).SubImage(image.Rect(0, 0, 592, 800)))
+	assertSimilar(t, translate(src.ToImage().(*image.RGBA).SubImage(image.Rect(592, 0, 600, 800))),
+		translate(got.ToImage().(*image.RGBA).SubImage(image.Rect(592, 0, 600, 800))))
+}
+
+func TestTransformOptions(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+
+	out, err := Transform(buf, TransformRot90, &TransformOptions{Grayscale: true, Progressive: true})
+	require.NoError(t, err)
+	config, err := DecodeConfig(out)
+	require.NoError(t, err)
+	assert.Equal(t, ColorSpace(ColorSpaceGrayScale), config.ColorSpace)
+	assert.True(t, config.Progressive)
+	assert.Equal(t, 800, config.OriginWidth)
+	assert.Equal(t, 600, config.OriginHeight)
+
+	// 只保留亮度的时候以8x8为单位，600x800的图片可以完美地水平翻转
+	_, err = Transform(buf, TransformHFlip, &TransformOptions{Grayscale: true, Perfect: true})
+	assert.NoError(t, err)
+
+	// cmyk.jpg是300x400的4:2:0图片
+	cmyk, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	out, err = Transform(cmyk, TransformRot180, &TransformOptions{Trim: true})
+	require.NoError(t, err)
+	config, err = DecodeConfig(out)
+	require.NoError(t, err)
+	assert.Equal(t, ColorSpace(ColorSpaceYCCK), config.ColorSpace)
+	assert.Equal(t, 288, config.OriginWidth)
+	assert.Equal(t, 400, config.OriginHeight)
+
+	// 默认复制所有的markers，CopyNone的时候只有编码器写的JFIF
+	commented := withMarkers(buf, Marker{Marker: MarkerCOM, Data: []byte("comment")})
+	out, err = Transform(commented, TransformNone, nil)
+	require.NoError(t, err)
+	metadata, err := ReadMetadata(out)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"comment"}, metadata.Comments())
+	out, err = Transform(commented, TransformNone, &TransformOptions{CopyNone: true})
+	require.NoError(t, err)
+	metadata, err = ReadMetadata(out)
+	require.NoError(t, err)
+	assert.Len(t, metadata.Markers, 1)
+
+	_, err = Transform(nil, TransformRot90, nil)
+	assert.Equal(t, ErrEmptyImage, err)
+	_, err = Transform(buf, TransformOp(100), nil)
+	assert.Equal(t, ErrOptionsUnsupported, err)
+	errorImg, err := ioutil.ReadFile("./testdata/error.jpg")
+	require.NoError(t, err)
+	_, err = Transform(errorImg, TransformRot90, nil)
+	assert.Error(t, err)
+}
+
+func TestLosslessCropRect(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	config, err := DecodeConfig(buf)
+	require.NoError(t, err)
+	grayBuf, err := ioutil.ReadFile("./testdata/gray.jpg")
+	require.NoError(t, err)
+	grayConfig, err := DecodeConfig(grayBuf)
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		config  *ImageConfig
+		rect    image.Rectangle
+		want    image.Rectangle
+		wantErr error
+	}{
+		{name: "unaligned", config: config, rect: image.Rect(13, 27, 301, 250), want: image.Rect(0, 16, 301, 250)},
+		{name: "aligned", config: config, rect: image.Rect(32, 48, 100, 100), want: image.Rect(32, 48, 100, 100)},
+		{name: "out of bounds", config: config, rect: image.Rect(590, 790, 700, 900), want: image.Rect(576, 784, 600, 800)},
+		{name: "empty", config: config, rect: image.Rect(600, 0, 700, 100), wantErr: ErrCropRectInvalid},
+		{name: "gray", config: grayConfig, rect: image.Rect(13, 27, 301, 250), want: image.Rect(8, 24, 301, 250)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LosslessCropRect(tt.config, tt.rect)
+			if tt.wantErr != nil {
+				assert.Equal(t, tt.wantErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLosslessCrop(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	src, err := Decode(buf, nil)
+	require.NoError(t, err)
+	srcImg := src.ToImage().(*image.RGBA)
+
+	out, rect, err := LosslessCrop(buf, image.Rect(13, 27, 301, 250))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 16, 301, 250), rect)
+	got, err := Decode(out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, rect.Size(), got.Bounds().Size())
+	assertSimilar(t, translate(srcImg.SubImage(rect)), got)
+
+	// 旋转后再剪裁，坐标是旋转后的图片的坐标
+	cropRect := image.Rect(160, 32, 400, 500)
+	out, err = Transform(buf, TransformRot90, &TransformOptions{CropRect: &cropRect})
+	require.NoError(t, err)
+	got, err = Decode(out, nil)
+	require.NoError(t, err)
+	want := transformImage(srcImg, TransformRot90).(*image.RGBA).SubImage(cropRect)
+	assertSimilar(t, translate(want), got)
+
+	// 左上角没有对齐MCU
+	cropRect = image.Rect(13, 27, 301, 250)
+	_, err = Transform(buf, TransformNone, &TransformOptions{CropRect: &cropRect})
+	assert.Equal(t, ErrCropRectInvalid, err)
+	_, _, err = LosslessCrop(buf, image.Rect(800, 0, 900, 100))
+	assert.Equal(t, ErrCropRectInvalid, err)
+	_, _, err = LosslessCrop(nil, image.Rect(0, 0, 100, 100))
+	assert.Error(t, err)
+}
+
+func BenchmarkTransform(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := Transform(buf, TransformRot90, nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
@@ -0,0 +1,55 @@
+package gojpegturbo
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// writerBufferSize 流式编码时攒够多少字节写一次io.Writer
+const writerBufferSize = 32 * 1024
+
+// jpegWriter 给libjpeg的destination manager写数据用，通过cgo.Handle传给C，C里只保存handle，不持有Go的指针
+type jpegWriter struct {
+	w     io.Writer
+	err   error // writer返回的错误
+	total int64 // 已经写入的字节数
+}
+
+// goJpegWriterWrite 给C调用的写入函数，直接把C的buffer交给io.Writer。成功返回0，出错返回-1。
+//
+//export goJpegWriterWrite
+func goJpegWriterWrite(handle C.uintptr_t, buf *C.uchar, size C.int) (n C.int) {
+	writer := cgo.Handle(handle).Value().(*jpegWriter)
+	// panic不能穿过C的栈，转成错误交给libjpeg处理
+	defer func() {
+		if r := recover(); r != nil {
+			writer.err = fmt.Errorf("write jpeg panic: %v", r)
+			n = -1
+		}
+	}()
+	return C.int(writer.write(unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))))
+}
+
+// write 把p全部写到writer，成功返回0，出错返回-1
+func (writer *jpegWriter) write(p []byte) int {
+	if writer.err != nil {
+		return -1
+	}
+	n, err := writer.w.Write(p)
+	writer.total += int64(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		writer.err = err
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,243 @@
+package gojpegturbo
+
+/*
+#cgo linux LDFLAGS: -lturbojpeg
+#cgo darwin LDFLAGS: -L/usr/local/opt/libjpeg-turbo/lib -lturbojpeg
+#cgo darwin CFLAGS: -I/usr/local/opt/libjpeg-turbo/include
+
+#include "goturbo.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+var (
+	// ErrSubSampleUnsupported 图片的二次采样方法不支持
+	ErrSubSampleUnsupported = errors.New("sub sample unsupported")
+	// ErrColorSpaceUnsupported 图片的色彩空间不支持，如DecodeYUV只支持YCbCr和灰度图
+	ErrColorSpaceUnsupported = errors.New("color space unsupported")
+)
+
+// subSampleRatios TJSubSample和image.YCbCrSubsampleRatio的对应关系，灰度图没有对应的采样比例
+var subSampleRatios = map[TJSubSample]image.YCbCrSubsampleRatio{
+	TjSubSample444: image.YCbCrSubsampleRatio444,
+	TjSubSample422: image.YCbCrSubsampleRatio422,
+	TjSubSample420: image.YCbCrSubsampleRatio420,
+	TjSubSample440: image.YCbCrSubsampleRatio440,
+	TjSubSample411: image.YCbCrSubsampleRatio411,
+}
+
+// YUVImage YUV平面格式的图片，保留了JPEG原来的二次采样，没有经过颜色空间转换。灰度图只有Y平面。
+//
+// 每个平面的宽高都是按采样因子对齐的（如4:2:0时Y平面的宽高是偶数），可能比实际图片大一点，有效的区域只有Width*Height
+// （Cb、Cr按采样比例缩小）。
+type YUVImage struct {
+	Y, Cb, Cr        []byte
+	YStride, CStride int         // Y平面和Cb、Cr平面每行的字节数
+	Width, Height    int         // 图片宽高
+	SubSample        TJSubSample // 二次采样方法
+}
+
+// DecodeYUV 解码JPEG图片成YUV平面，省掉YCbCr到RGB的颜色空间转换和Cb、Cr的升采样。只支持YCbCr和灰度图，RGB、CMYK等
+// 色彩空间的平面不是YCbCr，返回ErrColorSpaceUnsupported；采样方法没有对应的image.YCbCrSubsampleRatio时返回
+// ErrSubSampleUnsupported。
+func DecodeYUV(img []byte) (*YUVImage, error) {
+	config, err := DecodeConfig(img)
+	if err != nil {
+		return nil, err
+	}
+	if config.ColorSpace != ColorSpaceYCbCr && config.ColorSpace != ColorSpaceGrayScale {
+		return nil, ErrColorSpaceUnsupported
+	}
+	if _, ok := subSampleRatios[config.SubSample]; !ok && config.SubSample != TjSubSampleGray {
+		return nil, ErrSubSampleUnsupported
+	}
+	yuv := newYUVImage(config.OriginWidth, config.OriginHeight, config.SubSample)
+	jres := C.jpeg_decode_yuv_result{}
+	var cbPlane, crPlane *C.uchar
+	if len(yuv.Cb) > 0 {
+		cbPlane = (*C.uchar)(unsafe.Pointer(&yuv.Cb[0]))
+		crPlane = (*C.uchar)(unsafe.Pointer(&yuv.Cr[0]))
+	}
+	C.jpeg_decode_yuv((*C.uchar)(unsafe.Pointer(&img[0])), C.uint(uint(len(img))),
+		(*C.uchar)(unsafe.Pointer(&yuv.Y[0])), cbPlane, crPlane, &jres)
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return nil, fmt.Errorf("jpeg_decode_yuv failed, err = %s", C.GoString(jres.err))
+	}
+	return yuv, nil
+}
+
+// DecodeToYCbCr 解码JPEG图片成*image.YCbCr，采样比例和JPEG原图一致。灰度图的Cb、Cr平面填充成128，按4:2:0采样。
+func DecodeToYCbCr(img []byte) (*image.YCbCr, error) {
+	yuv, err := DecodeYUV(img)
+	if err != nil {
+		return nil, err
+	}
+	return yuv.ToYCbCr()
+}
+
+// newYUVImage 按照turbojpeg的平面尺寸分配各个平面
+func newYUVImage(width, height int, subSample TJSubSample) *YUVImage {
+	yuv := &YUVImage{
+		Width:     width,
+		Height:    height,
+		SubSample: subSample,
+	}
+	yuv.YStride = int(C.tjPlaneWidth(0, C.int(width), C.int(subSample)))
+	yuv.Y = make([]byte, yuv.YStride*int(C.tjPlaneHeight(0, C.int(height), C.int(subSample))))
+	if subSample != TjSubSampleGray {
+		yuv.CStride = int(C.tjPlaneWidth(1, C.int(width), C.int(subSample)))
+		cHeight := int(C.tjPlaneHeight(1, C.int(height), C.int(subSample)))
+		yuv.Cb = make([]byte, yuv.CStride*cHeight)
+		yuv.Cr = make([]byte, yuv.CStride*cHeight)
+	}
+	return yuv
+}
+
+// ToYCbCr 转成*image.YCbCr，和YUVImage共用平面的内存。灰度图会另外分配填充成128的Cb、Cr平面。采样方法没有对应的
+// image.YCbCrSubsampleRatio时返回ErrSubSampleUnsupported。
+func (img *YUVImage) ToYCbCr() (*image.YCbCr, error) {
+	rect := image.Rect(0, 0, img.Width, img.Height)
+	ratio, ok := subSampleRatios[img.SubSample]
+	if !ok {
+		if img.SubSample != TjSubSampleGray {
+			return nil, ErrSubSampleUnsupported
+		}
+		// 灰度图没有颜色分量，补上中性的Cb、Cr
+		ycbcr := &image.YCbCr{
+			Y:              img.Y,
+			YStride:        img.YStride,
+			CStride:        (img.Width + 1) / 2,
+			SubsampleRatio: image.YCbCrSubsampleRatio420,
+			Rect:           rect,
+		}
+		chroma := make([]byte, 2*ycbcr.CStride*((img.Height+1)/2))
+		for i := range chroma {
+			chroma[i] = 0x80
+		}
+		ycbcr.Cb = chroma[:len(chroma)/2]
+		ycbcr.Cr = chroma[len(chroma)/2:]
+		return ycbcr, nil
+	}
+	return &image.YCbCr{
+		Y:              img.Y,
+		Cb:             img.Cb,
+		Cr:             img.Cr,
+		YStride:        img.YStride,
+		CStride:        img.CStride,
+		SubsampleRatio: ratio,
+		Rect:           rect,
+	}, nil
+}
+
+// EncodeYUV 把*image.YCbCr的各个平面直接编码成JPEG，省掉RGB到YCbCr的颜色空间转换和降采样。采样方法沿用图片自身的
+// SubsampleRatio，options.SubSample只有设置成TjSubSampleGray时才生效，此时只编码Y平面输出灰度图。不支持写元数据。
+func EncodeYUV(img *image.YCbCr, options *EncodeOptions) ([]byte, error) {
+	if img == nil || img.Rect.Empty() {
+		return nil, ErrImgEmpty
+	}
+	if options.hasMetadata() {
+		return nil, ErrOptionsUnsupported
+	}
+	subSample := TjSubSampleUnknown
+	for tjSubSample, ratio := range subSampleRatios {
+		if ratio == img.SubsampleRatio {
+			subSample = tjSubSample
+		}
+	}
+	if subSample == TjSubSampleUnknown {
+		return nil, ErrSubSampleUnsupported
+	}
+	if options != nil && options.SubSample == TjSubSampleGray {
+		subSample = TjSubSampleGray
+	}
+	co, err := options.toCOptions()
+	if err != nil {
+		return nil, err
+	}
+	yuv := yuvPlanes(img, subSample)
+	jres := C.jpeg_encode_result{}
+	var cbPlane, crPlane *C.uchar
+	if subSample != TjSubSampleGray {
+		cbPlane = (*C.uchar)(unsafe.Pointer(&yuv.Cb[0]))
+		crPlane = (*C.uchar)(unsafe.Pointer(&yuv.Cr[0]))
+	}
+	C.jpeg_encode_yuv((*C.uchar)(unsafe.Pointer(&yuv.Y[0])), cbPlane, crPlane, C.int(yuv.YStride), C.int(yuv.CStride),
+		C.int(yuv.Width), C.int(yuv.Height), C.int(subSample), co, &jres)
+	if jres.img != nil {
+		defer C.tjFree(jres.img)
+	}
+	if jres.err != nil {
+		defer C.free(unsafe.Pointer(jres.err))
+		return nil, fmt.Errorf("jpeg_encode_yuv failed, err = %s", C.GoString(jres.err))
+	}
+	return C.GoBytes(unsafe.Pointer(jres.img), C.int(int(jres.img_size))), nil
+}
+
+// yuvPlanes 得到可以直接给turbojpeg读取的平面。turbojpeg会按采样因子对齐读取平面，如4:2:0时奇数宽高的图片会多读一行一列，
+// 图片是SubImage时起点也可能不对齐，这些情况需要复制一份补齐边缘的平面，否则直接使用图片的内存。
+func yuvPlanes(img *image.YCbCr, subSample TJSubSample) *YUVImage {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	hFactor, vFactor := mcuWidth[subSample]/8, mcuHeight[subSample]/8
+	planeWidth := int(C.tjPlaneWidth(0, C.int(width), C.int(subSample)))
+	planeHeight := int(C.tjPlaneHeight(0, C.int(height), C.int(subSample)))
+	yOffset := img.YOffset(img.Rect.Min.X, img.Rect.Min.Y)
+	usable := img.Rect.Min.X%hFactor == 0 && img.Rect.Min.Y%vFactor == 0 &&
+		img.YStride >= planeWidth && len(img.Y)-yOffset >= img.YStride*(planeHeight-1)+planeWidth
+	cOffset, cPlaneWidth, cPlaneHeight := 0, 0, 0
+	if subSample != TjSubSampleGray {
+		cOffset = img.COffset(img.Rect.Min.X, img.Rect.Min.Y)
+		cPlaneWidth = int(C.tjPlaneWidth(1, C.int(width), C.int(subSample)))
+		cPlaneHeight = int(C.tjPlaneHeight(1, C.int(height), C.int(subSample)))
+		usable = usable && img.CStride >= cPlaneWidth && len(img.Cb)-cOffset >= img.CStride*(cPlaneHeight-1)+cPlaneWidth &&
+			len(img.Cr)-cOffset >= img.CStride*(cPlaneHeight-1)+cPlaneWidth
+	}
+	if usable {
+		yuv := &YUVImage{
+			Y:         img.Y[yOffset:],
+			YStride:   img.YStride,
+			Width:     width,
+			Height:    height,
+			SubSample: subSample,
+		}
+		if subSample != TjSubSampleGray {
+			yuv.Cb = img.Cb[cOffset:]
+			yuv.Cr = img.Cr[cOffset:]
+			yuv.CStride = img.CStride
+		}
+		return yuv
+	}
+	// 复制一份，超出图片的部分用边缘的像素补齐
+	yuv := newYUVImage(width, height, subSample)
+	for y := 0; y < planeHeight; y++ {
+		row := yuv.Y[y*yuv.YStride : y*yuv.YStride+planeWidth]
+		srcY := img.Rect.Min.Y + minInt(y, height-1)
+		offset := img.YOffset(img.Rect.Min.X, srcY)
+		copy(row, img.Y[offset:offset+width])
+		for x := width; x < planeWidth; x++ {
+			row[x] = row[width-1]
+		}
+	}
+	for y := 0; y < cPlaneHeight; y++ {
+		srcY := img.Rect.Min.Y + minInt(y*vFactor, height-1)
+		for x := 0; x < cPlaneWidth; x++ {
+			offset := img.COffset(img.Rect.Min.X+minInt(x*hFactor, width-1), srcY)
+			yuv.Cb[y*yuv.CStride+x] = img.Cb[offset]
+			yuv.Cr[y*yuv.CStride+x] = img.Cr[offset]
+		}
+	}
+	return yuv
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,213 @@
+package gojpegturbo
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeYUV(t *testing.T) {
+	tests := []struct {
+		name          string
+		filename      string
+		wantSubSample TJSubSample
+		wantYStride   int
+		wantCStride   int
+		wantErr       bool
+	}{
+		{
+			name:          "case 1-420",
+			filename:      "./testdata/test.jpg",
+			wantSubSample: TjSubSample420,
+			wantYStride:   600,
+			wantCStride:   300,
+		},
+		{
+			name:          "case 2-gray",
+			filename:      "./testdata/gray.jpg",
+			wantSubSample: TjSubSampleGray,
+			wantYStride:   600,
+		},
+		{
+			name:     "case 3-cmyk",
+			filename: "./testdata/cmyk.jpg",
+			wantErr:  true,
+		},
+		{
+			name:     "case 4-error",
+			filename: "./testdata/error.jpg",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := ioutil.ReadFile(tt.filename)
+			require.NoError(t, err)
+			got, err := DecodeYUV(buf)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, 600, got.Width)
+			assert.Equal(t, 800, got.Height)
+			assert.Equal(t, tt.wantSubSample, got.SubSample)
+			assert.Equal(t, tt.wantYStride, got.YStride)
+			assert.Equal(t, tt.wantCStride, got.CStride)
+			assert.Equal(t, tt.wantCStride == 0, len(got.Cb) == 0)
+		})
+	}
+}
+
+func TestDecodeToYCbCr(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	want, err := Decode(buf, nil)
+	require.NoError(t, err)
+	for _, subSample := range []TJSubSample{TjSubSample444, TjSubSample422, TjSubSample420, TjSubSample440,
+		TjSubSample411} {
+		options := NewEncodeOptions()
+		options.SubSample = subSample
+		options.Quality = 100
+		src, err := Encode(want, options)
+		require.NoError(t, err)
+		got, err := DecodeToYCbCr(src)
+		require.NoError(t, err)
+		assert.Equal(t, subSampleRatios[subSample], got.SubsampleRatio)
+		assert.Equal(t, want.Bounds(), got.Bounds())
+		assertSimilar(t, want, got)
+	}
+
+	buf, err = ioutil.ReadFile("./testdata/gray.jpg")
+	require.NoError(t, err)
+	want, err = Decode(buf, nil)
+	require.NoError(t, err)
+	got, err := DecodeToYCbCr(buf)
+	require.NoError(t, err)
+	assert.Equal(t, image.YCbCrSubsampleRatio420, got.SubsampleRatio)
+	assertSimilar(t, want, got)
+
+	// 没有对应的image.YCbCrSubsampleRatio的采样方法不能当成灰度图丢掉颜色
+	_, err = (&YUVImage{Width: 1, Height: 1, SubSample: TJSubSample(6), Y: []byte{0}}).ToYCbCr()
+	assert.Equal(t, ErrSubSampleUnsupported, err)
+	_, err = (&YUVImage{Width: 1, Height: 1, SubSample: TjSubSampleUnknown, Y: []byte{0}}).ToYCbCr()
+	assert.Equal(t, ErrSubSampleUnsupported, err)
+
+	// RGB色彩空间的平面不是YCbCr
+	rgb, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	rgbJPEG := withRGBColorSpace(t, rgb)
+	config, err := DecodeConfig(rgbJPEG)
+	require.NoError(t, err)
+	require.Equal(t, ColorSpace(ColorSpaceRGB), config.ColorSpace)
+	_, err = DecodeYUV(rgbJPEG)
+	assert.Equal(t, ErrColorSpaceUnsupported, err)
+	_, err = DecodeToYCbCr(rgbJPEG)
+	assert.Equal(t, ErrColorSpaceUnsupported, err)
+	cmyk, err := ioutil.ReadFile("./testdata/cmyk.jpg")
+	require.NoError(t, err)
+	_, err = DecodeYUV(cmyk)
+	assert.Equal(t, ErrColorSpaceUnsupported, err)
+}
+
+// withRGBColorSpace 去掉JFIF段，加上transform为0的Adobe段，libjpeg会把3个分量当成RGB而不是YCbCr
+func withRGBColorSpace(t *testing.T, img []byte) []byte {
+	if img[2] == 0xff && img[3] == 0xe0 {
+		length := int(img[4])<<8 | int(img[5])
+		img = append(append([]byte{}, img[:2]...), img[4+length:]...)
+	}
+	require.False(t, img[2] == 0xff && img[3] == 0xe0)
+	return withMarkers(img, Marker{Marker: MarkerAPP14, Data: []byte("Adobe\x00\x64\x00\x00\x00\x00\x00")})
+}
+
+func TestEncodeYUV(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	src, err := Decode(buf, nil)
+	require.NoError(t, err)
+	ratios := []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio411}
+	rects := []image.Rectangle{
+		image.Rect(0, 0, 600, 800),
+		image.Rect(0, 0, 333, 211), // 奇数宽高
+		image.Rect(13, 27, 301, 250),
+	}
+	for _, ratio := range ratios {
+		for _, rect := range rects {
+			// 先生成整张图，再按rect截取SubImage，起点不对齐的情况也要能编码
+			ycbcr := image.NewYCbCr(src.Bounds(), ratio)
+			for y := 0; y < src.ImageHeight; y++ {
+				for x := 0; x < src.ImageWidth; x++ {
+					r, g, b, _ := src.At(x, y).RGBA()
+					yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+					ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+					ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+					ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+				}
+			}
+			want := ycbcr.SubImage(rect).(*image.YCbCr)
+			out, err := EncodeYUV(want, &EncodeOptions{Quality: 100})
+			require.NoError(t, err)
+			got, err := Decode(out, nil)
+			require.NoError(t, err)
+			assert.Equal(t, rect.Size(), got.Bounds().Size())
+			assertSimilar(t, translate(want), got)
+		}
+	}
+}
+
+func TestEncodeYUVGray(t *testing.T) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(t, err)
+	ycbcr, err := DecodeToYCbCr(buf)
+	require.NoError(t, err)
+	out, err := EncodeYUV(ycbcr, &EncodeOptions{Quality: 90, SubSample: TjSubSampleGray})
+	require.NoError(t, err)
+	config, err := DecodeConfig(out)
+	require.NoError(t, err)
+	assert.Equal(t, ColorSpace(ColorSpaceGrayScale), config.ColorSpace)
+
+	_, err = EncodeYUV(image.NewYCbCr(image.Rect(0, 0, 10, 10), image.YCbCrSubsampleRatio410), nil)
+	assert.Equal(t, ErrSubSampleUnsupported, err)
+	_, err = EncodeYUV(nil, nil)
+	assert.Equal(t, ErrImgEmpty, err)
+}
+
+// translate 把图片平移到原点，方便和解码结果比较
+func translate(img image.Image) image.Image {
+	dst := image.NewRGBA(image.Rectangle{Max: img.Bounds().Size()})
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			dst.Set(x, y, img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y))
+		}
+	}
+	return dst
+}
+
+func BenchmarkEncodeYUV(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	img, err := DecodeToYCbCr(buf)
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := EncodeYUV(img, nil)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}
+
+func BenchmarkDecodeToYCbCr(b *testing.B) {
+	buf, err := ioutil.ReadFile("./testdata/test.jpg")
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := DecodeToYCbCr(buf)
+		assert.NoError(b, err)
+	}
+	b.SetBytes(int64(len(buf)))
+}